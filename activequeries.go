@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"sort"
+	"time"
+)
+
+// QueryInfo describes a query being run, see ActiveQueries.
+type QueryInfo struct {
+	// Op is the operation running the query: GetValue, FindProviders,
+	// FindPeer, GetClosestPeers or FindPeersConnectedToPeer. Routing table
+	// refreshes run FindPeer queries.
+	Op string
+	// Key is the key the query is for, as sent to peers: a record key, the
+	// bytes of a CID or a peer ID.
+	Key     string
+	Started time.Time
+	Elapsed time.Duration
+
+	// Contacted is the number of peers queried so far, whether or not they
+	// answered.
+	Contacted int
+	// Frontier is the number of peers the query learned of but hasn't
+	// queried yet, including the ones it's dialing or waiting on.
+	Frontier int
+}
+
+// ActiveQueries returns the queries currently running, oldest first. It only
+// takes a snapshot of a few counters per query, so it's cheap enough to be
+// called often, e.g. from a debug HTTP handler.
+func (dht *IpfsDHT) ActiveQueries() []QueryInfo {
+	dht.activeQueriesLk.Lock()
+	infos := make([]QueryInfo, 0, len(dht.activeQueries))
+	for r, started := range dht.activeQueries {
+		infos = append(infos, QueryInfo{
+			Op:      r.query.op,
+			Key:     r.query.key,
+			Started: started,
+		})
+		info := &infos[len(infos)-1]
+		info.Contacted, info.Frontier = r.progress()
+	}
+	dht.activeQueriesLk.Unlock()
+
+	now := time.Now()
+	for i := range infos {
+		infos[i].Elapsed = now.Sub(infos[i].Started)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+func (dht *IpfsDHT) addActiveQuery(r *dhtQueryRunner) {
+	dht.activeQueriesLk.Lock()
+	dht.activeQueries[r] = time.Now()
+	dht.activeQueriesLk.Unlock()
+}
+
+func (dht *IpfsDHT) removeActiveQuery(r *dhtQueryRunner) {
+	dht.activeQueriesLk.Lock()
+	delete(dht.activeQueries, r)
+	dht.activeQueriesLk.Unlock()
+}
+
+// progress returns the number of peers the query contacted and the number of
+// peers it knows of but hasn't queried yet.
+func (r *dhtQueryRunner) progress() (contacted, frontier int) {
+	contacted = r.peersQueried.Size()
+	r.RLock()
+	failed := r.dialsFailed
+	r.RUnlock()
+	frontier = r.peersSeen.Size() - contacted - failed
+	if frontier < 0 {
+		frontier = 0
+	}
+	return contacted, frontier
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestActiveQueries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+	connect(t, ctx, a, b)
+
+	if queries := a.ActiveQueries(); len(queries) != 0 {
+		t.Fatalf("expected no active queries, got %v", queries)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	q := a.newQuery("hello", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		close(started)
+		<-release
+		return &dhtQueryResult{success: true}, nil
+	})
+	q.op = "GetValue"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, []peer.ID{b.self})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the query to start")
+	}
+	queries := a.ActiveQueries()
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 active query, got %v", queries)
+	}
+	if info := queries[0]; info.Op != "GetValue" || info.Key != "hello" || info.Contacted != 0 || info.Frontier != 1 || info.Elapsed <= 0 {
+		t.Fatalf("unexpected query info: %+v", info)
+	}
+
+	close(release)
+	<-done
+	if queries := a.ActiveQueries(); len(queries) != 0 {
+		t.Fatalf("expected the query to be done, got %v", queries)
+	}
+}
@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// dropMisattributedAddrs removes the peers with invalid IDs and the addresses
+// embedding another peer's ID from the closer peers sent by from, reporting
+// each of them to the OnAddrAttributionAnomaly hook.
+func (dht *IpfsDHT) dropMisattributedAddrs(from peer.ID, peers []*pb.Message_Peer) []*pb.Message_Peer {
+	valid := peers[:0]
+	for _, pbp := range peers {
+		id, err := peer.IDFromBytes(pbp.GetId())
+		if err != nil {
+			logger.Debugf("dropping peer with invalid ID %q from %s: %s", pbp.GetId(), from, err)
+			dht.reportAddrAttributionAnomaly(from, peer.ID(pbp.GetId()), nil)
+			continue
+		}
+
+		addrs := pbp.Addrs[:0]
+		for _, b := range pbp.Addrs {
+			addr, err := ma.NewMultiaddrBytes(b)
+			if err != nil {
+				// undecodable addresses are skipped when reading the message anyway.
+				addrs = append(addrs, b)
+				continue
+			}
+			if _, embedded := peer.SplitAddr(addr); embedded != "" && embedded != id {
+				logger.Debugf("dropping address %s of %s from %s: it belongs to %s", addr, id, from, embedded)
+				dht.reportAddrAttributionAnomaly(from, id, addr)
+				continue
+			}
+			addrs = append(addrs, b)
+		}
+		pbp.Addrs = addrs
+		valid = append(valid, pbp)
+	}
+	return valid
+}
+
+func (dht *IpfsDHT) reportAddrAttributionAnomaly(from, claimed peer.ID, addr ma.Multiaddr) {
+	if dht.onAddrAttributionAnomaly != nil {
+		dht.onAddrAttributionAnomaly(from, claimed, addr)
+	}
+}
@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDropMisattributedAddrs(t *testing.T) {
+	from := test.RandPeerIDFatal(t)
+	good := test.RandPeerIDFatal(t)
+	other := test.RandPeerIDFatal(t)
+
+	plain := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	own := ma.StringCast("/ip4/1.2.3.4/tcp/4002/p2p/" + good.Pretty())
+	foreign := ma.StringCast("/ip4/6.6.6.6/tcp/4001/p2p/" + other.Pretty())
+
+	var anomalies []ma.Multiaddr
+	var claimed []peer.ID
+	dht := &IpfsDHT{onAddrAttributionAnomaly: func(f, c peer.ID, addr ma.Multiaddr) {
+		if f != from {
+			t.Errorf("expected the anomaly to be reported for %s, got %s", from, f)
+		}
+		claimed = append(claimed, c)
+		anomalies = append(anomalies, addr)
+	}}
+
+	peers := pb.RawPeerInfosToPBPeers([]peer.AddrInfo{
+		{ID: good, Addrs: []ma.Multiaddr{plain, own, foreign}},
+		{ID: peer.ID("not a multihash"), Addrs: []ma.Multiaddr{plain}},
+	})
+	peers = dht.dropMisattributedAddrs(from, peers)
+
+	if len(peers) != 1 || peer.ID(peers[0].GetId()) != good {
+		t.Fatalf("expected only the valid peer to be kept, got %v", peers)
+	}
+	if addrs := peers[0].Addresses(); len(addrs) != 2 || !addrs[0].Equal(plain) || !addrs[1].Equal(own) {
+		t.Fatalf("expected the misattributed address to be dropped, got %v", addrs)
+	}
+	if len(anomalies) != 2 {
+		t.Fatalf("expected 2 anomalies, got %d", len(anomalies))
+	}
+	if claimed[0] != good || !anomalies[0].Equal(foreign) {
+		t.Errorf("expected %s to be reported for %s, got %s for %s", foreign, good, anomalies[0], claimed[0])
+	}
+	if claimed[1] != peer.ID("not a multihash") || anomalies[1] != nil {
+		t.Errorf("expected the invalid peer ID to be reported, got %s for %q", anomalies[1], claimed[1])
+	}
+}
@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// BootstrapBackoffState is the dial backoff of a bootstrap peer, see the
+// BootstrapPeerBackoff option.
+type BootstrapBackoffState struct {
+	// Failures is the number of times in a row we failed to connect to the
+	// peer.
+	Failures int
+	// Delay is the current backoff, doubling with every failure.
+	Delay time.Duration
+	// RetryAt is the time before which ConnectBootstrapPeers skips the peer.
+	RetryAt time.Time
+}
+
+// bootstrapBackoff tracks the bootstrap peers we failed to connect to.
+type bootstrapBackoff struct {
+	base, max time.Duration
+
+	lk    sync.Mutex
+	peers map[peer.ID]*BootstrapBackoffState
+}
+
+func newBootstrapBackoff(base, max time.Duration) *bootstrapBackoff {
+	return &bootstrapBackoff{
+		base:  base,
+		max:   max,
+		peers: make(map[peer.ID]*BootstrapBackoffState),
+	}
+}
+
+// active returns true if p should not be dialed yet.
+func (b *bootstrapBackoff) active(p peer.ID) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	s, ok := b.peers[p]
+	return ok && time.Now().Before(s.RetryAt)
+}
+
+// failed records a failed dial to p, doubling its backoff up to the max.
+func (b *bootstrapBackoff) failed(p peer.ID) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	s, ok := b.peers[p]
+	if !ok {
+		s = &BootstrapBackoffState{Delay: b.base}
+		b.peers[p] = s
+	} else if s.Delay < b.max {
+		s.Delay *= 2
+	}
+	if s.Delay > b.max {
+		s.Delay = b.max
+	}
+	s.Failures++
+	s.RetryAt = time.Now().Add(s.Delay)
+}
+
+// succeeded clears the backoff of p.
+func (b *bootstrapBackoff) succeeded(p peer.ID) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	delete(b.peers, p)
+}
+
+func (b *bootstrapBackoff) states() map[peer.ID]BootstrapBackoffState {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	out := make(map[peer.ID]BootstrapBackoffState, len(b.peers))
+	for p, s := range b.peers {
+		out[p] = *s
+	}
+	return out
+}
+
+// BootstrapBackoffStates returns the backoff of the bootstrap peers
+// ConnectBootstrapPeers failed to connect to last time it tried them. Peers
+// that were connected to, or never tried, aren't included. It returns nil
+// unless the BootstrapPeerBackoff option is set.
+func (dht *IpfsDHT) BootstrapBackoffStates() map[peer.ID]BootstrapBackoffState {
+	if dht.bootstrapBackoff == nil {
+		return nil
+	}
+	return dht.bootstrapBackoff.states()
+}
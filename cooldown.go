@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// evictionCooldownPeers is the maximum number of recently evicted peers we
+// remember. Once full, the peers evicted longest ago are forgotten early.
+var evictionCooldownPeers = 1024
+
+// evictionCooldown keeps peers out of the routing table for a while after
+// they were evicted, see the EvictionCooldown option.
+type evictionCooldown struct {
+	period  time.Duration
+	evicted *lru.Cache // peer.ID -> time.Time
+}
+
+func newEvictionCooldown(period time.Duration) *evictionCooldown {
+	evicted, err := lru.New(evictionCooldownPeers)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	return &evictionCooldown{period: period, evicted: evicted}
+}
+
+// evict starts the cooldown of p.
+func (c *evictionCooldown) evict(p peer.ID) {
+	c.evicted.Add(p, time.Now())
+}
+
+// end ends the cooldown of p early.
+func (c *evictionCooldown) end(p peer.ID) {
+	c.evicted.Remove(p)
+}
+
+// active returns true if p was evicted less than the cooldown period ago.
+func (c *evictionCooldown) active(p peer.ID) bool {
+	v, ok := c.evicted.Get(p)
+	if !ok {
+		return false
+	}
+	if time.Since(v.(time.Time)) < c.period {
+		return true
+	}
+	c.evicted.Remove(p)
+	return false
+}
@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+func TestEvictionCooldownExpires(t *testing.T) {
+	c := newEvictionCooldown(50 * time.Millisecond)
+	p := test.RandPeerIDFatal(t)
+	if c.active(p) {
+		t.Fatal("expected no cooldown for a peer never evicted")
+	}
+	c.evict(p)
+	if !c.active(p) {
+		t.Fatal("expected the evicted peer to be cooling down")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if c.active(p) {
+		t.Fatal("expected the cooldown to expire")
+	}
+}
+
+func TestEvictionCooldown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.evictionCooldown = newEvictionCooldown(time.Hour)
+	connect(t, ctx, a, b)
+
+	a.routingTable.Remove(b.self)
+	a.Update(ctx, b.self)
+	if a.routingTable.Find(b.self) != "" {
+		t.Fatal("expected the evicted peer not to be added back")
+	}
+
+	// answering one of our requests ends the cooldown.
+	if _, err := a.findPeerSingle(ctx, b.self, test.RandPeerIDFatal(t)); err != nil {
+		t.Fatal(err)
+	}
+	if a.routingTable.Find(b.self) == "" {
+		t.Fatal("expected the useful peer to be added back")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,12 +27,14 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
+	u "github.com/ipfs/go-ipfs-util"
 	logging "github.com/ipfs/go-log"
 	"github.com/jbenet/goprocess"
 	"github.com/jbenet/goprocess/context"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p-record"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/whyrusleeping/base32"
 )
 
@@ -56,6 +59,10 @@ type IpfsDHT struct {
 	ctx  context.Context
 	proc goprocess.Process
 
+	// queryCtx is canceled when the DHT shuts down to abort in-flight queries.
+	queryCtx      context.Context
+	cancelQueries context.CancelFunc
+
 	strmap map[peer.ID]*messageSender
 	smlk   sync.Mutex
 
@@ -67,10 +74,122 @@ type IpfsDHT struct {
 
 	bucketSize int
 
-	autoRefresh           bool
-	rtRefreshQueryTimeout time.Duration
-	rtRefreshPeriod       time.Duration
-	triggerRtRefresh      chan struct{}
+	dsErrPolicy opts.DatastoreErrorPolicy
+
+	selfInResults opts.SelfMode
+
+	provideExtraFanout int
+
+	maxMessageSize            int
+	penalizeOversizedMessages bool
+	maxMessagesPerStream      int
+
+	maxRecordSizes map[string]int // by namespace, "" for the default
+
+	maxCloserPeers int // per response
+
+	seedSources    []opts.PeerSource
+	peerstoreSeeds int      // max extra seeds taken from the peerstore
+	peerstoreKeys  peerKeys // keyspace locations of the peerstore's peers
+
+	queryStats *queryStatsTracker
+
+	selfOnly                  *selfOnlyTracker
+	penalizeSelfOnlyResponses bool
+
+	skipRelayOnly bool
+	ipv6Scopes    opts.IPv6Scope // accepted non-global scopes
+	onQueryDial   func(ctx context.Context, p peer.AddrInfo) bool
+
+	offline *offlineDetector // nil unless queries fail fast when offline
+
+	outboundQueryTransform func(key string) string
+
+	recentResults *recentResults
+	valueCache    *valueCache
+
+	// keys of local records being refreshed in the background.
+	refreshingLk sync.Mutex
+	refreshing   map[string]struct{}
+
+	// replica is set in replica mode, where the datastore is written to by
+	// another node only.
+	replica bool
+
+	keyDenied func(key []byte) bool // nil unless a key denylist is set
+
+	unknownNamespaceFallback record.Validator // nil unless unknown namespaces are accepted
+	unknownNamespaceGet      opts.UnknownNamespaceGetAction
+
+	putLocks *keyLocks // nil unless puts are serialized per key
+
+	onInvalidRecord func(from peer.ID, key string, err error)
+
+	onAddrAttributionAnomaly func(from, claimed peer.ID, addr ma.Multiaddr)
+
+	onCloserPeersSelected func(to peer.ID, target []byte, selected []peer.ID, distances []kb.ID)
+
+	onProviderRecordServed func(to peer.ID, key cid.Cid, numProviders int)
+
+	serveProvidersFreshness time.Duration
+
+	mergeProviderAddrs bool
+
+	onRecordConflict func(key string, records [][]byte, selected int)
+
+	onStalePutRejected          func(from peer.ID, key string, stale, held []byte)
+	returnNewerRecordOnStalePut bool
+
+	onBucketSplit func(newBucketCount int)
+	rtBucketsLk   sync.Mutex
+	rtBuckets     int // last bucket count seen, guarded by rtBucketsLk
+
+	rtHealth *rtHealth // nil unless health changes are reported
+
+	newPeerGracePeriod time.Duration
+	evictionCooldown   *evictionCooldown // nil if disabled
+	rtPeersAddedAt     map[peer.ID]time.Time
+	rtPeersPingedAt    map[peer.ID]time.Time // peers last pinged by the verifier
+	rtPeersLk          sync.Mutex
+
+	maxPeerAge     time.Duration
+	peerVerifyProc goprocess.Process
+
+	bootstrapDialConcurrency int
+	identifyWaitTimeout      time.Duration
+	bootstrapBackoff         *bootstrapBackoff // nil if disabled
+
+	healthyAfterQueries int
+	warmUpQueries       int32 // queries answered, up to healthyAfterQueries
+
+	queryConcurrencyInitial int // 0 for the default, maxQueryConcurrency
+	queryConcurrencyMax     int // concurrency queries may grow to when stalled
+
+	queryTraces *queryTraceHistory // nil unless queries are traced
+
+	activeQueriesLk sync.Mutex
+	activeQueries   map[*dhtQueryRunner]time.Time // running queries and when they started
+
+	autoRefresh             bool
+	rtRefreshQueryTimeout   time.Duration
+	rtRefreshPeriod         time.Duration
+	rtSparseBucketThreshold float64 // fraction of bucketSize above which buckets aren't refreshed
+	rtMinBucketFullness     float64 // fraction of bucketSize below which buckets are always refreshed
+	rtMaxRefreshBuckets     int
+	rtPrioritizeClosest     bool // refresh the bucket closest to self more often and harder
+	triggerRtRefresh        chan struct{}
+	rtRefreshEscalation     *refreshEscalation // nil if disabled
+	onRefreshComplete       func(opts.RefreshResult)
+	onIsolation             func(opts.RefreshResult)
+	rebootstrapPeers        []peer.AddrInfo // nil unless ReBootstrapOnIsolation is set
+	onRefreshTarget         func(bucketID int, target peer.ID)
+	rtRefreshProc           goprocess.Process // guarded by rtRefreshWorker.mu
+	rtRefreshWorker         refreshWorker
+
+	reprovideSource   opts.ContentSource
+	reprovideInterval time.Duration
+	reprovideRegions  *regionLimiter // nil unless provides are throttled per region
+	reprovideProc     goprocess.Process
 }
 
 // Assert that IPFS assumptions about interfaces aren't broken. These aren't a
@@ -90,29 +209,143 @@ func New(ctx context.Context, h host.Host, options ...opts.Option) (*IpfsDHT, er
 	if err := cfg.Apply(append([]opts.Option{opts.Defaults}, options...)...); err != nil {
 		return nil, err
 	}
-	dht := makeDHT(ctx, h, cfg.Datastore, cfg.Protocols, cfg.BucketSize)
+	fallback, err := unknownNamespaceFallback(cfg.Validator, cfg.UnknownNamespace.Action, cfg.UnknownNamespace.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	provOpts := []providers.Option{
+		providers.MaxRecordsPerPeer(cfg.MaxProviderRecordsPerPeer),
+		providers.MinRefreshInterval(cfg.MinProviderRefreshInterval),
+		providers.RecordLimits(cfg.ProviderRecordLimits.Soft, cfg.ProviderRecordLimits.Hard),
+		providers.EvictionWeights(cfg.ProviderRecordLimits.RecencyWeight, cfg.ProviderRecordLimits.DistanceWeight),
+	}
+	if cfg.Replica {
+		provOpts = append(provOpts, providers.ReadOnly())
+	}
+	dstore := cfg.Datastore
+	if cfg.DatastoreLatencyHook != nil {
+		dstore = &timedDatastore{Batching: dstore, hook: cfg.DatastoreLatencyHook}
+	}
+	dht := makeDHT(ctx, h, dstore, cfg.Protocols, cfg.BucketSize, provOpts...)
+	dht.replica = cfg.Replica
+	dht.keyDenied = cfg.KeyDenylist
 	dht.autoRefresh = cfg.RoutingTable.AutoRefresh
 	dht.rtRefreshPeriod = cfg.RoutingTable.RefreshPeriod
 	dht.rtRefreshQueryTimeout = cfg.RoutingTable.RefreshQueryTimeout
+	dht.rtSparseBucketThreshold = cfg.RoutingTable.SparseBucketThreshold
+	dht.rtMinBucketFullness = cfg.RoutingTable.MinBucketFullness
+	dht.rtMaxRefreshBuckets = cfg.RoutingTable.MaxRefreshBuckets
+	dht.rtPrioritizeClosest = cfg.RoutingTable.PrioritizeClosestBucket
+	dht.onRefreshComplete = cfg.OnRefreshComplete
+	dht.onIsolation = cfg.OnIsolation
+	if cfg.ReBootstrapOnIsolation.Enabled {
+		dht.rebootstrapPeers = cfg.ReBootstrapOnIsolation.Peers
+		if len(dht.rebootstrapPeers) == 0 {
+			if dht.rebootstrapPeers, err = peer.AddrInfosFromP2pAddrs(DefaultBootstrapPeers...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	dht.onRefreshTarget = cfg.OnRefreshTarget
+	if cfg.RoutingTable.EscalateAfter > 0 {
+		dht.rtRefreshEscalation = newRefreshEscalation(cfg.RoutingTable.EscalateAfter, cfg.RoutingTable.EscalationWindow)
+	}
+	dht.dsErrPolicy = cfg.DatastoreErrorPolicy
+	dht.selfInResults = cfg.SelfInResults
+	dht.provideExtraFanout = cfg.ProvideExtraFanout
+	dht.maxMessageSize = cfg.MaxMessageSize
+	dht.penalizeOversizedMessages = cfg.PenalizeOversizedMessages
+	dht.maxMessagesPerStream = cfg.MaxMessagesPerStream
+	dht.maxRecordSizes = cfg.MaxRecordSizes
+	dht.maxCloserPeers = cfg.MaxCloserPeersPerResponse
+	if dht.maxCloserPeers == 0 {
+		dht.maxCloserPeers = 2 * cfg.BucketSize
+	}
+	dht.seedSources = cfg.QuerySeedSources
+	dht.peerstoreSeeds = cfg.PeerstoreSeeds
+	dht.newPeerGracePeriod = cfg.NewPeerGracePeriod
+	if cfg.EvictionCooldown > 0 {
+		dht.evictionCooldown = newEvictionCooldown(cfg.EvictionCooldown)
+	}
+	dht.bootstrapDialConcurrency = cfg.BootstrapDialConcurrency
+	dht.identifyWaitTimeout = cfg.IdentifyWaitTimeout
+	if cfg.BootstrapBackoff.Base > 0 {
+		dht.bootstrapBackoff = newBootstrapBackoff(cfg.BootstrapBackoff.Base, cfg.BootstrapBackoff.Max)
+	}
+	dht.healthyAfterQueries = cfg.HealthyAfterQueries
+	dht.queryConcurrencyInitial = cfg.QueryConcurrency.Initial
+	dht.queryConcurrencyMax = cfg.QueryConcurrency.Max
+	if cfg.QueryTraceHistory > 0 {
+		dht.queryTraces = newQueryTraceHistory(cfg.QueryTraceHistory)
+	}
+	dht.penalizeSelfOnlyResponses = cfg.PenalizeSelfOnlyResponses
+	dht.skipRelayOnly = cfg.SkipRelayOnlyPeers
+	dht.ipv6Scopes = cfg.IPv6Scopes
+	dht.onQueryDial = cfg.OnQueryDial
+	if cfg.FailFastWhenOffline {
+		dht.offline = new(offlineDetector)
+	}
+	dht.outboundQueryTransform = cfg.OutboundQueryTransform
+	if cfg.SerializePuts {
+		dht.putLocks = newKeyLocks()
+	}
+	if cfg.RecentResults.Size > 0 {
+		dht.recentResults = newRecentResults(cfg.RecentResults.TTL, cfg.RecentResults.Size)
+	}
+	if cfg.ValueCache.Size > 0 {
+		dht.valueCache = newValueCache(cfg.ValueCache.TTL, cfg.ValueCache.Size)
+	}
+	dht.onInvalidRecord = cfg.OnInvalidRecord
+	dht.onAddrAttributionAnomaly = cfg.OnAddrAttributionAnomaly
+	dht.onCloserPeersSelected = cfg.OnCloserPeersSelected
+	dht.onProviderRecordServed = cfg.OnProviderRecordServed
+	dht.serveProvidersFreshness = cfg.ServeProvidersFreshnessThreshold
+	dht.mergeProviderAddrs = cfg.MergeProviderAddrs
+	dht.onRecordConflict = cfg.OnRecordConflict
+	dht.onStalePutRejected = cfg.OnStalePutRejected
+	dht.returnNewerRecordOnStalePut = cfg.ReturnNewerRecordOnStalePut
+	dht.onBucketSplit = cfg.OnBucketSplit
+	dht.unknownNamespaceGet = cfg.UnknownNamespaceGet
+	if cfg.OnRoutingTableHealthChange != nil {
+		dht.rtHealth = newRTHealth(cfg.OnRoutingTableHealthChange, dht.routingTable.Size)
+	}
 
 	// register for network notifs.
 	dht.host.Network().Notify((*netNotifiee)(dht))
 
-	dht.proc = goprocessctx.WithContextAndTeardown(ctx, func() error {
-		// remove ourselves from network notifs.
-		dht.host.Network().StopNotify((*netNotifiee)(dht))
-		return nil
-	})
-
-	dht.proc.AddChild(dht.providers.Process())
+	dht.proc = goprocessctx.WithContextAndTeardown(ctx, dht.teardown)
 	dht.Validator = cfg.Validator
+	dht.unknownNamespaceFallback = fallback
 
 	if !cfg.Client {
 		for _, p := range cfg.Protocols {
 			h.SetStreamHandler(p, dht.handleNewStream)
 		}
 	}
+
+	// handle the connections opened before we registered for notifs like
+	// new ones, so the first refresh already has peers to start from.
+	if cfg.SeedFromExistingConnections {
+		nn := (*netNotifiee)(dht)
+		for _, c := range h.Network().Conns() {
+			nn.Connected(h.Network(), c)
+		}
+	}
 	dht.startRefreshing()
+
+	if cfg.Reprovide.Source != nil {
+		dht.reprovideSource = cfg.Reprovide.Source
+		dht.reprovideInterval = cfg.Reprovide.Interval
+		if cfg.Reprovide.RegionConcurrency > 0 {
+			dht.reprovideRegions = newRegionLimiter(cfg.Reprovide.RegionBits, cfg.Reprovide.RegionConcurrency)
+		}
+		dht.startReproviding()
+	}
+
+	if cfg.RoutingTable.MaxPeerAge > 0 {
+		dht.maxPeerAge = cfg.RoutingTable.MaxPeerAge
+		dht.startVerifyingPeers()
+	}
 	return dht, nil
 }
 
@@ -139,17 +372,8 @@ func NewDHTClient(ctx context.Context, h host.Host, dstore ds.Batching) *IpfsDHT
 	return dht
 }
 
-func makeDHT(ctx context.Context, h host.Host, dstore ds.Batching, protocols []protocol.ID, bucketSize int) *IpfsDHT {
+func makeDHT(ctx context.Context, h host.Host, dstore ds.Batching, protocols []protocol.ID, bucketSize int, provOpts ...providers.Option) *IpfsDHT {
 	rt := kb.NewRoutingTable(bucketSize, kb.ConvertPeerID(h.ID()), time.Minute, h.Peerstore())
-	cmgr := h.ConnManager()
-
-	rt.PeerAdded = func(p peer.ID) {
-		cmgr.TagPeer(p, "kbucket", 5)
-	}
-
-	rt.PeerRemoved = func(p peer.ID) {
-		cmgr.UntagPeer(p, "kbucket")
-	}
 
 	dht := &IpfsDHT{
 		datastore:        dstore,
@@ -158,19 +382,100 @@ func makeDHT(ctx context.Context, h host.Host, dstore ds.Batching, protocols []p
 		host:             h,
 		strmap:           make(map[peer.ID]*messageSender),
 		ctx:              ctx,
-		providers:        providers.NewProviderManager(ctx, h.ID(), dstore),
+		providers:        providers.NewProviderManager(ctx, h.ID(), dstore, provOpts...),
 		birth:            time.Now(),
 		routingTable:     rt,
 		protocols:        protocols,
 		bucketSize:       bucketSize,
 		triggerRtRefresh: make(chan struct{}),
+		queryStats:       newQueryStatsTracker(),
+		selfOnly:         newSelfOnlyTracker(),
+		rtPeersAddedAt:   make(map[peer.ID]time.Time),
+		rtPeersPingedAt:  make(map[peer.ID]time.Time),
+		activeQueries:    make(map[*dhtQueryRunner]time.Time),
+		rtBuckets:        len(rt.Buckets),
 	}
 
+	dht.rtRefreshWorker.wake = make(chan struct{}, 1)
+
+	rt.PeerAdded = dht.rtPeerAdded
+	rt.PeerRemoved = dht.rtPeerRemoved
+
 	dht.ctx = dht.newContextWithLocalTags(ctx)
+	dht.queryCtx, dht.cancelQueries = context.WithCancel(dht.ctx)
 
 	return dht
 }
 
+// closeError aggregates the errors encountered while closing the DHT.
+type closeError []error
+
+func (e closeError) Error() string {
+	strs := make([]string, len(e))
+	for i, err := range e {
+		strs[i] = err.Error()
+	}
+	return "failed to close the dht: " + strings.Join(strs, "; ")
+}
+
+// teardown shuts down the DHT's components in order:
+//
+// 1. Stop accepting inbound requests and network notifications.
+// 2. Cancel in-flight queries.
+// 3. Stop the routing table refresh and reprovide workers.
+// 4. Stop the provider record GC and flush the provider store.
+// 5. Reset all outbound streams.
+func (dht *IpfsDHT) teardown() error {
+	var errs closeError
+
+	for _, p := range dht.protocols {
+		dht.host.RemoveStreamHandler(p)
+	}
+	dht.host.Network().StopNotify((*netNotifiee)(dht))
+	if dht.rtHealth != nil {
+		dht.rtHealth.stop()
+	}
+
+	dht.cancelQueries()
+
+	if err := dht.stopRefreshing(); err != nil {
+		errs = append(errs, xerrors.Errorf("stopping the refresh worker: %w", err))
+	}
+
+	if dht.reprovideProc != nil {
+		if err := dht.reprovideProc.Close(); err != nil {
+			errs = append(errs, xerrors.Errorf("stopping the reprovide worker: %w", err))
+		}
+	}
+
+	if dht.peerVerifyProc != nil {
+		if err := dht.peerVerifyProc.Close(); err != nil {
+			errs = append(errs, xerrors.Errorf("stopping the peer verifier: %w", err))
+		}
+	}
+
+	if err := dht.providers.Process().Close(); err != nil {
+		errs = append(errs, xerrors.Errorf("closing the provider store: %w", err))
+	}
+
+	dht.smlk.Lock()
+	for p, ms := range dht.strmap {
+		delete(dht.strmap, p)
+		// Do this asynchronously as ms.lk can block for a while.
+		go func(ms *messageSender) {
+			ms.lk.Lock()
+			defer ms.lk.Unlock()
+			ms.invalidate()
+		}(ms)
+	}
+	dht.smlk.Unlock()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
 // TODO Implement RT seeding as described in https://github.com/libp2p/go-libp2p-kad-dht/pull/384#discussion_r320994340 OR
 // come up with an alternative solution.
 // issue is being tracked at https://github.com/libp2p/go-libp2p-kad-dht/issues/387
@@ -206,6 +511,69 @@ func makeDHT(ctx context.Context, h host.Host, dstore ds.Batching, protocols []p
 	}
 }*/
 
+// rtPeerAdded is called when a peer is added to the routing table.
+func (dht *IpfsDHT) rtPeerAdded(p peer.ID) {
+	dht.host.ConnManager().TagPeer(p, "kbucket", 5)
+
+	// the table is locked while it calls us, so we can look at its buckets
+	// directly. it only splits buckets to make room for new peers.
+	dht.bucketsSeen(len(dht.routingTable.Buckets))
+
+	dht.rtPeersLk.Lock()
+	dht.rtPeersAddedAt[p] = time.Now()
+	size := len(dht.rtPeersAddedAt)
+	dht.rtPeersLk.Unlock()
+
+	if dht.rtHealth != nil {
+		dht.rtHealth.changed(size)
+	}
+}
+
+// bucketsSeen reports a split if the routing table has more than the n buckets
+// seen last.
+func (dht *IpfsDHT) bucketsSeen(n int) {
+	dht.rtBucketsLk.Lock()
+	defer dht.rtBucketsLk.Unlock()
+	if n <= dht.rtBuckets {
+		return
+	}
+	dht.rtBuckets = n
+	if dht.onBucketSplit != nil {
+		dht.onBucketSplit(n)
+	}
+}
+
+// rtPeerRemoved is called when a peer is removed from the routing table.
+func (dht *IpfsDHT) rtPeerRemoved(p peer.ID) {
+	dht.host.ConnManager().UntagPeer(p, "kbucket")
+	dht.queryStats.remove(p)
+	if dht.evictionCooldown != nil {
+		dht.evictionCooldown.evict(p)
+	}
+
+	dht.rtPeersLk.Lock()
+	delete(dht.rtPeersAddedAt, p)
+	delete(dht.rtPeersPingedAt, p)
+	size := len(dht.rtPeersAddedAt)
+	dht.rtPeersLk.Unlock()
+
+	if dht.rtHealth != nil {
+		dht.rtHealth.changed(size)
+	}
+}
+
+// inGracePeriod returns true if p was added to the routing table less than
+// the new peer grace period ago.
+func (dht *IpfsDHT) inGracePeriod(p peer.ID) bool {
+	if dht.newPeerGracePeriod <= 0 {
+		return false
+	}
+	dht.rtPeersLk.Lock()
+	addedAt, ok := dht.rtPeersAddedAt[p]
+	dht.rtPeersLk.Unlock()
+	return ok && time.Since(addedAt) < dht.newPeerGracePeriod
+}
+
 // putValueToPeer stores the given key/value pair at the peer 'p'
 func (dht *IpfsDHT) putValueToPeer(ctx context.Context, p peer.ID, rec *recpb.Record) error {
 
@@ -218,6 +586,10 @@ func (dht *IpfsDHT) putValueToPeer(ctx context.Context, p peer.ID, rec *recpb.Re
 	}
 
 	if !bytes.Equal(rpmes.GetRecord().Value, pmes.GetRecord().Value) {
+		if held := rpmes.GetRecord(); dht.isNewerRecord(string(rec.Key), held, rec) {
+			logger.Debugf("putValueToPeer: peer %s holds a newer record for %s", p, loggableKey(string(rec.Key)))
+			return &NewerRecordError{Key: string(rec.Key), Peer: p, Record: held}
+		}
 		logger.Warningf("putValueToPeer: value not put correctly. (%v != %v)", pmes, rpmes)
 		return errors.New("value not put correctly")
 	}
@@ -225,8 +597,29 @@ func (dht *IpfsDHT) putValueToPeer(ctx context.Context, p peer.ID, rec *recpb.Re
 	return nil
 }
 
+// isNewerRecord tells whether held is a valid record for key, better than rec
+// according to the validator.
+func (dht *IpfsDHT) isNewerRecord(key string, held, rec *recpb.Record) bool {
+	if held == nil || !bytes.Equal(held.GetKey(), rec.GetKey()) {
+		return false
+	}
+	if dht.validatorFor(key).Validate(key, held.GetValue()) != nil {
+		return false
+	}
+	i, err := dht.validatorFor(key).Select(key, [][]byte{rec.GetValue(), held.GetValue()})
+	return err == nil && i == 1
+}
+
 var errInvalidRecord = errors.New("received invalid record")
 
+// ErrReadOnlyReplica is returned when trying to store a record on a DHT
+// running in replica mode.
+var ErrReadOnlyReplica = errors.New("dht is a read-only replica")
+
+// ErrKeyDenied is returned by the PUT_VALUE handler for keys on the
+// denylist, see the KeyDenylist option.
+var ErrKeyDenied = errors.New("key is denied")
+
 // getValueOrPeers queries a particular peer p for the value for
 // key. It returns either the value or a list of closer peers.
 // NOTE: It will update the dht's peerstore with any new addresses
@@ -246,9 +639,16 @@ func (dht *IpfsDHT) getValueOrPeers(ctx context.Context, p peer.ID, key string)
 		logger.Debug("getValueOrPeers: got value")
 
 		// make sure record is valid.
-		err = dht.Validator.Validate(string(record.GetKey()), record.GetValue())
+		if dht.unvalidatedGet(key) {
+			err = nil
+		} else {
+			err = dht.validatorFor(string(record.GetKey())).Validate(string(record.GetKey()), record.GetValue())
+		}
 		if err != nil {
 			logger.Info("Received invalid record! (discarded)")
+			if dht.onInvalidRecord != nil {
+				dht.onInvalidRecord(p, key, err)
+			}
 			// return a sentinal to signify an invalid record was received
 			err = errInvalidRecord
 			record = new(recpb.Record)
@@ -307,8 +707,33 @@ func (dht *IpfsDHT) getLocal(key string) (*recpb.Record, error) {
 	return rec, nil
 }
 
+// checkDatastoreError applies the configured datastore error policy to an
+// error returned while storing or retrieving a value. It returns the error if
+// the operation should fail, and nil if it should carry on without the
+// datastore.
+func (dht *IpfsDHT) checkDatastoreError(err error) error {
+	return datastoreErrorPolicy(err, dht.dsErrPolicy == opts.DatastoreErrorDegrade)
+}
+
+// checkProviderDatastoreError is checkDatastoreError for provider records,
+// which only fail the operation under DatastoreErrorFail.
+func (dht *IpfsDHT) checkProviderDatastoreError(err error) error {
+	return datastoreErrorPolicy(err, dht.dsErrPolicy != opts.DatastoreErrorFail)
+}
+
+func datastoreErrorPolicy(err error, degrade bool) error {
+	if err == nil || !degrade || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	logger.Warningf("ignoring datastore error: %s", err)
+	return nil
+}
+
 // putLocal stores the key value pair in the datastore
 func (dht *IpfsDHT) putLocal(key string, rec *recpb.Record) error {
+	if dht.replica {
+		return ErrReadOnlyReplica
+	}
 	logger.Debugf("putLocal: %v %v", key, rec)
 	data, err := proto.Marshal(rec)
 	if err != nil {
@@ -323,7 +748,15 @@ func (dht *IpfsDHT) putLocal(key string, rec *recpb.Record) error {
 // on the given peer.
 func (dht *IpfsDHT) Update(ctx context.Context, p peer.ID) {
 	logger.Event(ctx, "updatePeer", p)
-	dht.routingTable.Update(p)
+	if dht.evictionCooldown != nil && dht.evictionCooldown.active(p) {
+		logger.Debugf("not adding %s back to the routing table during its cooldown", p)
+		return
+	}
+	if _, err := dht.routingTable.Update(p); err == kb.ErrPeerRejectedNoCapacity {
+		// the table may have split its last bucket before finding there's
+		// still no room for p, without adding any peer.
+		dht.bucketsSeen(len(dht.routingTable.GetAllBuckets()))
+	}
 }
 
 // FindLocal looks for a peer with a given ID connected to this dht and returns the peer and the table it was found in.
@@ -349,6 +782,7 @@ func (dht *IpfsDHT) findPeerSingle(ctx context.Context, p peer.ID, id peer.ID) (
 	resp, err := dht.sendRequest(ctx, p, pmes)
 	switch err {
 	case nil:
+		resp.CloserPeers = dht.dropMisattributedAddrs(p, resp.CloserPeers)
 		return resp, nil
 	case ErrReadTimeout:
 		logger.Warningf("read timeout: %s %s", p.Pretty(), id)
@@ -390,6 +824,7 @@ func (dht *IpfsDHT) betterPeersToQuery(pmes *pb.Message, p peer.ID, count int) [
 	// no node? nil
 	if closer == nil {
 		logger.Warning("betterPeersToQuery: no closer peers to send:", p)
+		dht.reportCloserPeersSelected(p, pmes.GetKey(), nil)
 		return nil
 	}
 
@@ -409,10 +844,26 @@ func (dht *IpfsDHT) betterPeersToQuery(pmes *pb.Message, p peer.ID, count int) [
 		filtered = append(filtered, clp)
 	}
 
+	dht.reportCloserPeersSelected(p, pmes.GetKey(), filtered)
+
 	// ok seems like closer nodes
 	return filtered
 }
 
+// reportCloserPeersSelected calls the OnCloserPeersSelected hook, if set, with
+// the distances of the selected peers to the target.
+func (dht *IpfsDHT) reportCloserPeersSelected(to peer.ID, target []byte, selected []peer.ID) {
+	if dht.onCloserPeersSelected == nil {
+		return
+	}
+	key := kb.ConvertKey(string(target))
+	distances := make([]kb.ID, len(selected))
+	for i, p := range selected {
+		distances[i] = kb.ID(u.XOR(kb.ConvertPeerID(p), key))
+	}
+	dht.onCloserPeersSelected(to, target, selected, distances)
+}
+
 // Context return dht's context
 func (dht *IpfsDHT) Context() context.Context {
 	return dht.ctx
@@ -428,7 +879,44 @@ func (dht *IpfsDHT) RoutingTable() *kb.RoutingTable {
 	return dht.routingTable
 }
 
-// Close calls Process Close
+// ProviderRecordLimitHits returns how many times each peer was denied storing
+// a provider record because it hit the limit set with the
+// MaxProviderRecordsPerPeer option. Only the most recent offenders are
+// reported.
+func (dht *IpfsDHT) ProviderRecordLimitHits() map[peer.ID]int {
+	return dht.providers.LimitHits()
+}
+
+// ProviderRecord is a provider record held by this node.
+type ProviderRecord struct {
+	Provider peer.AddrInfo
+	Expires  time.Time
+}
+
+// ExportProviderRecords returns the unexpired provider records this node holds
+// for the given key, with the provider addresses currently known to the
+// peerstore. It only reads local state; nothing is sent over the network.
+//
+// Note that peers only accept ADD_PROVIDER messages announcing the sender
+// itself, so a node re-announcing these records must be the provider.
+func (dht *IpfsDHT) ExportProviderRecords(key cid.Cid) ([]ProviderRecord, error) {
+	provs, expires, err := dht.providers.GetProvidersWithExpiry(dht.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]ProviderRecord, 0, len(provs))
+	for i, p := range provs {
+		records = append(records, ProviderRecord{
+			Provider: dht.peerstore.PeerInfo(p),
+			Expires:  expires[i],
+		})
+	}
+	return records, nil
+}
+
+// Close shuts down the DHT. See teardown for the order in which components are
+// shut down. It's safe to call Close more than once; subsequent calls return
+// the same error as the first one.
 func (dht *IpfsDHT) Close() error {
 	return dht.proc.Close()
 }
@@ -442,6 +930,33 @@ func (dht *IpfsDHT) protocolStrs() []string {
 	return pstrs
 }
 
+// PeerProtocolVersions returns the DHT protocol we speak with each peer in
+// the routing table: the first of our protocols the peer supports according
+// to the peerstore, which is the one we negotiate with it. Peers the peerstore
+// doesn't know a supported protocol of are left out. This doesn't touch the
+// network.
+func (dht *IpfsDHT) PeerProtocolVersions() map[peer.ID]protocol.ID {
+	protos := dht.protocolStrs()
+	out := make(map[peer.ID]protocol.ID)
+	for _, p := range dht.routingTable.ListPeers() {
+		supported, err := dht.peerstore.SupportsProtocols(p, protos...)
+		if err != nil {
+			continue
+		}
+		// protos is in our order of preference.
+	pick:
+		for _, proto := range protos {
+			for _, s := range supported {
+				if s == proto {
+					out[p] = protocol.ID(proto)
+					break pick
+				}
+			}
+		}
+	}
+	return out
+}
+
 func mkDsKey(s string) ds.Key {
 	return ds.NewKey(base32.RawStdEncoding.EncodeToString([]byte(s)))
 }
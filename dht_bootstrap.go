@@ -2,11 +2,20 @@ package dht
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	process "github.com/jbenet/goprocess"
 	processctx "github.com/jbenet/goprocess/context"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/routing"
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	identify "github.com/libp2p/go-libp2p/p2p/protocol/identify"
 	"github.com/multiformats/go-multiaddr"
 	_ "github.com/multiformats/go-multiaddr-dns"
 )
@@ -17,6 +26,14 @@ var DefaultBootstrapPeers []multiaddr.Multiaddr
 // see a new peer, we trigger a bootstrap round.
 var minRTRefreshThreshold = 4
 
+// closestBucketRefreshFactor is how many times more often the closest bucket
+// is refreshed with the PrioritizeClosestBucket option.
+var closestBucketRefreshFactor = 4
+
+// closestBucketWalks is the number of random IDs in the closest bucket walked
+// toward by each closest bucket refresh.
+var closestBucketWalks = 3
+
 func init() {
 	for _, s := range []string{
 		"/dnsaddr/bootstrap.libp2p.io/ipfs/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
@@ -44,14 +61,26 @@ func init() {
 // Start the refresh worker.
 func (dht *IpfsDHT) startRefreshing() error {
 	// scan the RT table periodically & do a random walk on k-buckets that haven't been queried since the given bucket period
-	dht.proc.Go(func(proc process.Process) {
+	w := &dht.rtRefreshWorker
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started() {
+		return ErrRefreshWorkerClosed
+	}
+	dht.rtRefreshProc = process.Go(func(proc process.Process) {
 		ctx := processctx.OnClosingContext(proc)
 
 		refreshTicker := time.NewTicker(dht.rtRefreshPeriod)
 		defer refreshTicker.Stop()
 
 		// refresh if option is set
+		var closestTick <-chan time.Time
 		if dht.autoRefresh {
+			if dht.rtPrioritizeClosest {
+				closestTicker := time.NewTicker(dht.rtRefreshPeriod / time.Duration(closestBucketRefreshFactor))
+				defer closestTicker.Stop()
+				closestTick = closestTicker.C
+			}
 			dht.doRefresh(ctx)
 		} else {
 			// disable the "auto-refresh" ticker so that no more ticks are sent to this channel
@@ -60,9 +89,17 @@ func (dht *IpfsDHT) startRefreshing() error {
 
 		for {
 			select {
+			case <-closestTick:
+				dht.refreshClosestBucket(ctx)
+				continue
 			case <-refreshTicker.C:
 			case <-dht.triggerRtRefresh:
 				logger.Infof("triggering a refresh: RT has %d peers", dht.routingTable.Size())
+			case <-w.wake:
+				if !w.pending() {
+					// the waiters were served by the last refresh.
+					continue
+				}
 			case <-ctx.Done():
 				return
 			}
@@ -74,12 +111,60 @@ func (dht *IpfsDHT) startRefreshing() error {
 }
 
 func (dht *IpfsDHT) doRefresh(ctx context.Context) {
-	dht.selfWalk(ctx)
-	dht.refreshBuckets(ctx)
+	aggressive := dht.rtRefreshEscalation != nil && dht.rtRefreshEscalation.take()
+	if aggressive {
+		logger.Warningf("refresh triggered repeatedly, refreshing all buckets (routing table has %d peers)", dht.routingTable.Size())
+	}
+	start := time.Now()
+	waiters := dht.rtRefreshWorker.takeWaiters()
+	dht.rtRefreshWorker.ran(start, 0)
+	res := opts.RefreshResult{Aggressive: aggressive}
+	res.SelfWalkErr = dht.selfWalk(ctx)
+	res.Buckets = dht.refreshBuckets(ctx, aggressive)
+	for _, b := range res.Buckets {
+		if b.Err != nil {
+			res.Failed++
+		} else {
+			res.Succeeded++
+		}
+	}
+	if dht.routingTable.Size() == 0 && ctx.Err() == nil {
+		dht.isolated(ctx, &res)
+	}
+	res.Duration = time.Since(start)
+	dht.rtRefreshWorker.ran(start, res.Duration)
+	if dht.onRefreshComplete != nil {
+		dht.onRefreshComplete(res)
+	}
+	for _, ch := range waiters {
+		ch <- res
+		close(ch)
+	}
+}
+
+// isolated handles a refresh that found us isolated, re-bootstrapping if the
+// ReBootstrapOnIsolation option is set.
+func (dht *IpfsDHT) isolated(ctx context.Context, res *opts.RefreshResult) {
+	res.Isolated = true
+	logger.Warning("routing table refresh reached no peers, we're isolated")
+	if dht.rebootstrapPeers != nil {
+		res.ReBootstrapErr = dht.ConnectBootstrapPeers(ctx, dht.rebootstrapPeers)
+		if res.ReBootstrapErr != nil {
+			logger.Warningf("failed to re-bootstrap: %s", res.ReBootstrapErr)
+		} else {
+			dht.selfWalk(ctx)
+		}
+	}
+	if dht.onIsolation != nil {
+		dht.onIsolation(*res)
+	}
 }
 
 // refreshBuckets scans the routing table, and does a random walk on k-buckets that haven't been queried since the given bucket period
-func (dht *IpfsDHT) refreshBuckets(ctx context.Context) {
+//
+// Aggressive refreshes walk all buckets, in parallel. It returns the outcome
+// of each walk.
+func (dht *IpfsDHT) refreshBuckets(ctx context.Context, aggressive bool) []opts.BucketRefresh {
 	doQuery := func(bucketId int, target string, f func(context.Context) error) error {
 		logger.Infof("starting refreshing bucket %d to %s (routing table size was %d)",
 			bucketId, target, dht.routingTable.Size())
@@ -97,18 +182,22 @@ func (dht *IpfsDHT) refreshBuckets(ctx context.Context) {
 	}
 
 	buckets := dht.routingTable.GetAllBuckets()
-	if len(buckets) > 16 {
-		// Don't bother bootstrapping more than 16 buckets.
+	if len(buckets) > dht.rtMaxRefreshBuckets {
+		// Don't bother bootstrapping more than rtMaxRefreshBuckets buckets.
 		// GenRandPeerID can't generate target peer IDs with more than
 		// 16 bits specified anyways.
-		buckets = buckets[:16]
+		buckets = buckets[:dht.rtMaxRefreshBuckets]
 	}
-	for bucketID, bucket := range buckets {
-		if time.Since(bucket.RefreshedAt()) <= dht.rtRefreshPeriod {
-			continue
-		}
+	var (
+		resLk   sync.Mutex
+		results []opts.BucketRefresh
+	)
+	refresh := func(bucketID int) {
 		// gen rand peer in the bucket
 		randPeerInBucket := dht.routingTable.GenRandPeerID(bucketID)
+		if dht.onRefreshTarget != nil {
+			dht.onRefreshTarget(bucketID, randPeerInBucket)
+		}
 
 		// walk to the generated peer
 		walkFnc := func(c context.Context) error {
@@ -119,21 +208,225 @@ func (dht *IpfsDHT) refreshBuckets(ctx context.Context) {
 			return err
 		}
 
-		if err := doQuery(bucketID, randPeerInBucket.String(), walkFnc); err != nil {
+		err := doQuery(bucketID, randPeerInBucket.String(), walkFnc)
+		if err != nil {
 			logger.Warningf("failed to do a random walk on bucket %d: %s", bucketID, err)
 		}
+		resLk.Lock()
+		results = append(results, opts.BucketRefresh{Bucket: bucketID, Err: err})
+		resLk.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for bucketID, bucket := range buckets {
+		if aggressive {
+			wg.Add(1)
+			go func(bucketID int) {
+				defer wg.Done()
+				refresh(bucketID)
+			}(bucketID)
+			continue
+		}
+		closest := dht.rtPrioritizeClosest && bucketID == len(buckets)-1
+		if !closest && !dht.shouldRefreshBucket(bucket) {
+			logger.Debugf("skipping refresh of bucket %d: it has %d peers", bucketID, bucket.Len())
+			continue
+		}
+		refresh(bucketID)
 	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Bucket < results[j].Bucket })
+	return results
+}
+
+// refreshClosestBucket walks toward our own ID and toward closestBucketWalks
+// random IDs in the bucket closest to it, all in parallel.
+func (dht *IpfsDHT) refreshClosestBucket(ctx context.Context) {
+	bucketID := len(dht.routingTable.GetAllBuckets()) - 1
+	if bucketID >= dht.rtMaxRefreshBuckets {
+		bucketID = dht.rtMaxRefreshBuckets - 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dht.selfWalk(ctx)
+	}()
+	for i := 0; i < closestBucketWalks; i++ {
+		target := dht.routingTable.GenRandPeerID(bucketID)
+		if dht.onRefreshTarget != nil {
+			dht.onRefreshTarget(bucketID, target)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queryCtx, cancel := context.WithTimeout(ctx, dht.rtRefreshQueryTimeout)
+			defer cancel()
+			_, err := dht.FindPeer(queryCtx, target)
+			if err != nil && err != routing.ErrNotFound && queryCtx.Err() == nil {
+				logger.Warningf("failed to do a random walk on the closest bucket %d: %s", bucketID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// shouldRefreshBucket returns true if the bucket is below the MinBucketFullness
+// ratio, or if it's both stale and sparse.
+func (dht *IpfsDHT) shouldRefreshBucket(b *kb.Bucket) bool {
+	if float64(b.Len()) < dht.rtMinBucketFullness*float64(dht.bucketSize) {
+		return true
+	}
+	return time.Since(b.RefreshedAt()) > dht.rtRefreshPeriod && dht.isSparseBucket(b)
+}
+
+// isSparseBucket returns true if the bucket isn't fuller than allowed by the
+// RefreshSparseBucketsOnly option.
+func (dht *IpfsDHT) isSparseBucket(b *kb.Bucket) bool {
+	return float64(b.Len()) <= dht.rtSparseBucketThreshold*float64(dht.bucketSize)
 }
 
 // Traverse the DHT toward the self ID
-func (dht *IpfsDHT) selfWalk(ctx context.Context) {
+func (dht *IpfsDHT) selfWalk(ctx context.Context) error {
 	queryCtx, cancel := context.WithTimeout(ctx, dht.rtRefreshQueryTimeout)
 	defer cancel()
-	_, err := dht.FindPeer(queryCtx, dht.self)
+	_, err := dht.findPeer(queryCtx, dht.self)
 	if err == routing.ErrNotFound {
-		return
+		return nil
 	}
 	logger.Warningf("failed to query self during routing table refresh: %s", err)
+	return err
+}
+
+// ConnectBootstrapPeers connects to the given bootstrap peers, dialing up to
+// BootstrapDialConcurrency of them in parallel. The remaining dials are
+// cancelled as soon as more than minRTRefreshThreshold peers are connected, so
+// slow or dead peers at the end of a long list don't hold up startup.
+//
+// DefaultBootstrapPeers can be converted with peer.AddrInfosFromP2pAddrs. An
+// error is returned if no bootstrap peer could be connected to. Peers backing
+// off after failed dials are skipped, see the BootstrapPeerBackoff option.
+func (dht *IpfsDHT) ConnectBootstrapPeers(ctx context.Context, peers []peer.AddrInfo) error {
+	if len(peers) == 0 {
+		return errors.New("no bootstrap peers given")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		lk        sync.Mutex
+		connected int
+		dialed    int
+		lastErr   error
+	)
+	sem := make(chan struct{}, dht.bootstrapDialConcurrency)
+dial:
+	for _, pi := range peers {
+		if dht.bootstrapBackoff != nil && dht.bootstrapBackoff.active(pi.ID) {
+			logger.Debugf("skipping bootstrap peer %s: backing off", pi.ID)
+			continue
+		}
+		dialed++
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dial
+		}
+		if ctx.Err() != nil {
+			// we're connected to enough peers already.
+			break
+		}
+
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := dht.host.Connect(ctx, pi)
+			if err == nil {
+				err = dht.waitIdentified(ctx, pi.ID)
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Debugf("failed to connect to bootstrap peer %s: %s", pi.ID, err)
+					lastErr = err
+					if dht.bootstrapBackoff != nil {
+						dht.bootstrapBackoff.failed(pi.ID)
+					}
+				}
+				return
+			}
+			if dht.bootstrapBackoff != nil {
+				dht.bootstrapBackoff.succeeded(pi.ID)
+			}
+			connected++
+			if connected > minRTRefreshThreshold {
+				cancel()
+			}
+		}(pi)
+	}
+	wg.Wait()
+
+	if connected > 0 {
+		logger.Infof("connected to %d bootstrap peers", connected)
+		return nil
+	}
+	if dialed == 0 {
+		return errors.New("all bootstrap peers are backing off")
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return fmt.Errorf("failed to connect to any bootstrap peer: %s", lastErr)
+}
+
+// identifier is implemented by hosts running the identify protocol, like the
+// basic host.
+type identifier interface {
+	IDService() *identify.IDService
+}
+
+// waitIdentified waits for identify to complete on our connections to p, for
+// up to the IdentifyWaitTimeout option, and adds p to the routing table if it
+// turns out to be a DHT server. It doesn't wait if the host doesn't expose its
+// identify service.
+func (dht *IpfsDHT) waitIdentified(ctx context.Context, p peer.ID) error {
+	ider, ok := dht.host.(identifier)
+	if !ok || dht.identifyWaitTimeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, dht.identifyWaitTimeout)
+	defer cancel()
+	for _, c := range dht.host.Network().ConnsToPeer(p) {
+		done := make(chan struct{})
+		go func(c network.Conn) {
+			ider.IDService().IdentifyConn(c)
+			close(done)
+		}(c)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return fmt.Errorf("identifying %s: %s", p, ctx.Err())
+		}
+	}
+
+	protos, err := dht.peerstore.SupportsProtocols(p, dht.protocolStrs()...)
+	if err != nil || len(protos) == 0 {
+		return nil
+	}
+	dht.plk.Lock()
+	defer dht.plk.Unlock()
+	if dht.host.Network().Connectedness(p) == network.Connected {
+		dht.Update(dht.Context(), p)
+	}
+	return nil
 }
 
 // Bootstrap tells the DHT to get into a bootstrapped state satisfying the
@@ -147,6 +440,9 @@ func (dht *IpfsDHT) Bootstrap(_ context.Context) error {
 
 // RefreshRoutingTable tells the DHT to refresh it's routing tables.
 func (dht *IpfsDHT) RefreshRoutingTable() {
+	if dht.rtRefreshEscalation != nil {
+		dht.rtRefreshEscalation.trigger()
+	}
 	select {
 	case dht.triggerRtRefresh <- struct{}{}:
 	default:
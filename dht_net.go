@@ -2,21 +2,27 @@ package dht
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 
 	ggio "github.com/gogo/protobuf/io"
+	u "github.com/ipfs/go-ipfs-util"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 
+	"github.com/libp2p/go-libp2p-record"
 	"github.com/libp2p/go-msgio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
@@ -72,14 +78,15 @@ func (dht *IpfsDHT) handleNewStream(s network.Stream) {
 // Returns true on orderly completion of writes (so we can Close the stream).
 func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 	ctx := dht.ctx
-	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	r := msgio.NewVarintReaderSize(s, dht.maxMessageSize)
 
 	mPeer := s.Conn().RemotePeer()
+	proto := string(s.Protocol())
 
 	timer := time.AfterFunc(dhtStreamIdleTimeout, func() { s.Reset() })
 	defer timer.Stop()
 
-	for {
+	for handled := 0; ; handled++ {
 		var req pb.Message
 		msgbytes, err := r.ReadMsg()
 		if err != nil {
@@ -87,6 +94,9 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			if err == io.EOF {
 				return true
 			}
+			if err == msgio.ErrMsgTooLarge {
+				dht.handleOversizedMessage(mPeer)
+			}
 			// This string test is necessary because there isn't a single stream reset error
 			// instance	in use.
 			if err.Error() != "stream reset" {
@@ -99,6 +109,14 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			)
 			return false
 		}
+		// Only close the stream once the peer sends one message too many,
+		// so it has read all our responses by then and can resend this
+		// one on a new stream.
+		if dht.maxMessagesPerStream > 0 && handled == dht.maxMessagesPerStream {
+			r.ReleaseMsg(msgbytes)
+			logger.Debugf("closing stream from %s after %d messages", mPeer, handled)
+			return true
+		}
 		err = req.Unmarshal(msgbytes)
 		r.ReleaseMsg(msgbytes)
 		if err != nil {
@@ -117,6 +135,8 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 		ctx, _ := tag.New(
 			ctx,
 			tag.Upsert(metrics.KeyMessageType, req.GetType().String()),
+			metrics.UpsertNamespace(dht.metricsNamespace(&req)),
+			metrics.UpsertProtocol(proto),
 		)
 
 		stats.Record(
@@ -159,10 +179,40 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 	}
 }
 
+// handleOversizedMessage is called when a peer sends us a message larger than
+// the configured maximum message size.
+func (dht *IpfsDHT) handleOversizedMessage(p peer.ID) {
+	logger.Warningf("peer %s sent a message larger than %d bytes", p, dht.maxMessageSize)
+	if dht.penalizeOversizedMessages {
+		dht.routingTable.Remove(p)
+	}
+}
+
+// capCloserPeers keeps only the maxCloserPeers closest peers to the key from
+// the closer peers of a response, so a peer can't make us process and store
+// an arbitrary number of them.
+func (dht *IpfsDHT) capCloserPeers(key []byte, resp *pb.Message) {
+	closer := resp.GetCloserPeers()
+	if len(closer) <= dht.maxCloserPeers {
+		return
+	}
+	logger.Debugf("ignoring %d of %d closer peers in response", len(closer)-dht.maxCloserPeers, len(closer))
+
+	target := kb.ConvertKey(string(key))
+	dists := make(map[*pb.Message_Peer][]byte, len(closer))
+	for _, p := range closer {
+		dists[p] = u.XOR(target, kb.ConvertPeerID(peer.ID(p.GetId())))
+	}
+	sort.Slice(closer, func(i, j int) bool {
+		return bytes.Compare(dists[closer[i]], dists[closer[j]]) < 0
+	})
+	resp.CloserPeers = closer[:dht.maxCloserPeers]
+}
+
 // sendRequest sends out a request, but also makes sure to
 // measure the RTT for latency measurements.
 func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
-	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes))
+	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes), metrics.UpsertNamespace(dht.metricsNamespace(pmes)))
 
 	ms, err := dht.messageSenderForPeer(ctx, p)
 	if err != nil {
@@ -172,12 +222,20 @@ func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message
 
 	start := time.Now()
 
-	rpmes, err := ms.SendRequest(ctx, pmes)
+	rpmes, err := ms.SendRequest(ctx, dht.transformOutbound(pmes))
+	ctx, _ = tag.New(ctx, metrics.UpsertProtocol(ms.Protocol()))
 	if err != nil {
 		stats.Record(ctx, metrics.SentRequestErrors.M(1))
 		return nil, err
 	}
 
+	dht.capCloserPeers(pmes.GetKey(), rpmes)
+
+	// a peer answering us is useful, let it back into the routing table.
+	if dht.evictionCooldown != nil {
+		dht.evictionCooldown.end(p)
+	}
+
 	// update the peer (on valid msgs only)
 	dht.updateFromMessage(ctx, p, rpmes)
 
@@ -194,9 +252,26 @@ func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message
 	return rpmes, nil
 }
 
+// transformOutbound applies the OutboundQueryTransform hook to the key of an
+// outbound query message. The message is copied as it may be sent to several
+// peers.
+func (dht *IpfsDHT) transformOutbound(pmes *pb.Message) *pb.Message {
+	if dht.outboundQueryTransform == nil || pmes.Key == nil {
+		return pmes
+	}
+	switch pmes.GetType() {
+	case pb.Message_FIND_NODE, pb.Message_GET_VALUE, pb.Message_GET_PROVIDERS:
+	default:
+		return pmes
+	}
+	transformed := *pmes
+	transformed.Key = []byte(dht.outboundQueryTransform(string(pmes.Key)))
+	return &transformed
+}
+
 // sendMessage sends out a message
 func (dht *IpfsDHT) sendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
-	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes))
+	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes), metrics.UpsertNamespace(dht.metricsNamespace(pmes)))
 
 	ms, err := dht.messageSenderForPeer(ctx, p)
 	if err != nil {
@@ -204,7 +279,9 @@ func (dht *IpfsDHT) sendMessage(ctx context.Context, p peer.ID, pmes *pb.Message
 		return err
 	}
 
-	if err := ms.SendMessage(ctx, pmes); err != nil {
+	err = ms.SendMessage(ctx, dht.transformOutbound(pmes))
+	ctx, _ = tag.New(ctx, metrics.UpsertProtocol(ms.Protocol()))
+	if err != nil {
 		stats.Record(ctx, metrics.SentMessageErrors.M(1))
 		return err
 	}
@@ -218,6 +295,29 @@ func (dht *IpfsDHT) sendMessage(ctx context.Context, p peer.ID, pmes *pb.Message
 	return nil
 }
 
+// metricsNamespace returns the namespace used to label metrics for the given
+// message. Record keys are only labeled with their namespace if our validator
+// knows about it, so the set of label values stays bounded.
+func (dht *IpfsDHT) metricsNamespace(pmes *pb.Message) string {
+	switch pmes.GetType() {
+	case pb.Message_ADD_PROVIDER, pb.Message_GET_PROVIDERS:
+		return metrics.NamespaceProviders
+	case pb.Message_FIND_NODE:
+		return metrics.NamespacePeers
+	case pb.Message_GET_VALUE, pb.Message_PUT_VALUE:
+		ns, _, err := record.SplitKey(string(pmes.GetKey()))
+		if err != nil {
+			return metrics.NamespaceOther
+		}
+		if nsval, ok := dht.Validator.(record.NamespacedValidator); ok {
+			if _, ok := nsval[ns]; ok {
+				return ns
+			}
+		}
+	}
+	return metrics.NamespaceOther
+}
+
 func (dht *IpfsDHT) updateFromMessage(ctx context.Context, p peer.ID, mes *pb.Message) error {
 	// Make sure that this node is actually a DHT server, not just a client.
 	protos, err := dht.peerstore.SupportsProtocols(p, dht.protocolStrs()...)
@@ -268,6 +368,17 @@ type messageSender struct {
 
 	invalid   bool
 	singleMes int
+
+	// protocol is the protocol negotiated on the most recently opened stream.
+	protocol protocol.ID
+}
+
+// Protocol returns the DHT protocol negotiated with the peer, or the empty
+// string if we haven't managed to open a stream yet.
+func (ms *messageSender) Protocol() string {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	return string(ms.protocol)
 }
 
 // invalidate is called before this messageSender is removed from the strmap.
@@ -304,8 +415,9 @@ func (ms *messageSender) prep(ctx context.Context) error {
 		return err
 	}
 
-	ms.r = msgio.NewVarintReaderSize(nstr, network.MessageSizeMax)
+	ms.r = msgio.NewVarintReaderSize(nstr, ms.dht.maxMessageSize)
 	ms.s = nstr
+	ms.protocol = nstr.Protocol()
 
 	return nil
 }
@@ -377,6 +489,12 @@ func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb
 			ms.s.Reset()
 			ms.s = nil
 
+			if err == msgio.ErrMsgTooLarge {
+				// no point in retrying, the peer is misbehaving.
+				ms.dht.handleOversizedMessage(ms.p)
+				return nil, err
+			}
+
 			if retry {
 				logger.Info("error reading message, bailing: ", err)
 				return nil, err
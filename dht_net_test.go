@@ -0,0 +1,209 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+
+	"github.com/libp2p/go-libp2p-record"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-msgio"
+)
+
+func TestMetricsNamespace(t *testing.T) {
+	dht := &IpfsDHT{
+		Validator: record.NamespacedValidator{
+			"pk": record.PublicKeyValidator{},
+		},
+	}
+
+	for _, tc := range []struct {
+		typ pb.Message_MessageType
+		key string
+		ns  string
+	}{
+		{pb.Message_GET_VALUE, "/pk/foo", "pk"},
+		{pb.Message_PUT_VALUE, "/pk/foo", "pk"},
+		{pb.Message_GET_VALUE, "/unknown/foo", metrics.NamespaceOther},
+		{pb.Message_GET_VALUE, "garbage", metrics.NamespaceOther},
+		{pb.Message_GET_PROVIDERS, "foo", metrics.NamespaceProviders},
+		{pb.Message_ADD_PROVIDER, "foo", metrics.NamespaceProviders},
+		{pb.Message_FIND_NODE, "foo", metrics.NamespacePeers},
+		{pb.Message_PING, "", metrics.NamespaceOther},
+	} {
+		ns := dht.metricsNamespace(pb.NewMessage(tc.typ, []byte(tc.key), 0))
+		if ns != tc.ns {
+			t.Errorf("expected namespace %q for %s %q, got %q", tc.ns, tc.typ, tc.key, ns)
+		}
+	}
+}
+
+func TestOversizedMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d, err := New(
+		ctx,
+		bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.MaxMessageSize(1024),
+		opts.PenalizeOversizedMessages(true),
+		opts.DisableAutoRefresh(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := setupDHT(ctx, t, false)
+	connect(t, ctx, d, other)
+
+	s, err := other.host.NewStream(ctx, d.self, opts.ProtocolDHT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := msgio.NewVarintWriter(s)
+	if err := w.WriteMsg(make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the stream to be reset")
+	}
+
+	if d.routingTable.Find(other.self) != "" {
+		t.Fatal("expected the misbehaving peer to be evicted from the routing table")
+	}
+}
+
+func TestMaxMessagesPerStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d, err := New(
+		ctx,
+		bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.MaxMessagesPerStream(2),
+		opts.DisableAutoRefresh(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := setupDHT(ctx, t, false)
+	connect(t, ctx, d, other)
+
+	s, err := other.host.NewStream(ctx, d.self, opts.ProtocolDHT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := msgio.NewVarintReader(s)
+	for i := 0; i < 2; i++ {
+		if err := writeMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadMsg(); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	// the third message gets the stream closed instead of handled.
+	writeMsg(s, pb.NewMessage(pb.Message_PING, nil, 0))
+	if _, err := r.ReadMsg(); err == nil {
+		t.Fatal("expected the stream to be closed")
+	}
+
+	// a new stream can be used as usual.
+	s, err = other.host.NewStream(ctx, d.self, opts.ProtocolDHT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgio.NewVarintReader(s).ReadMsg(); err != nil {
+		t.Fatal(err)
+	}
+
+	// requests sent on a stream we closed are retried on a new one.
+	for i := 0; i < 5; i++ {
+		if err := other.Ping(ctx, d.self); err != nil {
+			t.Fatalf("ping %d: %v", i, err)
+		}
+	}
+}
+
+func TestOutboundQueryTransform(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	for _, d := range []*IpfsDHT{a, b} {
+		d.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
+	}
+	a.outboundQueryTransform = func(key string) string {
+		if key == "/v/hello" {
+			return "/v/decoy"
+		}
+		return key
+	}
+
+	pmes := pb.NewMessage(pb.Message_GET_VALUE, []byte("/v/hello"), 0)
+	if transformed := a.transformOutbound(pmes); string(transformed.Key) != "/v/decoy" || string(pmes.Key) != "/v/hello" {
+		t.Fatalf("expected a transformed copy of the message, got %q (original %q)", transformed.Key, pmes.Key)
+	}
+	for _, typ := range []pb.Message_MessageType{pb.Message_PUT_VALUE, pb.Message_ADD_PROVIDER} {
+		pmes := pb.NewMessage(typ, []byte("/v/hello"), 0)
+		if transformed := a.transformOutbound(pmes); string(transformed.Key) != "/v/hello" {
+			t.Fatalf("expected the key of %s messages to be left as is, got %q", typ, transformed.Key)
+		}
+	}
+
+	rec := record.MakePutRecord("/v/decoy", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := b.putLocal("/v/decoy", rec); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, ctx, a, b)
+
+	ctxT, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	val, err := a.GetValue(ctxT, "/v/hello")
+	if err != nil || string(val) != "world" {
+		t.Fatalf("expected the value stored under the transformed key, got %q (%v)", val, err)
+	}
+}
+
+func TestCapCloserPeers(t *testing.T) {
+	dht := &IpfsDHT{maxCloserPeers: 3}
+	key := []byte(test.RandPeerIDFatal(t))
+
+	var peers []peer.ID
+	resp := pb.NewMessage(pb.Message_FIND_NODE, key, 0)
+	for i := 0; i < 10; i++ {
+		p := test.RandPeerIDFatal(t)
+		peers = append(peers, p)
+		resp.CloserPeers = append(resp.CloserPeers, &pb.Message_Peer{Id: []byte(p)})
+	}
+
+	dht.capCloserPeers(key, resp)
+	expected := kb.SortClosestPeers(peers, kb.ConvertKey(string(key)))[:3]
+	if len(resp.CloserPeers) != 3 {
+		t.Fatalf("expected 3 closer peers, got %d", len(resp.CloserPeers))
+	}
+	for i, p := range resp.CloserPeers {
+		if peer.ID(p.Id) != expected[i] {
+			t.Fatalf("expected the closest peers in order, got %s at %d", peer.ID(p.Id), i)
+		}
+	}
+}
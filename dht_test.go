@@ -12,9 +12,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/libp2p/go-libp2p-core/test"
 	"github.com/multiformats/go-multistream"
 
 	"golang.org/x/xerrors"
@@ -26,6 +29,9 @@ import (
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 
 	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/failstore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	u "github.com/ipfs/go-ipfs-util"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p-record"
@@ -205,6 +211,111 @@ func bootstrap(t *testing.T, ctx context.Context, dhts []*IpfsDHT) {
 	}
 }
 
+func TestPutValueMaxRecordSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.maxRecordSizes = map[string]int{"v": 4, "": 16}
+	connect(t, ctx, a, b)
+
+	if err := a.PutValue(ctx, "/v/small", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	err := a.PutValue(ctx, "/v/big", []byte("12345"))
+	tooLarge, ok := err.(*RecordTooLargeError)
+	if !ok {
+		t.Fatalf("expected a RecordTooLargeError, got %v", err)
+	}
+	if tooLarge.Namespace != "v" || tooLarge.Size != 5 || tooLarge.Limit != 4 {
+		t.Fatalf("unexpected error: %s", tooLarge)
+	}
+
+	// b has no limit, but a refuses to store the record for it.
+	if err := b.PutValue(ctx, "/v/big", []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := a.getLocal("/v/big"); err != nil || rec != nil {
+		t.Fatalf("expected the oversized record not to be stored, got %v (%v)", rec, err)
+	}
+
+	// other namespaces fall back to the default limit.
+	if err := a.checkRecordSize("/pk/key", make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.checkRecordSize("/pk/key", make([]byte, 17)); err == nil {
+		t.Fatal("expected the default limit to apply")
+	}
+}
+
+func TestPutValueConflictPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	b.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	connect(t, ctx, a, b)
+
+	rec := record.MakePutRecord("/v/hello", []byte("newer"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := b.putLocal("/v/hello", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	err := a.PutValue(ctx, "/v/hello", []byte("valid"), OnPutValueConflict(PutValueConflictPolicy{
+		Action: PutConflictAbort,
+	}))
+	newer, ok := err.(*NewerRecordError)
+	if !ok {
+		t.Fatalf("expected a NewerRecordError, got %v", err)
+	}
+	if newer.Peer != b.self || string(newer.Record.GetValue()) != "newer" {
+		t.Fatalf("unexpected error: %s", newer)
+	}
+	if local, err := a.getLocal("/v/hello"); err != nil || local != nil {
+		t.Fatalf("expected an aborted put not to be stored, got %v (%v)", local, err)
+	}
+
+	err = a.PutValue(ctx, "/v/hello", []byte("valid"), OnPutValueConflict(PutValueConflictPolicy{
+		Action: PutConflictProceed,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local, err := a.getLocal("/v/hello"); err != nil || string(local.GetValue()) != "valid" {
+		t.Fatalf("expected our value to be stored, got %v (%v)", local, err)
+	}
+
+	err = a.PutValue(ctx, "/v/hello", []byte("valid"), OnPutValueConflict(PutValueConflictPolicy{
+		Action: PutConflictMerge,
+		Merge: func(key string, ours, newer []byte) ([]byte, error) {
+			if string(ours) != "valid" || string(newer) != "newer" {
+				t.Errorf("unexpected merge of %s and %s", ours, newer)
+			}
+			return newer, nil
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local, err := a.getLocal("/v/hello"); err != nil || string(local.GetValue()) != "newer" {
+		t.Fatalf("expected the merged value to be stored, got %v (%v)", local, err)
+	}
+}
+
 func TestValueGetSet(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -484,74 +595,1159 @@ func TestValueGetInvalid(t *testing.T) {
 	testSetGet("valid", "newer", nil)
 }
 
-func TestInvalidMessageSenderTracking(t *testing.T) {
+func TestOnInvalidRecord(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dht := setupDHT(ctx, t, false)
-	defer dht.Close()
+	dhtA := setupDHT(ctx, t, false)
+	dhtB := setupDHT(ctx, t, false)
 
-	foo := peer.ID("asdasd")
-	_, err := dht.messageSenderForPeer(ctx, foo)
-	if err == nil {
-		t.Fatal("that shouldnt have succeeded")
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	dhtA.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
+	dhtB.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+
+	var invalidLk sync.Mutex
+	invalidFrom := make(map[peer.ID]int)
+	dhtB.onInvalidRecord = func(from peer.ID, key string, err error) {
+		invalidLk.Lock()
+		defer invalidLk.Unlock()
+		if key != "/v/hello" {
+			t.Errorf("unexpected invalid record key: %s", key)
+		}
+		if err == nil {
+			t.Error("expected the validation error")
+		}
+		invalidFrom[from]++
 	}
 
-	dht.smlk.Lock()
-	mscnt := len(dht.strmap)
-	dht.smlk.Unlock()
+	connect(t, ctx, dhtA, dhtB)
 
-	if mscnt > 0 {
-		t.Fatal("should have no message senders in map")
+	ctxT, cancelT := context.WithTimeout(ctx, time.Second)
+	defer cancelT()
+	if err := dhtA.PutValue(ctxT, "/v/hello", []byte("expired")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dhtB.GetValue(ctxT, "/v/hello"); err != routing.ErrNotFound {
+		t.Fatalf("expected %s, got %v", routing.ErrNotFound, err)
+	}
+
+	invalidLk.Lock()
+	defer invalidLk.Unlock()
+	if len(invalidFrom) != 1 || invalidFrom[dhtA.self] == 0 {
+		t.Fatalf("expected the invalid record from %s to be reported, got %v", dhtA.self, invalidFrom)
 	}
 }
 
-func TestProvides(t *testing.T) {
-	// t.Skip("skipping test to debug another")
+func TestValueGetFreshness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	b.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	connect(t, ctx, a, b)
+
+	putLocal := func(d *IpfsDHT, val string, received time.Time) {
+		t.Helper()
+		rec := record.MakePutRecord("/v/hello", []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(received)
+		if err := d.putLocal("/v/hello", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getValue := func(policy ValueFreshnessPolicy) string {
+		t.Helper()
+		ctxT, cancel := context.WithTimeout(ctx, time.Second*2)
+		defer cancel()
+		val, err := a.GetValue(ctxT, "/v/hello", ValueFreshness(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(val)
+	}
+
+	putLocal(a, "valid", time.Now().Add(-time.Hour))
+	putLocal(b, "newer", time.Now())
+
+	if val := getValue(ValueFreshnessPolicy{MaxStaleness: 2 * time.Hour}); val != "valid" {
+		t.Fatalf("expected the local record, got %q", val)
+	}
+
+	// too stale, but returned anyway while it's refreshed in the background.
+	if val := getValue(ValueFreshnessPolicy{MaxStaleness: time.Minute}); val != "valid" {
+		t.Fatalf("expected the stale local record, got %q", val)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec, err := a.getLocal("/v/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rec.GetValue()) == "newer" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stale local record to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	putLocal(a, "valid", time.Now().Add(-time.Hour))
+	if val := getValue(ValueFreshnessPolicy{MaxStaleness: time.Minute, PreferFresh: true}); val != "newer" {
+		t.Fatalf("expected the network record, got %q", val)
+	}
+
+	// invalid local records are never returned.
+	putLocal(a, "expired", time.Now())
+	if val := getValue(ValueFreshnessPolicy{MaxStaleness: time.Hour}); val != "newer" {
+		t.Fatalf("expected the network record, got %q", val)
+	}
+}
+
+func TestValueGetBackgroundRefreshOnLocalHit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	b.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	connect(t, ctx, a, b)
+
+	for d, val := range map[*IpfsDHT]string{a: "valid", b: "newer"} {
+		rec := record.MakePutRecord("/v/hello", []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		if err := d.putLocal("/v/hello", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getValue := func() string {
+		t.Helper()
+		val, err := a.GetValue(ctx, "/v/hello",
+			ValueFreshness(ValueFreshnessPolicy{MaxStaleness: time.Hour}),
+			BackgroundRefreshOnLocalHit(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(val)
+	}
+
+	// the fresh local record is returned, and replaced in the background.
+	if val := getValue(); val != "valid" {
+		t.Fatalf("expected the local record, got %q", val)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for getValue() != "newer" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the local record to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the refreshed record counts as just received.
+	rec, err := a.getLocal("/v/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recvtime, err := u.ParseRFC3339(rec.GetTimeReceived()); err != nil || time.Since(recvtime) > time.Minute {
+		t.Fatalf("expected the refreshed record to have a receive time, got %q", rec.GetTimeReceived())
+	}
+}
+
+func TestValueGetTrustedCorroboration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+
+	for _, d := range dhts {
+		d.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
+	}
+
+	querier, trusted, untrusted := dhts[0], dhts[1], dhts[2]
+	connect(t, ctx, querier, trusted)
+	connect(t, ctx, querier, untrusted)
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := untrusted.putLocal("/v/hello", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	getValue := func(opts ...routing.Option) ([]byte, error) {
+		ctxT, cancel := context.WithTimeout(ctx, time.Second*2)
+		defer cancel()
+		return querier.GetValue(ctxT, "/v/hello", opts...)
+	}
+
+	if _, err := getValue(RequireTrustedCorroboration()); err != errNoTrustedPeers {
+		t.Fatalf("expected %v, got %v", errNoTrustedPeers, err)
+	}
+
+	// Without requiring corroboration, the untrusted value is fine.
+	if val, err := getValue(WithTrustedPeers(trusted.self)); err != nil || string(val) != "world" {
+		t.Fatalf("expected 'world', got %q (%v)", val, err)
+	}
+
+	if _, err := getValue(WithTrustedPeers(trusted.self), RequireTrustedCorroboration()); err != ErrNotCorroborated {
+		t.Fatalf("expected %v, got %v", ErrNotCorroborated, err)
+	}
+
+	if err := trusted.putLocal("/v/hello", rec); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := getValue(WithTrustedPeers(trusted.self), RequireTrustedCorroboration()); err != nil || string(val) != "world" {
+		t.Fatalf("expected 'world', got %q (%v)", val, err)
+	}
+}
+
+func TestValueGetMaxRPCs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	for _, d := range dhts {
+		d.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
+	}
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+		if err := d.putLocal("/v/hello", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getValue := func(opts ...routing.Option) ([]byte, error) {
+		ctxT, cancel := context.WithTimeout(ctx, time.Second*2)
+		defer cancel()
+		return dhts[0].GetValue(ctxT, "/v/hello", opts...)
+	}
+
+	if val, err := getValue(); err != nil || string(val) != "world" {
+		t.Fatalf("expected 'world', got %q (%v)", val, err)
+	}
+
+	val, err := getValue(MaxRPCs(1))
+	if err != ErrRPCBudgetExhausted {
+		t.Fatalf("expected %v, got %v", ErrRPCBudgetExhausted, err)
+	}
+	if string(val) != "world" {
+		t.Fatalf("expected the best-effort value 'world', got %q", val)
+	}
+
+	// a budget large enough for the whole query doesn't truncate it.
+	if val, err := getValue(MaxRPCs(10)); err != nil || string(val) != "world" {
+		t.Fatalf("expected 'world', got %q (%v)", val, err)
+	}
+}
+
+func TestValueGetRecordConflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+
+	for _, d := range dhts {
+		d.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	}
+
+	var conflicts [][][]byte
+	var selected []int
+	dhts[0].onRecordConflict = func(key string, records [][]byte, sel int) {
+		conflicts = append(conflicts, records)
+		selected = append(selected, sel)
+	}
+
+	for i, val := range []string{"valid", "newer"} {
+		rec := record.MakePutRecord("/v/hello", []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		if err := dhts[i+1].putLocal("/v/hello", rec); err != nil {
+			t.Fatal(err)
+		}
+		connect(t, ctx, dhts[0], dhts[i+1])
+	}
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	val, err := dhts[0].GetValue(ctxT, "/v/hello")
+	if err != nil || string(val) != "newer" {
+		t.Fatalf("expected 'newer', got %q (%v)", val, err)
+	}
+
+	if len(conflicts) != 1 {
+		t.Fatalf("expected a single conflict, got %d", len(conflicts))
+	}
+	if len(conflicts[0]) != 2 || string(conflicts[0][selected[0]]) != "newer" {
+		t.Fatalf("unexpected conflict report: %q, selected %d", conflicts[0], selected[0])
+	}
+
+	// the selected record is always reported, even past the limit.
+	records := make([][]byte, maxConflictRecords)
+	for i := range records {
+		records[i] = []byte(fmt.Sprint(i))
+	}
+	dhts[0].reportRecordConflict("/v/hello", records, []byte("newer"))
+	if sel := selected[1]; sel != maxConflictRecords-1 || string(conflicts[1][sel]) != "newer" {
+		t.Fatalf("expected the selected record to be reported last, got %d", sel)
+	}
+}
+
+func TestDatastoreErrorPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errFailed := errors.New("failed")
+	newDHT := func(policy opts.DatastoreErrorPolicy) *IpfsDHT {
+		fstore := failstore.NewFailstore(ds.NewMapDatastore(), func(op string) error {
+			switch op {
+			case "get", "has":
+				return errFailed
+			}
+			return nil
+		})
+		d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+			opts.Datastore(dssync.MutexWrap(fstore)),
+			opts.DatastoreErrors(policy),
+			opts.NamespacedValidator("v", blankValidator{}),
+			opts.DisableAutoRefresh(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	c := cid.NewCidV0(u.Hash([]byte("hello")))
+	for _, tc := range []struct {
+		policy                opts.DatastoreErrorPolicy
+		valueFails, provFails bool
+	}{
+		{opts.DatastoreErrorDefault, true, false},
+		{opts.DatastoreErrorFail, true, true},
+		{opts.DatastoreErrorDegrade, false, false},
+	} {
+		d := newDHT(tc.policy)
+		requester := test.RandPeerIDFatal(t)
+
+		_, err := d.handleGetValue(ctx, requester, pb.NewMessage(pb.Message_GET_VALUE, []byte("/v/hello"), 0))
+		if (err != nil) != tc.valueFails {
+			t.Errorf("policy %d: unexpected GET_VALUE error: %v", tc.policy, err)
+		}
+		_, err = d.handleGetProviders(ctx, requester, pb.NewMessage(pb.Message_GET_PROVIDERS, c.Bytes(), 0))
+		if (err != nil) != tc.provFails {
+			t.Errorf("policy %d: unexpected GET_PROVIDERS error: %v", tc.policy, err)
+		}
+
+		// context errors are never ignored.
+		cctx, ccancel := context.WithCancel(ctx)
+		ccancel()
+		if err := d.checkProviderDatastoreError(cctx.Err()); err != context.Canceled {
+			t.Errorf("policy %d: expected %s, got %v", tc.policy, context.Canceled, err)
+		}
+
+		d.Close()
+		d.host.Close()
+	}
+}
+
+func TestReplicaMode(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dhts := setupDHTS(t, ctx, 4)
-	defer func() {
-		for i := 0; i < 4; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
-		}
-	}()
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	newDHT := func(options ...opts.Option) *IpfsDHT {
+		d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)), append([]opts.Option{
+			opts.Datastore(dstore),
+			opts.NamespacedValidator("v", blankValidator{}),
+			opts.DisableAutoRefresh(),
+		}, options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	primary := newDHT()
+	replica := newDHT(opts.ReplicaMode())
+	defer replica.host.Close()
+	defer replica.Close()
+	defer primary.host.Close()
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := primary.putLocal("/v/hello", rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Provide(ctx, testCaseCids[0], false); err != nil {
+		t.Fatal(err)
+	}
+	// flushes the provider records.
+	primary.Close()
+
+	if err := replica.PutValue(ctx, "/v/hello", []byte("other")); err != ErrReadOnlyReplica {
+		t.Fatalf("expected %v, got %v", ErrReadOnlyReplica, err)
+	}
+	if err := replica.Provide(ctx, testCaseCids[1], false); err != ErrReadOnlyReplica {
+		t.Fatalf("expected %v, got %v", ErrReadOnlyReplica, err)
+	}
+
+	// inbound writes are rejected.
+	requester := test.RandPeerIDFatal(t)
+	putMes := pb.NewMessage(pb.Message_PUT_VALUE, []byte("/v/hello"), 0)
+	putMes.Record = record.MakePutRecord("/v/hello", []byte("other"))
+	handler := replica.handlerForMsgType(pb.Message_PUT_VALUE)
+	if _, err := handler(ctx, requester, putMes); err != ErrReadOnlyReplica {
+		t.Fatalf("expected %v, got %v", ErrReadOnlyReplica, err)
+	}
+
+	// reads are served from the primary's datastore.
+	resp, err := replica.handleGetValue(ctx, requester, pb.NewMessage(pb.Message_GET_VALUE, []byte("/v/hello"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.GetRecord().GetValue()) != "world" {
+		t.Fatalf("expected the primary's record, got %v", resp.GetRecord())
+	}
+	provs := replica.providers.GetProviders(ctx, testCaseCids[0])
+	if len(provs) != 1 || provs[0] != primary.self {
+		t.Fatalf("expected the primary's provider record, got %v", provs)
+	}
+}
+
+func TestKeyDenylist(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	denied := testCaseCids[0]
+	d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.NamespacedValidator("v", blankValidator{}),
+		opts.DisableAutoRefresh(),
+		opts.KeyDenylist(func(key []byte) bool {
+			return string(key) == "/v/denied" || string(key) == denied.KeyString()
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.host.Close()
+
+	rec := record.MakePutRecord("/v/denied", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := d.putLocal("/v/denied", rec); err != nil {
+		t.Fatal(err)
+	}
+	requester := test.RandPeerIDFatal(t)
+	d.providers.AddProvider(ctx, denied, requester)
+
+	resp, err := d.handlerForMsgType(pb.Message_GET_VALUE)(ctx, requester, pb.NewMessage(pb.Message_GET_VALUE, []byte("/v/denied"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetRecord() != nil {
+		t.Fatalf("expected no record for a denied key, got %v", resp.GetRecord())
+	}
+	resp, err = d.handlerForMsgType(pb.Message_GET_PROVIDERS)(ctx, requester, pb.NewMessage(pb.Message_GET_PROVIDERS, denied.Bytes(), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetProviderPeers()) != 0 {
+		t.Fatalf("expected no providers for a denied key, got %v", resp.GetProviderPeers())
+	}
+
+	putMes := pb.NewMessage(pb.Message_PUT_VALUE, []byte("/v/denied"), 0)
+	putMes.Record = record.MakePutRecord("/v/denied", []byte("other"))
+	if _, err := d.handlerForMsgType(pb.Message_PUT_VALUE)(ctx, requester, putMes); err != ErrKeyDenied {
+		t.Fatalf("expected %v, got %v", ErrKeyDenied, err)
+	}
+
+	// other keys are served as usual.
+	putMes = pb.NewMessage(pb.Message_PUT_VALUE, []byte("/v/allowed"), 0)
+	putMes.Record = record.MakePutRecord("/v/allowed", []byte("world"))
+	if _, err := d.handlerForMsgType(pb.Message_PUT_VALUE)(ctx, requester, putMes); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = d.handlerForMsgType(pb.Message_GET_VALUE)(ctx, requester, pb.NewMessage(pb.Message_GET_VALUE, []byte("/v/allowed"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.GetRecord().GetValue()) != "world" {
+		t.Fatalf("expected the stored record, got %v", resp.GetRecord())
+	}
+}
+
+func TestUnknownNamespacePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	put := func(d *IpfsDHT, key, value string) error {
+		putMes := pb.NewMessage(pb.Message_PUT_VALUE, []byte(key), 0)
+		putMes.Record = record.MakePutRecord(key, []byte(value))
+		_, err := d.handlerForMsgType(pb.Message_PUT_VALUE)(ctx, test.RandPeerIDFatal(t), putMes)
+		return err
+	}
+
+	for _, tc := range []struct {
+		action   opts.UnknownNamespaceAction
+		fallback record.Validator
+		accepted bool
+	}{
+		{opts.UnknownNamespaceReject, nil, false},
+		{opts.UnknownNamespaceAccept, nil, true},
+		{opts.UnknownNamespaceDelegate, testValidator{}, true},
+	} {
+		d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+			opts.NamespacedValidator("v", testValidator{}),
+			opts.DisableAutoRefresh(),
+			opts.UnknownNamespacePolicy(tc.action, tc.fallback),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// validators can still be registered after New.
+		if _, ok := d.Validator.(record.NamespacedValidator); !ok {
+			t.Errorf("action %d: expected the validator to stay a NamespacedValidator", tc.action)
+		}
+
+		err = put(d, "/unknown/hello", "valid")
+		if tc.accepted && err != nil {
+			t.Errorf("action %d: expected the record to be accepted, got %v", tc.action, err)
+		} else if !tc.accepted && err == nil {
+			t.Errorf("action %d: expected the record to be rejected", tc.action)
+		}
+		if tc.action == opts.UnknownNamespaceDelegate && put(d, "/unknown/hello", "expired") == nil {
+			t.Error("expected the fallback validator to reject the record")
+		}
+		// registered namespaces and keys without one are unaffected.
+		if err := put(d, "/v/hello", "expired"); err == nil {
+			t.Errorf("action %d: expected the registered validator to reject the record", tc.action)
+		}
+		if err := put(d, "hello", "valid"); err == nil {
+			t.Errorf("action %d: expected a key without a namespace to be rejected", tc.action)
+		}
+
+		d.Close()
+		d.host.Close()
+	}
+
+	if _, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.UnknownNamespacePolicy(opts.UnknownNamespaceDelegate, nil),
+	); err == nil {
+		t.Fatal("expected delegating to a nil validator to fail")
+	}
+	if _, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.Validator(blankValidator{}),
+		opts.UnknownNamespacePolicy(opts.UnknownNamespaceAccept, nil),
+	); err == nil {
+		t.Fatal("expected the policy to need a NamespacedValidator")
+	}
+}
+
+func TestUnknownNamespaceGetPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// b serves a record in a namespace a has no validator for.
+	b, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.DisableAutoRefresh(),
+		opts.UnknownNamespacePolicy(opts.UnknownNamespaceAccept, nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer b.host.Close()
+	rec := record.MakePutRecord("/unknown/hello", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := b.putLocal("/unknown/hello", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []opts.UnknownNamespaceGetAction{opts.UnknownNamespaceGetReject, opts.UnknownNamespaceGetFirst} {
+		a, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+			opts.DisableAutoRefresh(),
+			opts.UnknownNamespaceGetPolicy(action),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		connect(t, ctx, a, b)
+
+		val, err := a.GetValue(ctx, "/unknown/hello")
+		if action == opts.UnknownNamespaceGetReject {
+			if nerr, ok := err.(*UnknownNamespaceError); !ok || nerr.Namespace != "unknown" {
+				t.Errorf("expected an unknown namespace error, got %v", err)
+			}
+		} else if err != nil || string(val) != "world" {
+			t.Errorf("expected the first value to be returned, got %q, %v", val, err)
+		}
+
+		a.Close()
+		a.host.Close()
+	}
+}
+
+func TestStalePutRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer a.host.Close()
+
+	var (
+		lk       sync.Mutex
+		rejected []string
+	)
+	b, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.NamespacedValidator("v", testValidator{}),
+		opts.DisableAutoRefresh(),
+		opts.ReturnNewerRecordOnStalePut(true),
+		opts.OnStalePutRejected(func(from peer.ID, key string, stale, held []byte) {
+			lk.Lock()
+			defer lk.Unlock()
+			if from != a.self {
+				t.Errorf("expected the stale record to come from %s, got %s", a.self, from)
+			}
+			rejected = append(rejected, key+" "+string(stale)+" "+string(held))
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer b.host.Close()
+	a.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	connect(t, ctx, a, b)
+
+	rec := record.MakePutRecord("/v/hello", []byte("newer"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := b.putLocal("/v/hello", rec); err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.PutValue(ctx, "/v/hello", []byte("valid"))
+	nerr, ok := err.(*NewerRecordError)
+	if !ok {
+		t.Fatalf("expected a *NewerRecordError, got %v", err)
+	}
+	if nerr.Peer != b.self || string(nerr.Record.GetValue()) != "newer" {
+		t.Fatalf("expected the newer record held by %s, got %v from %s", b.self, nerr.Record, nerr.Peer)
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	if len(rejected) != 1 || rejected[0] != "/v/hello valid newer" {
+		t.Fatalf("expected the hook to report the stale put, got %v", rejected)
+	}
+	if rec, _ := b.getLocal("/v/hello"); string(rec.GetValue()) != "newer" {
+		t.Fatalf("expected the newer record to be kept, got %v", rec)
+	}
+}
+
+func TestNegativeResults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := make([]*IpfsDHT, 3)
+	for i := range dhts {
+		dhts[i] = setupDHT(ctx, t, false)
+		defer dhts[i].Close()
+		defer dhts[i].host.Close()
+	}
+	a, b, c := dhts[0], dhts[1], dhts[2]
+
+	// b has no record and only knows c, which is farther from the key.
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("/v/hello%d", i)
+		if kb.Closer(b.self, c.self, key) {
+			break
+		}
+	}
+	connect(t, ctx, a, b)
+	connect(t, ctx, b, c)
+
+	rec := record.MakePutRecord(key, []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := c.putLocal(key, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := a.GetValue(ctx, key, Quorum(1), NegativeResults(NegativeResultsAuthoritative))
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected b's answer to end the lookup, got %v", err)
+	}
+
+	val, err := a.GetValue(ctx, key, Quorum(1), NegativeResults(NegativeResultsContinue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "world" {
+		t.Fatalf("expected world, got %q", val)
+	}
+}
+
+func TestInvalidMessageSenderTracking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dht := setupDHT(ctx, t, false)
+	defer dht.Close()
+
+	foo := peer.ID("asdasd")
+	_, err := dht.messageSenderForPeer(ctx, foo)
+	if err == nil {
+		t.Fatal("that shouldnt have succeeded")
+	}
+
+	dht.smlk.Lock()
+	mscnt := len(dht.strmap)
+	dht.smlk.Unlock()
+
+	if mscnt > 0 {
+		t.Fatal("should have no message senders in map")
+	}
+}
+
+func TestProvides(t *testing.T) {
+	// t.Skip("skipping test to debug another")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	for _, k := range testCaseCids {
+		logger.Debugf("announcing provider for %s", k)
+		if err := dhts[3].Provide(ctx, k, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// what is this timeout for? was 60ms before.
+	time.Sleep(time.Millisecond * 6)
+
+	n := 0
+	for _, c := range testCaseCids {
+		n = (n + 1) % 3
+
+		logger.Debugf("getting providers for %s from %d", c, n)
+		ctxT, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		provchan := dhts[n].FindProvidersAsync(ctxT, c, 1)
+
+		select {
+		case prov := <-provchan:
+			if prov.ID == "" {
+				t.Fatal("Got back nil provider")
+			}
+			if prov.ID != dhts[3].self {
+				t.Fatal("Got back wrong provider")
+			}
+		case <-ctxT.Done():
+			t.Fatal("Did not get a provider back.")
+		}
+	}
+}
+
+func TestProvideExtraFanout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// with a bucket size of 2, only 2 of the peers are among the closest.
+	provider, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.BucketSize(2),
+		opts.ProvideExtraFanout(2),
+		opts.NamespacedValidator("v", blankValidator{}),
+		opts.DisableAutoRefresh(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	others := make([]*IpfsDHT, 10)
+	for i := range others {
+		others[i] = setupDHT(ctx, t, false)
+		// the provider's routing table can't fit them all.
+		connectNoSync(t, ctx, provider, others[i])
+		wait(t, ctx, others[i], provider)
+	}
+	defer func() {
+		for _, d := range append(others, provider) {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	if provider.routingTable.Size() < 3 {
+		t.Fatalf("expected at least 3 peers in the routing table, got %d", provider.routingTable.Size())
+	}
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+	stats, err := provider.ProvideWithStats(ctxT, testCaseCids[0], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ClosestSent != 2 || stats.ClosestAccepted != 2 {
+		t.Fatalf("expected the record to be sent to and accepted by the 2 closest peers, got %+v", stats)
+	}
+	random := provider.routingTable.Size() - stats.ClosestSent
+	if random > 2 {
+		random = 2
+	}
+	if stats.RandomSent != random || stats.RandomAccepted != random {
+		t.Fatalf("expected the record to be sent to and accepted by %d random peers, got %+v", random, stats)
+	}
+
+	// the record ends up with as many peers as accepted it.
+	var holders int
+	for i := 0; i < 100; i++ {
+		holders = 0
+		for _, d := range others {
+			if len(d.providers.GetProviders(ctx, testCaseCids[0])) > 0 {
+				holders++
+			}
+		}
+		if holders == stats.ClosestAccepted+stats.RandomAccepted {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d peers to store the record, got %d", stats.ClosestAccepted+stats.RandomAccepted, holders)
+}
+
+func TestFindProvidersAsyncEx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	c := testCaseCids[0]
+	if err := dhts[3].Provide(ctx, c, true); err != nil {
+		t.Fatal(err)
+	}
+
+	target := kb.ConvertKey(c.KeyString())
+	self := kb.ConvertPeerID(dhts[3].self)
+	closer := 0
+	for _, d := range dhts[:3] {
+		if kb.Closer(d.self, dhts[3].self, c.KeyString()) {
+			closer++
+		}
+	}
+
+	ctxT, cancelT := context.WithTimeout(ctx, time.Second)
+	defer cancelT()
+	select {
+	case prov, ok := <-dhts[0].FindProvidersAsyncEx(ctxT, c, 1):
+		if !ok {
+			t.Fatal("Did not get a provider back.")
+		}
+		if prov.ID != dhts[3].self {
+			t.Fatal("Got back wrong provider")
+		}
+		if cpl := kb.CommonPrefixLen(self, target); prov.CommonPrefixLen != cpl {
+			t.Fatalf("expected common prefix length %d, got %d", cpl, prov.CommonPrefixLen)
+		}
+		// The searcher doesn't necessarily learn of every peer before the
+		// provider, and never counts itself.
+		if prov.Rank > closer {
+			t.Fatalf("expected rank of at most %d, got %d", closer, prov.Rank)
+		}
+	case <-ctxT.Done():
+		t.Fatal("Did not get a provider back.")
+	}
+
+	// Once every peer is known, the rank is exact.
+	r := newProviderRanker(c)
+	for _, d := range dhts {
+		r.add(d.self)
+	}
+	if rank := r.rank(peer.AddrInfo{ID: dhts[3].self}).Rank; rank != closer {
+		t.Fatalf("expected rank %d, got %d", closer, rank)
+	}
+}
+
+func TestMergeProviderAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	c := testCaseCids[0]
+	prov := test.RandPeerIDFatal(t)
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001"), ma.StringCast("/ip4/5.6.7.8/tcp/4001")}
+	for i, d := range dhts[1:] {
+		d.peerstore.AddAddr(prov, addrs[i], time.Hour)
+		d.providers.AddProvider(ctx, c, prov)
+	}
+
+	find := func() []ma.Multiaddr {
+		t.Helper()
+		provs, err := dhts[0].FindProviders(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(provs) != 1 || provs[0].ID != prov {
+			t.Fatalf("expected a single provider, got %v", provs)
+		}
+		return provs[0].Addrs
+	}
+	if found := find(); len(found) != 1 {
+		t.Fatalf("expected the addresses of a single response, got %v", found)
+	}
+
+	dhts[0].mergeProviderAddrs = true
+	found := find()
+	if len(found) != 2 {
+		t.Fatalf("expected the addresses of both responses, got %v", found)
+	}
+	for _, a := range addrs {
+		if !found[0].Equal(a) && !found[1].Equal(a) {
+			t.Fatalf("expected %s to be merged, got %v", a, found)
+		}
+	}
+}
+
+func TestPeerProtocolVersions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	connect(t, ctx, a, b)
+
+	const newer = "/test/kad/2.0.0"
+	a.protocols = []protocol.ID{newer, opts.ProtocolDHT}
+	upgraded, unknown := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	a.peerstore.AddProtocols(upgraded, string(opts.ProtocolDHT), newer)
+	a.routingTable.Update(upgraded)
+	a.routingTable.Update(unknown)
+
+	versions := a.PeerProtocolVersions()
+	if len(versions) != 2 {
+		t.Fatalf("expected the versions of 2 peers, got %v", versions)
+	}
+	if versions[b.self] != opts.ProtocolDHT {
+		t.Errorf("expected %s for b, got %s", opts.ProtocolDHT, versions[b.self])
+	}
+	if versions[upgraded] != newer {
+		t.Errorf("expected the preferred %s, got %s", newer, versions[upgraded])
+	}
+}
+
+func TestBucketSplitHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	var counts []int
+	d.onBucketSplit = func(n int) {
+		counts = append(counts, n)
+	}
+	for i := 0; i < 10*KValue; i++ {
+		d.routingTable.Update(test.RandPeerIDFatal(t))
+	}
+
+	if len(counts) == 0 {
+		t.Fatal("expected the routing table to split")
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] <= counts[i-1] {
+			t.Fatalf("expected the bucket count to grow, got %v", counts)
+		}
+	}
+	if last := counts[len(counts)-1]; last != len(d.routingTable.GetAllBuckets()) {
+		t.Fatalf("expected the last split to report %d buckets, got %d", len(d.routingTable.GetAllBuckets()), last)
+	}
+}
+
+func TestBucketSplitHookRejectedPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	var counts []int
+	d.onBucketSplit = func(n int) {
+		counts = append(counts, n)
+	}
+	// fill the only bucket with peers that stay in bucket 0 after a split.
+	seen := make(map[peer.ID]bool)
+	for len(seen) <= d.bucketSize {
+		p := d.routingTable.GenRandPeerID(0)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		d.Update(ctx, p)
+	}
+
+	if d.routingTable.Size() != d.bucketSize {
+		t.Fatalf("expected the last peer to be rejected, got %d peers", d.routingTable.Size())
+	}
+	if len(counts) != 1 || counts[0] != 2 {
+		t.Fatalf("expected a single split to 2 buckets, got %v", counts)
+	}
+}
+
+func TestServeProvidersFreshnessThreshold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	c := testCaseCids[0]
+	old, fresh := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	for _, p := range []peer.ID{old, d.self} {
+		if err := d.providers.AddProvider(ctx, c, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := d.providers.AddProvider(ctx, c, fresh); err != nil {
+		t.Fatal(err)
+	}
+
+	if provs, err := d.servableProviders(ctx, c); err != nil || len(provs) != 3 {
+		t.Fatalf("expected all 3 providers without a threshold, got %v (%v)", provs, err)
+	}
+
+	// our own record is always served.
+	d.serveProvidersFreshness = 50 * time.Millisecond
+	provs, err := d.servableProviders(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := peer.NewSet()
+	for _, p := range provs {
+		served.Add(p)
+	}
+	if served.Size() != 2 || !served.Contains(fresh) || !served.Contains(d.self) {
+		t.Fatalf("expected only the fresh provider and ourselves, got %v", provs)
+	}
+
+	// the old record is still stored.
+	if provs := d.providers.GetProviders(ctx, c); len(provs) != 3 {
+		t.Fatalf("expected 3 stored providers, got %d", len(provs))
+	}
+}
+
+func TestProviderRecordServedHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	type served struct {
+		to           peer.ID
+		key          cid.Cid
+		numProviders int
+	}
+	var got []served
+	d.onProviderRecordServed = func(to peer.ID, key cid.Cid, numProviders int) {
+		got = append(got, served{to, key, numProviders})
+	}
 
-	connect(t, ctx, dhts[0], dhts[1])
-	connect(t, ctx, dhts[1], dhts[2])
-	connect(t, ctx, dhts[1], dhts[3])
+	requester := test.RandPeerIDFatal(t)
+	c := testCaseCids[0]
+	if err := d.providers.AddProvider(ctx, c, test.RandPeerIDFatal(t)); err != nil {
+		t.Fatal(err)
+	}
 
-	for _, k := range testCaseCids {
-		logger.Debugf("announcing provider for %s", k)
-		if err := dhts[3].Provide(ctx, k, true); err != nil {
+	for _, k := range []cid.Cid{c, testCaseCids[1]} {
+		pmes := pb.NewMessage(pb.Message_GET_PROVIDERS, k.Bytes(), 0)
+		if _, err := d.handleGetProviders(ctx, requester, pmes); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	// what is this timeout for? was 60ms before.
-	time.Sleep(time.Millisecond * 6)
-
-	n := 0
-	for _, c := range testCaseCids {
-		n = (n + 1) % 3
-
-		logger.Debugf("getting providers for %s from %d", c, n)
-		ctxT, cancel := context.WithTimeout(ctx, time.Second)
-		defer cancel()
-		provchan := dhts[n].FindProvidersAsync(ctxT, c, 1)
-
-		select {
-		case prov := <-provchan:
-			if prov.ID == "" {
-				t.Fatal("Got back nil provider")
-			}
-			if prov.ID != dhts[3].self {
-				t.Fatal("Got back wrong provider")
-			}
-		case <-ctxT.Done():
-			t.Fatal("Did not get a provider back.")
+	expected := []served{{requester, c, 1}, {requester, testCaseCids[1], 0}}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d calls, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("call %d: expected %v, got %v", i, expected[i], got[i])
 		}
 	}
 }
@@ -807,6 +2003,522 @@ func TestPeriodicRefresh(t *testing.T) {
 	}
 }
 
+func TestRefreshSparseBucketsOnly(t *testing.T) {
+	dht := newTestRoutingTableDHT(t, KValue/2)
+	bucket := dht.routingTable.GetAllBuckets()[0]
+
+	for _, tc := range []struct {
+		threshold float64
+		sparse    bool
+	}{
+		{1, true},
+		{0.5, true},
+		{0.25, false},
+		{0, false},
+	} {
+		dht.rtSparseBucketThreshold = tc.threshold
+		if dht.isSparseBucket(bucket) != tc.sparse {
+			t.Errorf("threshold %f: expected sparse to be %t with %d peers", tc.threshold, tc.sparse, bucket.Len())
+		}
+	}
+
+	var cfg opts.Options
+	if err := cfg.Apply(opts.RefreshSparseBucketsOnly(1.5)); err == nil {
+		t.Error("expected an out of range threshold to be rejected")
+	}
+}
+
+func TestRefreshUnderfullBuckets(t *testing.T) {
+	dht := newTestRoutingTableDHT(t, KValue/2)
+	bucket := dht.routingTable.GetAllBuckets()[0]
+	bucket.ResetRefreshedAt(time.Now())
+
+	if dht.shouldRefreshBucket(bucket) {
+		t.Error("expected a recently refreshed bucket not to be refreshed")
+	}
+	dht.rtMinBucketFullness = 0.75
+	if !dht.shouldRefreshBucket(bucket) {
+		t.Errorf("expected a bucket with %d peers to be refreshed", bucket.Len())
+	}
+	dht.rtMinBucketFullness = 0.5
+	if dht.shouldRefreshBucket(bucket) {
+		t.Errorf("expected a bucket with %d peers not to be refreshed", bucket.Len())
+	}
+
+	var cfg opts.Options
+	if err := cfg.Apply(opts.MinBucketFullness(-1)); err == nil {
+		t.Error("expected an out of range ratio to be rejected")
+	}
+}
+
+func TestOnRefreshComplete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	results := make(chan opts.RefreshResult, 1)
+	a.onRefreshComplete = func(res opts.RefreshResult) { results <- res }
+	// refresh the only bucket even though it was just created.
+	a.rtMinBucketFullness = 1
+	connect(t, ctx, a, b)
+	a.RefreshRoutingTable()
+
+	select {
+	case res := <-results:
+		if res.SelfWalkErr != nil {
+			t.Fatalf("unexpected self walk error: %s", res.SelfWalkErr)
+		}
+		if len(res.Buckets) != 1 || res.Buckets[0].Bucket != 0 || res.Succeeded != 1 || res.Failed != 0 {
+			t.Fatalf("expected bucket 0 to be refreshed, got %+v", res)
+		}
+		if res.Aggressive || res.Duration <= 0 {
+			t.Fatalf("unexpected result: %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the refresh")
+	}
+}
+
+func TestOnRefreshTarget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	type refreshTarget struct {
+		bucket int
+		target peer.ID
+	}
+	targets := make(chan refreshTarget, 10)
+	a.onRefreshTarget = func(bucketID int, target peer.ID) {
+		targets <- refreshTarget{bucketID, target}
+	}
+	done := make(chan struct{}, 1)
+	a.onRefreshComplete = func(opts.RefreshResult) { done <- struct{}{} }
+	// refresh the only bucket even though it was just created.
+	a.rtMinBucketFullness = 1
+	connect(t, ctx, a, b)
+	a.RefreshRoutingTable()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the refresh")
+	}
+	close(targets)
+	var got []refreshTarget
+	for rt := range targets {
+		got = append(got, rt)
+	}
+	if len(got) != 1 || got[0].bucket != 0 {
+		t.Fatalf("expected a single refresh of bucket 0, got %v", got)
+	}
+	if cpl := kb.CommonPrefixLen(kb.ConvertPeerID(got[0].target), kb.ConvertPeerID(a.self)); cpl != 0 {
+		t.Fatalf("expected the target to be in bucket 0, shares %d bits with us", cpl)
+	}
+}
+
+func TestReBootstrapOnIsolation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	isolations := make(chan opts.RefreshResult, 1)
+	a.onIsolation = func(res opts.RefreshResult) {
+		if a.routingTable.Find(b.self) == "" {
+			t.Error("expected to be re-bootstrapped before the hook is called")
+		}
+		select {
+		case isolations <- res:
+		default:
+		}
+	}
+	a.rebootstrapPeers = []peer.AddrInfo{{ID: b.self, Addrs: b.host.Addrs()}}
+	a.identifyWaitTimeout = 5 * time.Second
+
+	timeout := time.After(5 * time.Second)
+	for {
+		a.RefreshRoutingTable()
+		select {
+		case res := <-isolations:
+			if !res.Isolated || res.ReBootstrapErr != nil {
+				t.Fatalf("expected to re-bootstrap after finding ourselves isolated, got %+v", res)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for the refresh")
+		}
+	}
+}
+
+func TestRefreshWorkerStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	if st := a.RefreshWorkerStatus(); !st.Alive || st.Runs != 0 || !st.LastRun.IsZero() {
+		t.Fatalf("expected an idle worker, got %+v", st)
+	}
+	connect(t, ctx, a, b)
+
+	// refresh waits for a refresh to complete after the given number of
+	// runs. Adding peers to a small routing table triggers refreshes too.
+	refresh := func(after int) WorkerStatus {
+		for i := 0; i < 500; i++ {
+			// triggers are dropped while the worker is busy.
+			a.RefreshRoutingTable()
+			if st := a.RefreshWorkerStatus(); st.Runs > after && st.LastDuration > 0 {
+				return st
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for the refresh: %+v", a.RefreshWorkerStatus())
+		return WorkerStatus{}
+	}
+	st := refresh(0)
+	if st.LastRun.IsZero() {
+		t.Fatalf("expected a refresh to be recorded, got %+v", st)
+	}
+
+	// the refresh worker stops.
+	a.rtRefreshWorker.mu.Lock()
+	proc := a.rtRefreshProc
+	a.rtRefreshWorker.mu.Unlock()
+	proc.Close()
+	if st := a.RefreshWorkerStatus(); st.Alive {
+		t.Fatalf("expected the worker to be dead, got %+v", st)
+	}
+
+	if err := a.RestartRefreshWorker(); err != nil {
+		t.Fatal(err)
+	}
+	if st := a.RefreshWorkerStatus(); !st.Alive || st.Restarts != 1 {
+		t.Fatalf("expected the worker to be restarted, got %+v", st)
+	}
+	refresh(a.RefreshWorkerStatus().Runs)
+
+	a.Close()
+	if err := a.RestartRefreshWorker(); err != ErrRefreshWorkerClosed {
+		t.Fatalf("expected ErrRefreshWorkerClosed, got %v", err)
+	}
+	if st := a.RefreshWorkerStatus(); st.Alive {
+		t.Fatalf("expected the worker to be stopped with the dht, got %+v", st)
+	}
+}
+
+func TestRestartRefreshWorkerConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	defer a.host.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.RestartRefreshWorker(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if st := a.RefreshWorkerStatus(); !st.Alive || st.Restarts != 10 {
+		t.Fatalf("expected the worker to be restarted 10 times, got %+v", st)
+	}
+
+	// no worker is left listening for triggers.
+	a.Close()
+	select {
+	case a.triggerRtRefresh <- struct{}{}:
+		t.Fatal("expected every refresh worker to be stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRefreshRoutingTableAsync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	defer a.host.Close()
+
+	// hold the first refresh until released.
+	inProgress := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	a.onRefreshComplete = func(opts.RefreshResult) {
+		once.Do(func() {
+			close(inProgress)
+			<-release
+		})
+	}
+	timeout := time.After(5 * time.Second)
+wait:
+	for {
+		// triggers are dropped while the worker is busy.
+		a.RefreshRoutingTable()
+		select {
+		case <-inProgress:
+			break wait
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for the refresh")
+		}
+	}
+	runs := a.RefreshWorkerStatus().Runs
+
+	// callers during a refresh share the next one.
+	chs := make([]<-chan opts.RefreshResult, 3)
+	for i := range chs {
+		chs[i] = a.RefreshRoutingTableAsync()
+	}
+	close(release)
+	var results []opts.RefreshResult
+	for _, ch := range chs {
+		select {
+		case res, ok := <-ch:
+			if !ok {
+				t.Fatal("expected a refresh result")
+			}
+			results = append(results, res)
+		case <-timeout:
+			t.Fatal("timed out waiting for the refresh")
+		}
+	}
+	for _, res := range results[1:] {
+		if res.Duration != results[0].Duration {
+			t.Fatalf("expected all callers to get the same result, got %+v", results)
+		}
+	}
+	if st := a.RefreshWorkerStatus(); st.Runs != runs+1 {
+		t.Fatalf("expected a single refresh for all callers, got %d", st.Runs-runs)
+	}
+
+	// callers arriving right as the worker goes idle aren't lost.
+	for i := 0; i < 100; i++ {
+		select {
+		case <-a.RefreshRoutingTableAsync():
+		case <-timeout:
+			t.Fatal("timed out waiting for the refresh")
+		}
+	}
+
+	a.Close()
+	if _, ok := <-a.RefreshRoutingTableAsync(); ok {
+		t.Fatal("expected no result once the dht is closed")
+	}
+}
+
+func TestPrioritizeClosestBucket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	connect(t, ctx, a, b)
+	if res := a.refreshBuckets(ctx, false); len(res) != 0 {
+		t.Fatalf("expected the fresh bucket not to be refreshed, got %+v", res)
+	}
+
+	// the only bucket is the closest one.
+	a.rtPrioritizeClosest = true
+	if res := a.refreshBuckets(ctx, false); len(res) != 1 || res[0].Bucket != 0 {
+		t.Fatalf("expected the closest bucket to be refreshed, got %+v", res)
+	}
+
+	var targets []peer.ID
+	a.onRefreshTarget = func(bucketID int, target peer.ID) {
+		if bucketID != 0 {
+			t.Errorf("unexpected refresh of bucket %d", bucketID)
+		}
+		targets = append(targets, target)
+	}
+	a.refreshClosestBucket(ctx)
+	if len(targets) != closestBucketWalks {
+		t.Fatalf("expected %d walks in the closest bucket, got %d", closestBucketWalks, len(targets))
+	}
+}
+
+func TestMaxRefreshBuckets(t *testing.T) {
+	var cfg opts.Options
+	if err := cfg.Apply(opts.Defaults); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RoutingTable.MaxRefreshBuckets != 16 {
+		t.Fatalf("expected 16 buckets to be refreshed by default, got %d", cfg.RoutingTable.MaxRefreshBuckets)
+	}
+	if err := cfg.Apply(opts.MaxRefreshBuckets(8)); err != nil || cfg.RoutingTable.MaxRefreshBuckets != 8 {
+		t.Fatalf("expected 8 buckets to be refreshed, got %d (%v)", cfg.RoutingTable.MaxRefreshBuckets, err)
+	}
+	for _, n := range []int{0, 17} {
+		if err := cfg.Apply(opts.MaxRefreshBuckets(n)); err == nil {
+			t.Errorf("expected %d buckets to be rejected", n)
+		}
+	}
+}
+
+func TestConnectBootstrapPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := minRTRefreshThreshold + 3
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	d := dhts[0]
+	d.bootstrapDialConcurrency = 1
+
+	// dead peers are skipped.
+	peers := []peer.AddrInfo{{ID: test.RandPeerIDFatal(t)}}
+	if err := d.ConnectBootstrapPeers(ctx, peers); err == nil {
+		t.Fatal("expected an error when no bootstrap peer is reachable")
+	}
+
+	for _, other := range dhts[1:] {
+		peers = append(peers, peer.AddrInfo{ID: other.self, Addrs: other.host.Addrs()})
+	}
+	if err := d.ConnectBootstrapPeers(ctx, peers); err != nil {
+		t.Fatal(err)
+	}
+
+	// dials are sequential, so we should stop right after exceeding the
+	// threshold.
+	for i, other := range dhts[1:] {
+		connected := d.host.Network().Connectedness(other.self) == network.Connected
+		if expected := i <= minRTRefreshThreshold; connected != expected {
+			t.Errorf("bootstrap peer %d: expected connected to be %t", i, expected)
+		}
+	}
+}
+
+func TestConnectBootstrapPeersIdentifyWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.identifyWaitTimeout = 5 * time.Second
+	peers := []peer.AddrInfo{{ID: b.self, Addrs: b.host.Addrs()}}
+	if err := a.ConnectBootstrapPeers(ctx, peers); err != nil {
+		t.Fatal(err)
+	}
+	// b is identified and usable as soon as we're connected.
+	if a.routingTable.Find(b.self) == "" {
+		t.Fatal("expected the bootstrap peer to be in the routing table")
+	}
+}
+
+func TestConnectBootstrapPeersBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.bootstrapBackoff = newBootstrapBackoff(time.Hour, 3*time.Hour)
+	dead := peer.AddrInfo{ID: test.RandPeerIDFatal(t)}
+	if err := a.ConnectBootstrapPeers(ctx, []peer.AddrInfo{dead}); err == nil {
+		t.Fatal("expected an error when no bootstrap peer is reachable")
+	}
+	states := a.BootstrapBackoffStates()
+	if s, ok := states[dead.ID]; len(states) != 1 || !ok || s.Failures != 1 || s.Delay != time.Hour {
+		t.Fatalf("expected the dead peer to back off for an hour, got %+v", states)
+	}
+	if err := a.ConnectBootstrapPeers(ctx, []peer.AddrInfo{dead}); err == nil || a.BootstrapBackoffStates()[dead.ID].Failures != 1 {
+		t.Fatal("expected the dead peer to be skipped")
+	}
+
+	// the backoff doubles up to the max, and a success clears it.
+	a.bootstrapBackoff.failed(dead.ID)
+	a.bootstrapBackoff.failed(dead.ID)
+	if s := a.BootstrapBackoffStates()[dead.ID]; s.Failures != 3 || s.Delay != 3*time.Hour {
+		t.Fatalf("expected a capped backoff after 3 failures, got %+v", s)
+	}
+	a.bootstrapBackoff.failed(b.self)
+	a.bootstrapBackoff.peers[b.self].RetryAt = time.Now()
+	if err := a.ConnectBootstrapPeers(ctx, []peer.AddrInfo{dead, {ID: b.self, Addrs: b.host.Addrs()}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.BootstrapBackoffStates()[b.self]; ok {
+		t.Fatal("expected the backoff of the reachable peer to be cleared")
+	}
+}
+
+func TestSeedFromExistingConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := setupDHT(ctx, t, false)
+	defer b.Close()
+	defer b.host.Close()
+
+	for _, seed := range []bool{false, true} {
+		h := bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport))
+		defer h.Close()
+		if err := h.Connect(ctx, peer.AddrInfo{ID: b.self, Addrs: b.host.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+
+		options := []opts.Option{opts.DisableAutoRefresh()}
+		if seed {
+			options = append(options, opts.SeedFromExistingConnections())
+		}
+		a, err := New(ctx, h, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+
+		if found := a.routingTable.Find(b.self) != ""; found != seed {
+			t.Errorf("seeding %t: expected the connected peer in the routing table to be %t", seed, seed)
+		}
+	}
+}
+
 func TestProvidesMany(t *testing.T) {
 	t.Skip("this test doesn't work")
 	ctx, cancel := context.WithCancel(context.Background())
@@ -1519,3 +3231,32 @@ func TestClientModeAtInit(t *testing.T) {
 	err := pinger.Ping(context.Background(), client.PeerID())
 	assert.True(t, xerrors.Is(err, multistream.ErrNotSupported))
 }
+
+func TestCloseTeardown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := setupDHTS(t, ctx, 2)
+	connect(t, ctx, ds[0], ds[1])
+
+	require.NoError(t, ds[0].Close())
+	// closing twice should be safe.
+	require.NoError(t, ds[0].Close())
+
+	for _, p := range ds[0].host.Mux().Protocols() {
+		assert.NotEqual(t, string(opts.ProtocolDHT), p, "should have stopped handling inbound requests")
+	}
+	select {
+	case <-ds[0].rtRefreshProc.Closed():
+	default:
+		t.Fatal("expected the refresh worker to be stopped")
+	}
+	select {
+	case <-ds[0].providers.Process().Closed():
+	default:
+		t.Fatal("expected the provider manager to be stopped")
+	}
+	assert.Error(t, ds[0].queryCtx.Err(), "expected queries to be canceled")
+
+	ds[1].peerstore.AddAddrs(ds[0].PeerID(), ds[0].Host().Addrs(), peerstore.AddressTTL)
+	assert.Error(t, ds[1].Ping(ctx, ds[0].PeerID()))
+}
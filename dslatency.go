@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// timedDatastore reports the latency of datastore operations, see the
+// DatastoreLatencyHook option.
+type timedDatastore struct {
+	ds.Batching
+	hook func(op string, d time.Duration)
+}
+
+func (t *timedDatastore) Get(key ds.Key) ([]byte, error) {
+	defer t.time("get", time.Now())
+	return t.Batching.Get(key)
+}
+
+func (t *timedDatastore) Has(key ds.Key) (bool, error) {
+	defer t.time("has", time.Now())
+	return t.Batching.Has(key)
+}
+
+func (t *timedDatastore) GetSize(key ds.Key) (int, error) {
+	defer t.time("getsize", time.Now())
+	return t.Batching.GetSize(key)
+}
+
+func (t *timedDatastore) Put(key ds.Key, value []byte) error {
+	defer t.time("put", time.Now())
+	return t.Batching.Put(key, value)
+}
+
+func (t *timedDatastore) Delete(key ds.Key) error {
+	defer t.time("delete", time.Now())
+	return t.Batching.Delete(key)
+}
+
+func (t *timedDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	defer t.time("query", time.Now())
+	return t.Batching.Query(q)
+}
+
+func (t *timedDatastore) Batch() (ds.Batch, error) {
+	b, err := t.Batching.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &timedBatch{Batch: b, ds: t}, nil
+}
+
+func (t *timedDatastore) time(op string, start time.Time) {
+	t.hook(op, time.Since(start))
+}
+
+// timedBatch reports the latency of committing a batch.
+type timedBatch struct {
+	ds.Batch
+	ds *timedDatastore
+}
+
+func (b *timedBatch) Commit() error {
+	defer b.ds.time("batch", time.Now())
+	return b.Batch.Commit()
+}
@@ -0,0 +1,58 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	u "github.com/ipfs/go-ipfs-util"
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	record "github.com/libp2p/go-libp2p-record"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+)
+
+func TestDatastoreLatencyHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	ops := make(map[string]int)
+	d, err := New(
+		ctx,
+		bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.DisableAutoRefresh(),
+		opts.DatastoreLatencyHook(func(op string, _ time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			ops[op]++
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.host.Close()
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := d.putLocal("/v/hello", rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.getLocal("/v/hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.providers.AddProvider(ctx, testCaseCids[0], d.self); err != nil {
+		t.Fatal(err)
+	}
+	// the provider manager commits its writes when closed.
+	d.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, op := range []string{"put", "get", "batch"} {
+		if ops[op] == 0 {
+			t.Errorf("expected %q operations to be timed, got %v", op, ops)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// refreshEscalation upgrades the next routing table refresh to an aggressive
+// one after enough refresh triggers within a window, see the
+// EscalatingRefresh option.
+type refreshEscalation struct {
+	triggers int
+	window   time.Duration
+
+	lk       sync.Mutex
+	recent   []time.Time // triggers within the window, oldest first
+	escalate bool
+}
+
+func newRefreshEscalation(triggers int, window time.Duration) *refreshEscalation {
+	return &refreshEscalation{triggers: triggers, window: window}
+}
+
+// trigger records a refresh trigger.
+func (e *refreshEscalation) trigger() {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	now := time.Now()
+	i := 0
+	for i < len(e.recent) && now.Sub(e.recent[i]) > e.window {
+		i++
+	}
+	e.recent = append(e.recent[i:], now)
+	if len(e.recent) >= e.triggers {
+		e.escalate = true
+		e.recent = e.recent[:0]
+	}
+}
+
+// take returns true if the next refresh should be aggressive, and resets the
+// escalation.
+func (e *refreshEscalation) take() bool {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	escalate := e.escalate
+	e.escalate = false
+	return escalate
+}
@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshEscalation(t *testing.T) {
+	e := newRefreshEscalation(3, 50*time.Millisecond)
+	e.trigger()
+	e.trigger()
+	if e.take() {
+		t.Fatal("expected no escalation after 2 triggers")
+	}
+
+	// triggers older than the window don't count.
+	time.Sleep(60 * time.Millisecond)
+	e.trigger()
+	if e.take() {
+		t.Fatal("expected triggers outside the window not to count")
+	}
+	e.trigger()
+	e.trigger()
+	if !e.take() {
+		t.Fatal("expected 3 triggers within the window to escalate")
+	}
+	if e.take() {
+		t.Fatal("expected the escalation to only apply to the next refresh")
+	}
+}
@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// PeerResult is the outcome of looking up a single peer with FindPeers.
+type PeerResult struct {
+	ID       peer.ID
+	AddrInfo peer.AddrInfo // set if Err is nil
+	Err      error
+}
+
+// FindPeers looks up the given peers, running up to concurrency lookups at
+// once, and sends each result on the returned channel as soon as it's known.
+// The channel is closed once all the peers were looked up, or when ctx is
+// done, in which case the peers not resolved yet are left out.
+//
+// Peers we're already connected to are returned right away. The others are
+// looked up in keyspace order, so that concurrent lookups head for the same
+// region of the DHT and reuse each other's connections. A peer an earlier
+// lookup connected to, e.g. by querying it on the way, is returned without a
+// lookup of its own. Duplicate IDs are only looked up once.
+func (dht *IpfsDHT) FindPeers(ctx context.Context, ids []peer.ID, concurrency int) <-chan PeerResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	out := make(chan PeerResult)
+	send := func(r PeerResult) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		select {
+		case out <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(out)
+
+		targets := make([]peer.ID, 0, len(ids))
+		seen := peer.NewSet()
+		for _, id := range ids {
+			if !seen.TryAdd(id) {
+				continue
+			}
+			if pi := dht.FindLocal(id); pi.ID != "" {
+				if !send(PeerResult{ID: id, AddrInfo: pi}) {
+					return
+				}
+				continue
+			}
+			targets = append(targets, id)
+		}
+		sortByKeyspace(targets)
+
+		todo := make(chan peer.ID)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency && i < len(targets); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for id := range todo {
+					// earlier lookups may have connected us to it.
+					pi := dht.FindLocal(id)
+					var err error
+					if pi.ID == "" {
+						pi, err = dht.FindPeer(ctx, id)
+					}
+					if !send(PeerResult{ID: id, AddrInfo: pi, Err: err}) {
+						return
+					}
+				}
+			}()
+		}
+
+	feed:
+		for _, id := range targets {
+			select {
+			case todo <- id:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(todo)
+		wg.Wait()
+	}()
+
+	return out
+}
+
+// sortByKeyspace sorts the peers by their position in the keyspace, so that
+// peers close to each other are next to each other.
+func sortByKeyspace(peers []peer.ID) {
+	keys := make(map[peer.ID]kb.ID, len(peers))
+	for _, p := range peers {
+		keys[p] = kb.ConvertPeerID(p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return bytes.Compare(keys[peers[i]], keys[peers[j]]) < 0
+	})
+}
@@ -0,0 +1,67 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+func TestFindPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[i-1], dhts[i])
+	}
+
+	unknown := test.RandPeerIDFatal(t)
+	ids := []peer.ID{dhts[4].self, dhts[1].self, dhts[2].self, unknown, dhts[3].self, dhts[2].self}
+
+	ctxT, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	results := make(map[peer.ID]PeerResult)
+	for r := range dhts[0].FindPeers(ctxT, ids, 2) {
+		if _, ok := results[r.ID]; ok {
+			t.Fatalf("got %s twice", r.ID)
+		}
+		results[r.ID] = r
+	}
+
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	for _, d := range dhts[1:] {
+		r := results[d.self]
+		if r.Err != nil || r.AddrInfo.ID != d.self || len(r.AddrInfo.Addrs) == 0 {
+			t.Fatalf("expected to find %s, got %v (%v)", d.self, r.AddrInfo, r.Err)
+		}
+	}
+	if results[unknown].Err == nil {
+		t.Fatal("expected the unknown peer not to be found")
+	}
+}
+
+func TestFindPeersCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	ctxT, cancelT := context.WithCancel(ctx)
+	cancelT()
+	for r := range d.FindPeers(ctxT, []peer.ID{test.RandPeerIDFatal(t)}, 1) {
+		t.Fatalf("expected no results once cancelled, got %v", r)
+	}
+}
@@ -16,9 +16,12 @@ import (
 	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
 	"github.com/whyrusleeping/base32"
+	"go.opencensus.io/stats"
 )
 
 // dhthandler specifies the signature of functions that handle DHT messages.
@@ -27,15 +30,21 @@ type dhtHandler func(context.Context, peer.ID, *pb.Message) (*pb.Message, error)
 func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 	switch t {
 	case pb.Message_GET_VALUE:
-		return dht.handleGetValue
+		return dht.denyKeys(dht.handleGetValue)
 	case pb.Message_PUT_VALUE:
-		return dht.handlePutValue
+		if dht.replica {
+			return dht.handleReadOnly
+		}
+		return dht.denyKeys(dht.handlePutValue)
 	case pb.Message_FIND_NODE:
 		return dht.handleFindPeer
 	case pb.Message_ADD_PROVIDER:
-		return dht.handleAddProvider
+		if dht.replica {
+			return dht.handleReadOnly
+		}
+		return dht.denyKeys(dht.handleAddProvider)
 	case pb.Message_GET_PROVIDERS:
-		return dht.handleGetProviders
+		return dht.denyKeys(dht.handleGetProviders)
 	case pb.Message_PING:
 		return dht.handlePing
 	default:
@@ -43,6 +52,39 @@ func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 	}
 }
 
+// handleReadOnly rejects writes in replica mode. PUT_VALUE requesters get their
+// stream reset; ADD_PROVIDER messages expect no response and are just dropped.
+func (dht *IpfsDHT) handleReadOnly(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	logger.Debugf("%s rejecting %s from %s: %s", dht.self, pmes.GetType(), p, ErrReadOnlyReplica)
+	if pmes.GetType() == pb.Message_ADD_PROVIDER {
+		return nil, nil
+	}
+	return nil, ErrReadOnlyReplica
+}
+
+// denyKeys wraps h to refuse messages for keys on the denylist. Lookups get an
+// empty response, PUT_VALUE requesters get their stream reset and ADD_PROVIDER
+// messages are dropped.
+func (dht *IpfsDHT) denyKeys(h dhtHandler) dhtHandler {
+	if dht.keyDenied == nil {
+		return h
+	}
+	return func(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+		if !dht.keyDenied(pmes.GetKey()) {
+			return h(ctx, p, pmes)
+		}
+		logger.Debugf("%s refusing %s from %s for denied key", dht.self, pmes.GetType(), p)
+		switch pmes.GetType() {
+		case pb.Message_PUT_VALUE:
+			return nil, ErrKeyDenied
+		case pb.Message_ADD_PROVIDER:
+			return nil, nil
+		default:
+			return pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel()), nil
+		}
+	}
+}
+
 func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, err error) {
 	ctx = logger.Start(ctx, "handleGetValue")
 	logger.SetTag(ctx, "peer", p)
@@ -60,7 +102,7 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	}
 
 	rec, err := dht.checkLocalDatastore(k)
-	if err != nil {
+	if err := dht.checkDatastoreError(err); err != nil {
 		return nil, err
 	}
 	resp.Record = rec
@@ -128,9 +170,12 @@ func (dht *IpfsDHT) checkLocalDatastore(k []byte) (*recpb.Record, error) {
 	// may be computationally expensive
 
 	if recordIsBad {
-		err := dht.datastore.Delete(dskey)
-		if err != nil {
-			logger.Error("Failed to delete bad record from datastore: ", err)
+		// in replica mode, the primary cleans up its own datastore.
+		if !dht.replica {
+			err := dht.datastore.Delete(dskey)
+			if err != nil {
+				logger.Error("Failed to delete bad record from datastore: ", err)
+			}
 		}
 
 		return nil, nil // can treat this as not having the record at all
@@ -162,8 +207,13 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 
 	cleanRecord(rec)
 
+	if err = dht.checkRecordSize(string(rec.GetKey()), rec.GetValue()); err != nil {
+		logger.Warningf("Oversized dht record in PUT from %s: %s", p.Pretty(), err)
+		return nil, err
+	}
+
 	// Make sure the record is valid (not expired, valid signature etc)
-	if err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue()); err != nil {
+	if err = dht.validatorFor(string(rec.GetKey())).Validate(string(rec.GetKey()), rec.GetValue()); err != nil {
 		logger.Warningf("Bad dht record in PUT from: %s. %s", p.Pretty(), err)
 		return nil, err
 	}
@@ -185,19 +235,29 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	// This prevents a record with for example a lower sequence number from
 	// overwriting a record with a higher sequence number.
 	existing, err := dht.getRecordFromDatastore(dskey)
-	if err != nil {
+	if err := dht.checkDatastoreError(err); err != nil {
 		return nil, err
 	}
 
 	if existing != nil {
 		recs := [][]byte{rec.GetValue(), existing.GetValue()}
-		i, err := dht.Validator.Select(string(rec.GetKey()), recs)
+		i, err := dht.validatorFor(string(rec.GetKey())).Select(string(rec.GetKey()), recs)
 		if err != nil {
 			logger.Warningf("Bad dht record in PUT from %s: %s", p.Pretty(), err)
 			return nil, err
 		}
 		if i != 0 {
 			logger.Infof("DHT record in PUT from %s is older than existing record. Ignoring", p.Pretty())
+			if dht.onStalePutRejected != nil {
+				dht.onStalePutRejected(p, string(rec.GetKey()), rec.GetValue(), existing.GetValue())
+			}
+			if dht.returnNewerRecordOnStalePut {
+				// let the putter know it's behind.
+				cleanRecord(existing)
+				resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
+				resp.Record = existing
+				return resp, nil
+			}
 			return nil, errors.New("old record")
 		}
 	}
@@ -210,6 +270,8 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, err
 	}
 
+	// NOTE: We always fail if we can't store the record, regardless of the
+	// datastore error policy, as there's nothing to fall back to.
 	err = dht.datastore.Put(dskey, data)
 	logger.Debugf("%s handlePutValue %v", dht.self, dskey)
 	return pmes, err
@@ -234,7 +296,7 @@ func (dht *IpfsDHT) getRecordFromDatastore(dskey ds.Key) (*recpb.Record, error)
 		return nil, nil
 	}
 
-	err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue())
+	err = dht.validatorFor(string(rec.GetKey())).Validate(string(rec.GetKey()), rec.GetValue())
 	if err != nil {
 		// Invalid record in datastore, probably expired but don't return an error,
 		// we'll just overwrite it
@@ -301,6 +363,27 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, p peer.ID, pmes *pb.Mess
 	return resp, nil
 }
 
+// servableProviders returns the providers of c we hand out to peers, leaving
+// out records older than the ServeProvidersFreshnessThreshold option allows.
+func (dht *IpfsDHT) servableProviders(ctx context.Context, c cid.Cid) ([]peer.ID, error) {
+	if dht.serveProvidersFreshness <= 0 {
+		return dht.providers.GetProvidersWithError(ctx, c)
+	}
+	provs, expires, err := dht.providers.GetProvidersWithExpiry(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	// records expire ProvideValidity after they were last refreshed.
+	oldest := time.Now().Add(-dht.serveProvidersFreshness).Add(providers.ProvideValidity)
+	fresh := provs[:0]
+	for i, p := range provs {
+		if p == dht.self || !expires[i].Before(oldest) {
+			fresh = append(fresh, p)
+		}
+	}
+	return fresh, nil
+}
+
 func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
 	ctx = logger.Start(ctx, "handleGetProviders")
 	defer func() { logger.FinishWithErr(ctx, _err) }()
@@ -320,19 +403,28 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 
 	// check if we have this value, to add ourselves as provider.
 	has, err := dht.datastore.Has(convertToDsKey(c.Bytes()))
-	if err != nil && err != ds.ErrNotFound {
-		logger.Debugf("unexpected datastore error: %v\n", err)
-		has = false
+	if err == ds.ErrNotFound {
+		err = nil
+	}
+	if err := dht.checkProviderDatastoreError(err); err != nil {
+		return nil, err
 	}
 
 	// setup providers
-	providers := dht.providers.GetProviders(ctx, c)
+	providers, err := dht.servableProviders(ctx, c)
+	if err := dht.checkProviderDatastoreError(err); err != nil {
+		return nil, err
+	}
 	if has {
 		providers = append(providers, dht.self)
 		logger.Debugf("%s have the value. added self as provider", reqDesc)
 	}
 
 	if len(providers) > 0 {
+		// Provider records only hold peer IDs: the addresses we hand out
+		// are read from the peerstore every time, so they're the latest
+		// ones identify, our queries or ADD_PROVIDER messages told us
+		// about. The latter expire after peerstore.ProviderAddrTTL.
 		// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
 		infos := pstore.PeerInfos(dht.peerstore, providers)
 		resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
@@ -348,6 +440,10 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 		logger.Debugf("%s have %d closer peers: %s", reqDesc, len(closer), infos)
 	}
 
+	if dht.onProviderRecordServed != nil {
+		dht.onProviderRecordServed(p, c, len(providers))
+	}
+
 	return resp, nil
 }
 
@@ -374,7 +470,7 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 			continue
 		}
 
-		if len(pi.Addrs) < 1 {
+		if pi.Addrs = dht.withAcceptedScopes(pi.Addrs); len(pi.Addrs) < 1 {
 			logger.Debugf("%s got no valid addresses for provider %s. Ignore.", dht.self, p)
 			continue
 		}
@@ -384,7 +480,23 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 			// add the received addresses to our peerstore.
 			dht.peerstore.AddAddrs(pi.ID, pi.Addrs, peerstore.ProviderAddrTTL)
 		}
-		dht.providers.AddProvider(ctx, c, p)
+		result, err := dht.providers.AddProviderRecord(ctx, c, p)
+		if err == providers.ErrTooManyRecords || err == providers.ErrStoreFull {
+			logger.Debugf("%s rejected provider record for %s from %s: %s", dht.self, c, p, err)
+			stats.Record(ctx, metrics.RejectedProviderRecords.M(1))
+			continue
+		}
+		if err := dht.checkProviderDatastoreError(err); err != nil {
+			return nil, err
+		}
+		switch result {
+		case providers.ProviderAdded:
+			stats.Record(ctx, metrics.NewProviderRecords.M(1))
+		case providers.ProviderRefreshed:
+			stats.Record(ctx, metrics.RefreshedProviderRecords.M(1))
+		case providers.ProviderRefreshThrottled:
+			stats.Record(ctx, metrics.ThrottledProviderRefreshes.M(1))
+		}
 	}
 
 	return nil, nil
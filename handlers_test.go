@@ -5,6 +5,10 @@ import (
 	"testing"
 
 	proto "github.com/gogo/protobuf/proto"
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
 )
 
@@ -57,3 +61,56 @@ func TestCleanRecord(t *testing.T) {
 		t.Error("failed to clean record")
 	}
 }
+
+func TestOnCloserPeersSelected(t *testing.T) {
+	dht := newTestRoutingTableDHT(t, 100)
+	requester := dht.routingTable.ListPeers()[0]
+	key := kb.ConvertKey("hello")
+
+	var (
+		calls     int
+		selected  []peer.ID
+		distances []kb.ID
+	)
+	dht.onCloserPeersSelected = func(to peer.ID, target []byte, peers []peer.ID, dists []kb.ID) {
+		calls++
+		if to != requester {
+			t.Errorf("expected the requester %s, got %s", requester, to)
+		}
+		if string(target) != "hello" {
+			t.Errorf("expected the target key, got %q", target)
+		}
+		selected = peers
+		distances = dists
+	}
+
+	pmes := pb.NewMessage(pb.Message_FIND_NODE, []byte("hello"), 0)
+	closer := dht.betterPeersToQuery(pmes, requester, dht.bucketSize)
+	if calls != 1 {
+		t.Fatalf("expected one call, got %d", calls)
+	}
+	if len(selected) != len(closer) {
+		t.Fatalf("expected the %d returned peers, got %d", len(closer), len(selected))
+	}
+	if len(distances) != len(selected) {
+		t.Fatalf("expected %d distances, got %d", len(selected), len(distances))
+	}
+
+	var expected []peer.ID
+	for _, p := range dht.routingTable.NearestPeers(key, dht.bucketSize) {
+		if p != requester {
+			expected = append(expected, p)
+		}
+	}
+	if len(selected) != len(expected) {
+		t.Fatalf("expected %d selected peers, got %d", len(expected), len(selected))
+	}
+	for i, p := range selected {
+		if p != expected[i] {
+			t.Fatalf("expected %s at position %d, got %s", expected[i], i, p)
+		}
+		if !bytes.Equal(distances[i], u.XOR(kb.ConvertPeerID(p), key)) {
+			t.Fatalf("wrong distance for %s at position %d", p, i)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrEmptyRoutingTable is returned by HealthCheck when we don't know any peers
+// to query.
+var ErrEmptyRoutingTable = errors.New("routing table is empty")
+
+// HealthCheck returns nil if the DHT is ready to serve lookups: its routing
+// table isn't empty and, if the HealthyAfterQueries option is set, enough
+// queries have been answered since it started.
+func (dht *IpfsDHT) HealthCheck() error {
+	if dht.routingTable.Size() == 0 {
+		return ErrEmptyRoutingTable
+	}
+	if n := int(atomic.LoadInt32(&dht.warmUpQueries)); n < dht.healthyAfterQueries {
+		return fmt.Errorf("dht is warming up: %d of %d queries succeeded", n, dht.healthyAfterQueries)
+	}
+	return nil
+}
+
+// recordWarmUpQuery counts a query at least one peer answered towards the
+// HealthyAfterQueries threshold. Counting stops at the threshold so the
+// counter can't overflow.
+func (dht *IpfsDHT) recordWarmUpQuery() {
+	if int(atomic.LoadInt32(&dht.warmUpQueries)) < dht.healthyAfterQueries {
+		atomic.AddInt32(&dht.warmUpQueries, 1)
+	}
+}
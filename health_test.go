@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.healthyAfterQueries = 2
+	if err := a.HealthCheck(); err != ErrEmptyRoutingTable {
+		t.Fatalf("expected an empty routing table, got %v", err)
+	}
+
+	connect(t, ctx, a, b)
+	if err := a.HealthCheck(); err == nil {
+		t.Fatal("expected the DHT to be warming up")
+	}
+
+	run := func(qfunc queryFunc) {
+		a.newQuery("hello", qfunc).Run(ctx, []peer.ID{b.self})
+	}
+
+	// failed queries don't count.
+	run(func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return nil, context.DeadlineExceeded
+	})
+	run(func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{success: true}, nil
+	})
+	if err := a.HealthCheck(); err == nil {
+		t.Fatal("expected the DHT to still be warming up")
+	}
+
+	run(func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{success: true}, nil
+	})
+	if err := a.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
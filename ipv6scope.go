@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"net"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// withAcceptedScopes filters the IPv6 addresses in scopes the IPv6ScopePolicy
+// option rejects out of addrs, in place.
+func (dht *IpfsDHT) withAcceptedScopes(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if dht.ipv6Scopes == opts.IPv6LinkLocal|opts.IPv6UniqueLocal {
+		return addrs
+	}
+	out := addrs[:0]
+	for _, a := range addrs {
+		if scope := ipv6Scope(a); scope == 0 || dht.ipv6Scopes&scope != 0 {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// ipv6Scope returns the non-global scope of the first IP address in a, or 0 if
+// it's global or not an IPv6 address.
+func ipv6Scope(a ma.Multiaddr) opts.IPv6Scope {
+	var scope opts.IPv6Scope
+	ma.ForEach(a, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP6ZONE:
+			return true
+		case ma.P_IP6:
+			ip := net.IP(c.RawValue())
+			switch {
+			case ip.IsLinkLocalUnicast():
+				scope = opts.IPv6LinkLocal
+			case len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc:
+				scope = opts.IPv6UniqueLocal
+			}
+		}
+		return false
+	})
+	return scope
+}
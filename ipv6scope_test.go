@@ -0,0 +1,46 @@
+package dht
+
+import (
+	"testing"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestWithAcceptedScopes(t *testing.T) {
+	addrs := func(strs ...string) []ma.Multiaddr {
+		out := make([]ma.Multiaddr, len(strs))
+		for i, s := range strs {
+			out[i] = ma.StringCast(s)
+		}
+		return out
+	}
+	all := []string{
+		"/ip4/10.0.0.1/tcp/4001",
+		"/ip6/2001:db8::1/tcp/4001",
+		"/ip6/fe80::1/tcp/4001",
+		"/ip6zone/eth0/ip6/fe80::2/tcp/4001",
+		"/ip6/fd00::1/tcp/4001",
+	}
+
+	for _, tc := range []struct {
+		scopes opts.IPv6Scope
+		want   []string
+	}{
+		{opts.IPv6LinkLocal | opts.IPv6UniqueLocal, all},
+		{opts.IPv6UniqueLocal, []string{all[0], all[1], all[4]}},
+		{opts.IPv6LinkLocal, all[:4]},
+		{0, all[:2]},
+	} {
+		dht := &IpfsDHT{ipv6Scopes: tc.scopes}
+		got := dht.withAcceptedScopes(addrs(all...))
+		if len(got) != len(tc.want) {
+			t.Fatalf("scopes %d: expected %v, got %v", tc.scopes, tc.want, got)
+		}
+		for i, a := range got {
+			if a.String() != tc.want[i] {
+				t.Fatalf("scopes %d: expected %v, got %v", tc.scopes, tc.want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package dht
+
+import (
+	"context"
+	"sync"
+)
+
+// keyLocks serializes operations per key, see the SerializePutsPerKey option.
+// Locks are only kept while held or waited for.
+type keyLocks struct {
+	lk    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sem  chan struct{} // holds a token while the key is locked
+	refs int           // holders and waiters, guarded by keyLocks.lk
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+// lock locks key and returns the function unlocking it. It gives up with
+// ctx.Err() if ctx is done before the key is unlocked.
+func (k *keyLocks) lock(ctx context.Context, key string) (func(), error) {
+	k.lk.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{sem: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.lk.Unlock()
+
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		k.release(key, l)
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-l.sem
+		k.release(key, l)
+	}, nil
+}
+
+// release drops a reference to the lock of key.
+func (k *keyLocks) release(key string, l *keyLock) {
+	k.lk.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.lk.Unlock()
+}
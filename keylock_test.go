@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func mustLock(t *testing.T, k *keyLocks, key string) func() {
+	t.Helper()
+	unlock, err := k.lock(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unlock
+}
+
+func TestKeyLocks(t *testing.T) {
+	k := newKeyLocks()
+	unlock := mustLock(t, k, "/v/hello")
+
+	// other keys aren't blocked.
+	mustLock(t, k, "/v/other")()
+
+	locked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		unlock, err := k.lock(context.Background(), "/v/hello")
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		close(locked)
+		unlock()
+		close(done)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected the key to stay locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected the key to be unlocked")
+	}
+
+	<-done
+	k.lk.Lock()
+	defer k.lk.Unlock()
+	if len(k.locks) != 0 {
+		t.Fatalf("expected unused locks to be dropped, got %d", len(k.locks))
+	}
+}
+
+func TestKeyLocksContext(t *testing.T) {
+	k := newKeyLocks()
+	unlock := mustLock(t, k, "/v/hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := k.lock(ctx, "/v/hello"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the waiter that gave up doesn't keep the key locked.
+	unlock()
+	mustLock(t, k, "/v/hello")()
+
+	k.lk.Lock()
+	defer k.lk.Unlock()
+	if len(k.locks) != 0 {
+		t.Fatalf("expected unused locks to be dropped, got %d", len(k.locks))
+	}
+}
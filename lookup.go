@@ -1,20 +1,31 @@
 package dht
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
 	logging "github.com/ipfs/go-log"
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	notif "github.com/libp2p/go-libp2p-routing/notifications"
 )
 
+// ErrSelfLookup is returned by peer lookups for our own peer ID when the
+// SelfInResults option is set to SelfError.
+var ErrSelfLookup = errors.New("lookup target is the local peer")
+
 func tryFormatLoggableKey(k string) (string, error) {
 	if len(k) == 0 {
 		return "", fmt.Errorf("loggableKey is empty")
@@ -53,11 +64,41 @@ func loggableKey(k string) logging.LoggableMap {
 	}
 }
 
+// findSelf answers FindPeer for our own peer ID according to the SelfInResults
+// option.
+func (dht *IpfsDHT) findSelf(ctx context.Context) (peer.AddrInfo, error) {
+	switch dht.selfInResults {
+	case opts.SelfInclude:
+		return peer.AddrInfo{ID: dht.self, Addrs: dht.host.Addrs()}, nil
+	case opts.SelfError:
+		return peer.AddrInfo{}, ErrSelfLookup
+	default:
+		return dht.findPeer(ctx, dht.self)
+	}
+}
+
 // Kademlia 'node lookup' operation. Returns a channel of the K closest peers
 // to the given key
 func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan peer.ID, error) {
+	if dht.selfInResults == opts.SelfError && key == string(dht.self) {
+		return nil, ErrSelfLookup
+	}
+	return dht.lookupClosestPeers(ctx, key, nil, nil, dht.selfInResults == opts.SelfInclude)
+}
+
+// getClosestPeers is GetClosestPeers for internal callers sending RPCs to the
+// peers found: it ignores the SelfInResults option, so we're never among them.
+// It fills in stats before closing the channel if it isn't nil. answered, if
+// not nil, is called concurrently with every peer answering the query.
+func (dht *IpfsDHT) getClosestPeers(ctx context.Context, key string, stats *QueryConcurrencyStats, answered func(peer.ID)) (<-chan peer.ID, error) {
+	return dht.lookupClosestPeers(ctx, key, stats, answered, false)
+}
+
+// lookupClosestPeers looks up the closest peers to key, adding ourselves to
+// the candidates if includeSelf is set.
+func (dht *IpfsDHT) lookupClosestPeers(ctx context.Context, key string, stats *QueryConcurrencyStats, answered func(peer.ID), includeSelf bool) (<-chan peer.ID, error) {
 	e := logger.EventBegin(ctx, "getClosestPeers", loggableKey(key))
-	tablepeers := dht.routingTable.NearestPeers(kb.ConvertKey(key), AlphaValue)
+	tablepeers := dht.seedPeers(kb.ConvertKey(key), AlphaValue)
 	if len(tablepeers) == 0 {
 		return nil, kb.ErrLookupFailure
 	}
@@ -80,6 +121,9 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan pee
 			return nil, err
 		}
 		peers := pb.PBPeersToPeerInfos(pmes.GetCloserPeers())
+		if answered != nil {
+			answered(p)
+		}
 
 		// For DHT query command
 		notif.PublishQueryEvent(parent, &notif.QueryEvent{
@@ -90,6 +134,8 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan pee
 
 		return &dhtQueryResult{closerPeers: peers}, nil
 	})
+	query.op = "GetClosestPeers"
+	query.concurrencyStats = stats
 
 	go func() {
 		defer close(out)
@@ -106,7 +152,11 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan pee
 			// refresh the k-bucket containing this key as the query was successful
 			dht.routingTable.BucketForID(kb.ConvertKey(key)).ResetRefreshedAt(time.Now())
 
-			sorted := kb.SortClosestPeers(res.queriedSet.Peers(), kb.ConvertKey(key))
+			peers := res.queriedSet.Peers()
+			if includeSelf {
+				peers = append(peers, dht.self)
+			}
+			sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
 			l := len(sorted)
 			if l > dht.bucketSize {
 				sorted = sorted[:dht.bucketSize]
@@ -120,3 +170,156 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan pee
 
 	return out, nil
 }
+
+// GetClosestPeersStream looks up the peers closest to key like GetClosestPeers,
+// but emits peers as the query progresses: every peer emitted answered the
+// query and is closer to the key than the ones emitted before it, so the last
+// one is the closest peer found. Callers can start using the closest peers so
+// far before the query completes. Only the closest peer is guaranteed to be
+// emitted, use GetClosestPeers for the whole set of closest peers.
+//
+// The channel is closed when the query completes or ctx is cancelled. It's
+// closed right away if the lookup can't start, e.g. with an empty routing
+// table.
+func (dht *IpfsDHT) GetClosestPeersStream(ctx context.Context, key string) <-chan peer.ID {
+	out := make(chan peer.ID, dht.bucketSize)
+
+	var (
+		lk      sync.Mutex
+		closest kb.ID   // closest peer that answered
+		pending peer.ID // the closest peer, if not emitted yet
+	)
+	wake := make(chan struct{}, 1)
+	target := kb.ConvertKey(key)
+	answered := func(p peer.ID) {
+		id := kb.ConvertPeerID(p)
+		lk.Lock()
+		if closest != nil && bytes.Compare(u.XOR(id, target), u.XOR(closest, target)) >= 0 {
+			lk.Unlock()
+			return
+		}
+		closest = id
+		pending = p
+		lk.Unlock()
+		// the query workers never wait for the caller, peers answering
+		// while it isn't reading are coalesced into the closest one.
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	res, err := dht.getClosestPeers(ctx, key, nil, answered)
+	if err != nil {
+		logger.Debugf("closest peers stream: %s", err)
+		close(out)
+		return out
+	}
+	go func() {
+		defer close(out)
+		for res != nil {
+			select {
+			case <-wake:
+			case _, ok := <-res:
+				if !ok {
+					res = nil
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			lk.Lock()
+			p := pending
+			pending = ""
+			lk.Unlock()
+			if p == "" {
+				continue
+			}
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// hashedKeyPrefixBits is how many leading bits of a pre-hashed key the key
+// looked up by GetClosestPeersRaw shares with it.
+const hashedKeyPrefixBits = 16
+
+// GetClosestPeersRaw is like GetClosestPeers, for a key given as bytes.
+//
+// If hashed is false, key is the routing key itself, as sent to other peers.
+// Like all DHT keys, it's hashed with SHA-256, by us and by the peers we query,
+// to get its location in the keyspace. GetClosestPeersRaw(ctx, []byte(k),
+// false) is the same as GetClosestPeers(ctx, k).
+//
+// If hashed is true, key is already a keyspace location: a 32 byte SHA-256
+// digest, which isn't hashed again. Peers only answer for routing keys, so we
+// look up a key whose hash shares the first 16 bits with the given one, then
+// sort the peers found by their distance to the given one. The query picks
+// peers by their distance to the key looked up, which only agrees with their
+// distance to the given location on the first 16 bits: a peer whose ID shares
+// more leading bits with the location, up to 16, is always picked over one
+// sharing fewer, but among peers sharing as many bits (or 16 and more), the
+// query may pick other peers than a lookup of the location would. Either way,
+// like any lookup, the result is the closest peers the query found, not
+// necessarily the closest in the network.
+//
+// The keys looked up are computed once, on the first call with hashed set,
+// which takes a fraction of a second.
+func (dht *IpfsDHT) GetClosestPeersRaw(ctx context.Context, key []byte, hashed bool) (<-chan peer.ID, error) {
+	if !hashed {
+		return dht.GetClosestPeers(ctx, string(key))
+	}
+	if len(key) != sha256.Size {
+		return nil, fmt.Errorf("hashed key must be %d bytes, got %d", sha256.Size, len(key))
+	}
+
+	target := kb.ID(key)
+	peers, err := dht.closestPeerList(ctx, keyWithHashPrefix(target))
+	if err != nil {
+		return nil, err
+	}
+	sorted := kb.SortClosestPeers(peers, target)
+	out := make(chan peer.ID, len(sorted))
+	for _, p := range sorted {
+		out <- p
+	}
+	close(out)
+	return out, nil
+}
+
+var (
+	hashPrefixKeysOnce sync.Once
+	// hashPrefixKeys[prefix] is one more than the number of the first key
+	// whose SHA-256 digest starts with prefix, see hashPrefixKey.
+	hashPrefixKeys []uint32
+)
+
+// keyWithHashPrefix returns a key whose SHA-256 digest has the same first
+// hashedKeyPrefixBits bits as target.
+func keyWithHashPrefix(target kb.ID) string {
+	hashPrefixKeysOnce.Do(func() {
+		hashPrefixKeys = make([]uint32, 1<<hashedKeyPrefixBits)
+		for i, left := uint32(0), len(hashPrefixKeys); left > 0; i++ {
+			h := sha256.Sum256([]byte(hashPrefixKey(i)))
+			prefix := binary.BigEndian.Uint16(h[:]) >> (16 - hashedKeyPrefixBits)
+			if hashPrefixKeys[prefix] == 0 {
+				hashPrefixKeys[prefix] = i + 1
+				left--
+			}
+		}
+	})
+	prefix := binary.BigEndian.Uint16(target) >> (16 - hashedKeyPrefixBits)
+	return hashPrefixKey(hashPrefixKeys[prefix] - 1)
+}
+
+// hashPrefixKey returns the key numbered i.
+func hashPrefixKey(i uint32) string {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(i))
+	return string(key)
+}
@@ -1,9 +1,22 @@
 package dht
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
 	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
 
 	cid "github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 )
 
 func TestLoggableKey(t *testing.T) {
@@ -34,3 +47,265 @@ func TestLoggableKey(t *testing.T) {
 		}
 	}
 }
+
+func TestSelfInResults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+
+	self := dhts[0]
+	closest := func(key string) []peer.ID {
+		t.Helper()
+		ch, err := self.GetClosestPeers(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []peer.ID
+		for p := range ch {
+			out = append(out, p)
+		}
+		return out
+	}
+
+	for _, p := range closest(string(self.self)) {
+		if p == self.self {
+			t.Fatal("expected self to be excluded by default")
+		}
+	}
+	if _, err := self.FindPeer(ctx, self.self); err != routing.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	self.selfInResults = opts.SelfInclude
+	if peers := closest(string(self.self)); len(peers) != 3 || peers[0] != self.self {
+		t.Fatalf("expected self to be the closest peer, got %v", peers)
+	}
+	// internal lookups, e.g. for PutValue, never send RPCs to us.
+	ch, err := self.getClosestPeers(ctx, string(self.self), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := range ch {
+		if p == self.self {
+			t.Fatal("expected self to be excluded from internal lookups")
+		}
+	}
+	if pi, err := self.FindPeer(ctx, self.self); err != nil || pi.ID != self.self || len(pi.Addrs) == 0 {
+		t.Fatalf("expected our own addresses, got %v (%v)", pi, err)
+	}
+
+	self.selfInResults = opts.SelfError
+	if _, err := self.GetClosestPeers(ctx, string(self.self)); err != ErrSelfLookup {
+		t.Fatalf("expected ErrSelfLookup, got %v", err)
+	}
+	if _, err := self.FindPeer(ctx, self.self); err != ErrSelfLookup {
+		t.Fatalf("expected ErrSelfLookup, got %v", err)
+	}
+	for _, p := range closest(string(dhts[2].self)) {
+		if p == self.self {
+			t.Fatal("expected self to be excluded from other lookups")
+		}
+	}
+}
+
+func TestGetClosestPeersRaw(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 6)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	var others []peer.ID
+	for i, d := range dhts {
+		for _, o := range dhts[i+1:] {
+			connect(t, ctx, d, o)
+		}
+		if i > 0 {
+			others = append(others, d.self)
+		}
+	}
+
+	collect := func(key []byte, hashed bool) []peer.ID {
+		t.Helper()
+		ch, err := dhts[0].GetClosestPeersRaw(ctx, key, hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var peers []peer.ID
+		for p := range ch {
+			peers = append(peers, p)
+		}
+		return peers
+	}
+	expectOrder := func(peers []peer.ID, target kb.ID) {
+		t.Helper()
+		expected := kb.SortClosestPeers(others, target)
+		if len(peers) != len(expected) {
+			t.Fatalf("expected %d peers, got %d", len(expected), len(peers))
+		}
+		for i := range peers {
+			if peers[i] != expected[i] {
+				t.Fatalf("expected peers sorted by distance to %x, got %v", target, peers)
+			}
+		}
+	}
+
+	// raw keys are hashed once.
+	target := sha256.Sum256([]byte("hello"))
+	expectOrder(collect([]byte("hello"), false), target[:])
+
+	// hashed keys aren't hashed again.
+	expectOrder(collect(target[:], true), target[:])
+	twice := sha256.Sum256(target[:])
+	expectOrder(collect(target[:], false), twice[:])
+
+	if _, err := dhts[0].GetClosestPeersRaw(ctx, []byte("hello"), true); err == nil {
+		t.Fatal("expected a hashed key of the wrong size to be rejected")
+	}
+
+	for _, target := range [][]byte{target[:], twice[:], make([]byte, sha256.Size), bytes.Repeat([]byte{0xff}, sha256.Size)} {
+		key := keyWithHashPrefix(target)
+		if kb.CommonPrefixLen(kb.ConvertKey(key), target) < hashedKeyPrefixBits {
+			t.Fatalf("expected the hash of %x to share %d bits with %x", key, hashedKeyPrefixBits, target)
+		}
+	}
+}
+
+func TestKeyWithHashPrefixOrder(t *testing.T) {
+	target := sha256.Sum256([]byte("hello"))
+	lookup := kb.ConvertKey(keyWithHashPrefix(target[:]))
+	closer := func(a, b, key kb.ID) bool {
+		return bytes.Compare(u.XOR(a, key), u.XOR(b, key)) < 0
+	}
+	prefixLen := func(id kb.ID) int {
+		if n := kb.CommonPrefixLen(id, target[:]); n < hashedKeyPrefixBits {
+			return n
+		}
+		return hashedKeyPrefixBits
+	}
+
+	var ids []kb.ID
+	for i := 0; i < 1000; i++ {
+		id := sha256.Sum256([]byte(fmt.Sprint(i)))
+		ids = append(ids, id[:])
+	}
+	for i := 0; i < 32; i++ {
+		id := append(kb.ID(nil), target[:]...)
+		id[i/8] ^= 0x80 >> uint(i%8)
+		ids = append(ids, id)
+	}
+
+	// up to 16 bits, sharing more bits with the target means being closer to
+	// the key looked up.
+	for _, a := range ids {
+		for _, b := range ids {
+			if prefixLen(a) > prefixLen(b) && !closer(a, b, lookup) {
+				t.Fatalf("expected %x to be closer than %x to the key looked up", a, b)
+			}
+		}
+	}
+
+	// past 16 bits, the order isn't kept.
+	if !closer(target[:], lookup, target[:]) || !closer(lookup, target[:], lookup) {
+		t.Fatal("expected the target and the key looked up to each be closest to themselves")
+	}
+}
+
+func TestGetClosestPeersStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 6)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	var others []peer.ID
+	for i, d := range dhts {
+		if i > 0 {
+			connect(t, ctx, dhts[i-1], d)
+			others = append(others, d.self)
+		}
+	}
+
+	key := "hello"
+	target := kb.ConvertKey(key)
+	var streamed []peer.ID
+	for p := range dhts[0].GetClosestPeersStream(ctx, key) {
+		streamed = append(streamed, p)
+	}
+	if len(streamed) == 0 {
+		t.Fatal("expected peers to be streamed")
+	}
+	for i := 1; i < len(streamed); i++ {
+		if !kb.Closer(streamed[i], streamed[i-1], key) {
+			t.Fatalf("expected every peer to be closer than the previous one, got %v", streamed)
+		}
+	}
+	if closest := kb.SortClosestPeers(others, target)[0]; streamed[len(streamed)-1] != closest {
+		t.Fatalf("expected the last peer to be the closest one %s, got %v", closest, streamed)
+	}
+
+	// the query doesn't wait for the caller to read the channel.
+	slow, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.BucketSize(1),
+		opts.NamespacedValidator("v", blankValidator{}),
+		opts.DisableAutoRefresh(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	defer slow.host.Close()
+	// through the peer farthest from the key, every peer it returns is
+	// closer and gets emitted.
+	all := append([]peer.ID{dhts[0].self}, others...)
+	farthest := kb.SortClosestPeers(all, target)[len(all)-1]
+	for _, d := range dhts {
+		if d.self == farthest {
+			connect(t, ctx, slow, d)
+		}
+	}
+	stream := slow.GetClosestPeersStream(ctx, key)
+	for i := 0; len(slow.ActiveQueries()) > 0; i++ {
+		if i == 500 {
+			t.Fatal("expected the query to complete while nobody reads the stream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	streamed = nil
+	for p := range stream {
+		streamed = append(streamed, p)
+	}
+	if len(streamed) == 0 {
+		t.Fatal("expected the closest peer to be streamed")
+	}
+	for i := 1; i < len(streamed); i++ {
+		if !kb.Closer(streamed[i], streamed[i-1], key) {
+			t.Fatalf("expected every peer to be closer than the previous one, got %v", streamed)
+		}
+	}
+
+	// lookups that can't start close the channel right away.
+	lonely := setupDHT(ctx, t, false)
+	defer lonely.Close()
+	defer lonely.host.Close()
+	for p := range lonely.GetClosestPeersStream(ctx, key) {
+		t.Fatalf("unexpected peer %s", p)
+	}
+}
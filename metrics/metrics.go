@@ -19,6 +19,20 @@ var (
 	// KeyInstanceID identifies a dht instance by the pointer address.
 	// Useful for differentiating between different dhts that have the same peer id.
 	KeyInstanceID, _ = tag.NewKey("instance_id")
+	// KeyNamespace identifies the record namespace (e.g. "ipns", "pk") an RPC
+	// relates to. Only known namespaces are used as values to keep the
+	// cardinality of this tag bounded.
+	KeyNamespace, _ = tag.NewKey("namespace")
+	// KeyProtocol identifies the DHT protocol negotiated on the stream an RPC
+	// was sent or received on.
+	KeyProtocol, _ = tag.NewKey("protocol")
+)
+
+// Values of KeyNamespace that don't correspond to a record namespace.
+const (
+	NamespaceProviders = "providers"
+	NamespacePeers     = "peers"
+	NamespaceOther     = "other"
 )
 
 // UpsertMessageType is a convenience upserts the message type
@@ -27,6 +41,18 @@ func UpsertMessageType(m *pb.Message) tag.Mutator {
 	return tag.Upsert(KeyMessageType, m.Type.String())
 }
 
+// UpsertNamespace is a convenience that upserts the given namespace into the
+// KeyNamespace.
+func UpsertNamespace(ns string) tag.Mutator {
+	return tag.Upsert(KeyNamespace, ns)
+}
+
+// UpsertProtocol is a convenience that upserts the given protocol into the
+// KeyProtocol.
+func UpsertProtocol(p string) tag.Mutator {
+	return tag.Upsert(KeyProtocol, p)
+}
+
 // Measures
 var (
 	ReceivedMessages       = stats.Int64("libp2p.io/dht/kad/received_messages", "Total number of messages received per RPC", stats.UnitDimensionless)
@@ -39,57 +65,82 @@ var (
 	SentRequests           = stats.Int64("libp2p.io/dht/kad/sent_requests", "Total number of requests sent per RPC", stats.UnitDimensionless)
 	SentRequestErrors      = stats.Int64("libp2p.io/dht/kad/sent_request_errors", "Total number of errors for requests sent per RPC", stats.UnitDimensionless)
 	SentBytes              = stats.Int64("libp2p.io/dht/kad/sent_bytes", "Total sent bytes per RPC", stats.UnitBytes)
+
+	RejectedProviderRecords    = stats.Int64("libp2p.io/dht/kad/rejected_provider_records", "Total number of provider records rejected because the providing peer stores too many records", stats.UnitDimensionless)
+	NewProviderRecords         = stats.Int64("libp2p.io/dht/kad/new_provider_records", "Total number of new provider records received", stats.UnitDimensionless)
+	RefreshedProviderRecords   = stats.Int64("libp2p.io/dht/kad/refreshed_provider_records", "Total number of provider records refreshed by their provider", stats.UnitDimensionless)
+	ThrottledProviderRefreshes = stats.Int64("libp2p.io/dht/kad/throttled_provider_refreshes", "Total number of provider record refreshes ignored because they came too soon", stats.UnitDimensionless)
 )
 
 var DefaultViews = []*view.View{
 	&view.View{
 		Measure:     ReceivedMessages,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: view.Count(),
 	},
 	&view.View{
 		Measure:     ReceivedMessageErrors,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: view.Count(),
 	},
 	&view.View{
 		Measure:     ReceivedBytes,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultBytesDistribution,
 	},
 	&view.View{
 		Measure:     InboundRequestLatency,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultMillisecondsDistribution,
 	},
 	&view.View{
 		Measure:     OutboundRequestLatency,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultMillisecondsDistribution,
 	},
 	&view.View{
 		Measure:     SentMessages,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: view.Count(),
 	},
 	&view.View{
 		Measure:     SentMessageErrors,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: view.Count(),
 	},
 	&view.View{
 		Measure:     SentRequests,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: view.Count(),
 	},
 	&view.View{
 		Measure:     SentRequestErrors,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: view.Count(),
 	},
 	&view.View{
 		Measure:     SentBytes,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyNamespace, KeyProtocol, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultBytesDistribution,
 	},
+	&view.View{
+		Measure:     RejectedProviderRecords,
+		TagKeys:     []tag.Key{KeyInstanceID},
+		Aggregation: view.Count(),
+	},
+	&view.View{
+		Measure:     NewProviderRecords,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	},
+	&view.View{
+		Measure:     RefreshedProviderRecords,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	},
+	&view.View{
+		Measure:     ThrottledProviderRefreshes,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	},
 }
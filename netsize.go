@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	u "github.com/ipfs/go-ipfs-util"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// ErrNotEnoughPeers is returned by EstimateNetworkSize when the routing table
+// doesn't contain enough peers to produce a meaningful estimate.
+var ErrNotEnoughPeers = errors.New("not enough peers in the routing table to estimate the network size")
+
+// minNetworkSizePeers is the minimum number of peers we need to know about
+// before attempting to estimate the network size.
+const minNetworkSizePeers = 3
+
+// EstimateNetworkSize estimates the number of peers in the network from the
+// XOR distances between our own ID and the K closest peers in our routing
+// table.
+//
+// In a network of N peers with uniformly distributed IDs, the i-th closest peer
+// is expected to be at a (normalized) distance of i/(N+1) from any point in the
+// keyspace. The estimate is the least-squares fit of N to the observed
+// distances.
+//
+// The estimate is only as good as our knowledge of our own neighbourhood: it
+// assumes we know the actual K closest peers to ourselves, which requires a
+// reasonably full and recently refreshed routing table. With a sparse routing
+// table it will overestimate the network size. Even in the best case, expect
+// the estimate to be off by a significant fraction for small values of K.
+func (dht *IpfsDHT) EstimateNetworkSize() (int, error) {
+	self := kb.ConvertPeerID(dht.self)
+	peers := dht.routingTable.NearestPeers(self, dht.bucketSize)
+	if len(peers) < minNetworkSizePeers {
+		return 0, ErrNotEnoughPeers
+	}
+
+	// NearestPeers returns peers sorted by distance to the target.
+	var sumSq, sumXY float64
+	for i, p := range peers {
+		x := float64(i + 1)
+		sumSq += x * x
+		sumXY += x * normalizedDistance(self, kb.ConvertPeerID(p))
+	}
+	if sumXY == 0 {
+		return 0, ErrNotEnoughPeers
+	}
+
+	return int(math.Round(sumSq/sumXY - 1)), nil
+}
+
+// normalizedDistance returns the XOR distance between the two keys scaled to
+// the [0, 1) interval. Only the most significant 64 bits are used, which is
+// plenty of precision for our purposes.
+func normalizedDistance(a, b []byte) float64 {
+	d := u.XOR(a, b)
+	return float64(binary.BigEndian.Uint64(d[:8])) / math.Exp2(64)
+}
@@ -0,0 +1,40 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/test"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+func newTestRoutingTableDHT(t *testing.T, npeers int) *IpfsDHT {
+	self := test.RandPeerIDFatal(t)
+	dht := &IpfsDHT{
+		self:         self,
+		bucketSize:   KValue,
+		routingTable: kb.NewRoutingTable(KValue, kb.ConvertPeerID(self), time.Hour, pstore.NewMetrics()),
+	}
+	for i := 0; i < npeers; i++ {
+		dht.routingTable.Update(test.RandPeerIDFatal(t))
+	}
+	return dht
+}
+
+func TestEstimateNetworkSize(t *testing.T) {
+	if _, err := newTestRoutingTableDHT(t, 1).EstimateNetworkSize(); err != ErrNotEnoughPeers {
+		t.Fatalf("expected ErrNotEnoughPeers, got %v", err)
+	}
+
+	const npeers = 2000
+	est, err := newTestRoutingTableDHT(t, npeers).EstimateNetworkSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The estimate is noisy, only check that it's in the right ballpark.
+	if est < npeers/4 || est > npeers*4 {
+		t.Fatalf("expected an estimate around %d, got %d", npeers, est)
+	}
+}
@@ -35,10 +35,7 @@ func (nn *netNotifiee) Connected(n network.Network, v network.Conn) {
 			refresh := dht.routingTable.Size() <= minRTRefreshThreshold
 			dht.Update(dht.Context(), p)
 			if refresh && dht.autoRefresh {
-				select {
-				case dht.triggerRtRefresh <- struct{}{}:
-				default:
-				}
+				dht.RefreshRoutingTable()
 			}
 		}
 		return
@@ -81,10 +78,7 @@ func (nn *netNotifiee) testConnection(v network.Conn) {
 		refresh := dht.routingTable.Size() <= minRTRefreshThreshold
 		dht.Update(dht.Context(), p)
 		if refresh && dht.autoRefresh {
-			select {
-			case dht.triggerRtRefresh <- struct{}{}:
-			default:
-			}
+			dht.RefreshRoutingTable()
 		}
 	}
 }
@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+// UnknownNamespaceError is returned by GetValue and SearchValue for keys in a
+// namespace no validator is registered for, see the UnknownNamespaceGetPolicy
+// option.
+type UnknownNamespaceError struct {
+	Namespace string
+}
+
+func (e *UnknownNamespaceError) Error() string {
+	return fmt.Sprintf("no validator for namespace %q: any peer could forge the values found for it, refusing to look it up", e.Namespace)
+}
+
+// unregisteredNamespace returns the namespace of key if the validator is a
+// NamespacedValidator without a validator for it. We can't tell for custom
+// validators.
+func (dht *IpfsDHT) unregisteredNamespace(key string) (string, bool) {
+	nsval, ok := dht.Validator.(record.NamespacedValidator)
+	if !ok {
+		return "", false
+	}
+	ns, _, err := record.SplitKey(key)
+	if err != nil || nsval[ns] != nil {
+		return "", false
+	}
+	return ns, true
+}
+
+// unknownNamespace returns the namespace of key if no validator handles it,
+// not even a fallback set by the UnknownNamespacePolicy option.
+func (dht *IpfsDHT) unknownNamespace(key string) (string, bool) {
+	if dht.unknownNamespaceFallback != nil {
+		return "", false
+	}
+	return dht.unregisteredNamespace(key)
+}
+
+// unvalidatedGet returns true if the values received for key are returned
+// without validation, see the UnknownNamespaceGetPolicy option.
+func (dht *IpfsDHT) unvalidatedGet(key string) bool {
+	if dht.unknownNamespaceGet != opts.UnknownNamespaceGetFirst {
+		return false
+	}
+	_, ok := dht.unknownNamespace(key)
+	return ok
+}
+
+// validatorFor returns the validator for the records of key: dht.Validator,
+// or the UnknownNamespacePolicy fallback for namespaces it has no validator
+// for.
+func (dht *IpfsDHT) validatorFor(key string) record.Validator {
+	if dht.unknownNamespaceFallback != nil {
+		if _, ok := dht.unregisteredNamespace(key); ok {
+			return dht.unknownNamespaceFallback
+		}
+	}
+	return dht.Validator
+}
+
+// unknownNamespaceFallback returns the validator the given
+// UnknownNamespacePolicy hands the records of unknown namespaces in v to, nil
+// if they're rejected.
+func unknownNamespaceFallback(v record.Validator, action opts.UnknownNamespaceAction, fallback record.Validator) (record.Validator, error) {
+	if action == opts.UnknownNamespaceReject {
+		return nil, nil
+	}
+	if _, ok := v.(record.NamespacedValidator); !ok {
+		return nil, errors.New("UnknownNamespacePolicy needs a NamespacedValidator")
+	}
+	if action == opts.UnknownNamespaceAccept {
+		fallback = acceptAllValidator{}
+	}
+	return fallback, nil
+}
+
+// acceptAllValidator accepts any record and selects the first one.
+type acceptAllValidator struct{}
+
+func (acceptAllValidator) Validate(string, []byte) error { return nil }
+
+func (acceptAllValidator) Select(string, [][]byte) (int, error) { return 0, nil }
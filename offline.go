@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	swarm "github.com/libp2p/go-libp2p-swarm"
+)
+
+// ErrOffline is returned by queries with the FailFastWhenOffline option set
+// when we appear to have no network connectivity.
+var ErrOffline = errors.New("dht is offline")
+
+// offlineDialFailures is the number of consecutive dials failing without delay
+// after which we consider ourselves offline, as long as we have no open
+// connections.
+var offlineDialFailures = 3
+
+// offlineDialFailureDuration is how quickly a dial has to fail to count as a
+// sign of being offline. Dials to unreachable peers usually take longer, while
+// dials without network connectivity fail right away.
+var offlineDialFailureDuration = time.Second
+
+// offlineRetryInterval is how long after the last failed dial queries fail
+// without trying to dial anyone, before they try again.
+var offlineRetryInterval = 10 * time.Second
+
+// offlineDetector guesses whether we're offline from the outcome of the dials
+// made by queries.
+type offlineDetector struct {
+	mu       sync.Mutex
+	failures int       // consecutive dials that failed right away
+	last     time.Time // when the last of them failed
+}
+
+// dialed records the outcome of a dial that took d. Dials failing before
+// reaching the network, e.g. to peers in dial backoff or without addresses,
+// don't tell anything about our connectivity and are ignored.
+func (o *offlineDetector) dialed(err error, d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch {
+	case err == nil:
+		o.failures = 0
+	case !reachedNetwork(err):
+	case d < offlineDialFailureDuration:
+		o.failures++
+		o.last = time.Now()
+	}
+}
+
+// reachedNetwork returns false for the dial errors the swarm returns without
+// trying to connect to the peer.
+func reachedNetwork(err error) bool {
+	if de, ok := err.(*swarm.DialError); ok && de.Cause != nil {
+		err = de.Cause
+	}
+	switch err {
+	case swarm.ErrDialBackoff, swarm.ErrNoAddresses, swarm.ErrNoGoodAddresses:
+		return false
+	}
+	return true
+}
+
+// reached records that a peer answered us.
+func (o *offlineDetector) reached() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failures = 0
+}
+
+// isOffline tells whether we appear to be offline: the last dials failed right
+// away, recently, and we have no open connections.
+func (dht *IpfsDHT) isOffline() bool {
+	if dht.offline == nil {
+		return false
+	}
+	dht.offline.mu.Lock()
+	failing := dht.offline.failures >= offlineDialFailures && time.Since(dht.offline.last) < offlineRetryInterval
+	dht.offline.mu.Unlock()
+	return failing && len(dht.host.Network().Conns()) == 0
+}
+
+// observeDial records the outcome of a query dial that took d, aborting the
+// query if we appear to be offline.
+func (r *dhtQueryRunner) observeDial(ctx context.Context, err error, d time.Duration) {
+	dht := r.query.dht
+	if dht.offline == nil || ctx.Err() != nil {
+		return
+	}
+	dht.offline.dialed(err, d)
+	if err == nil || !dht.isOffline() {
+		return
+	}
+	logger.Debugf("we appear to be offline, aborting the query")
+	r.Lock()
+	r.offline = true
+	r.Unlock()
+	go r.proc.Close() // we're one of the query's workers, and Close blocks.
+}
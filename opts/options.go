@@ -1,13 +1,19 @@
 package dhtopts
 
 import (
+	"context"
 	"fmt"
 	"time"
 
+	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p-record"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // Deprecated: The old format did not support more than one message per stream, and is not supported
@@ -19,6 +25,125 @@ var (
 	DefaultProtocols             = []protocol.ID{ProtocolDHT}
 )
 
+// DatastoreErrorPolicy determines how the DHT reacts when its datastore
+// returns an error.
+type DatastoreErrorPolicy int
+
+const (
+	// DatastoreErrorDefault keeps the DHT's historical behavior: value
+	// operations fail, while provider record operations log the error and
+	// carry on with whatever records are available.
+	DatastoreErrorDefault DatastoreErrorPolicy = iota
+	// DatastoreErrorFail fails the operation, returning the datastore error to
+	// the caller (or the remote peer).
+	DatastoreErrorFail
+	// DatastoreErrorDegrade logs the error and carries on with whatever data
+	// is available (e.g. from the cache or the network).
+	DatastoreErrorDegrade
+)
+
+// SelfMode determines how peer lookups treat the local node.
+type SelfMode int
+
+const (
+	// SelfExclude never returns the local node: GetClosestPeers leaves it out
+	// even if we're among the closest peers to the key, and FindPeer for our
+	// own ID runs a lookup that can only fail with routing.ErrNotFound. That
+	// lookup still finds our neighbours along the way.
+	SelfExclude SelfMode = iota
+	// SelfInclude returns the local node like any other peer: GetClosestPeers
+	// includes it if we're among the closest peers to the key, and FindPeer
+	// for our own ID returns our own addresses. The lookups made internally,
+	// e.g. by PutValue and Provide, still leave it out.
+	SelfInclude
+	// SelfError fails GetClosestPeers and FindPeer for our own ID with
+	// dht.ErrSelfLookup. Lookups for other keys behave as with SelfExclude.
+	SelfError
+)
+
+// UnknownNamespaceAction says how records in a namespace without a registered
+// validator are handled, see UnknownNamespacePolicy.
+type UnknownNamespaceAction int
+
+const (
+	// UnknownNamespaceReject fails their validation with
+	// record.ErrInvalidRecordType.
+	UnknownNamespaceReject UnknownNamespaceAction = iota
+	// UnknownNamespaceAccept accepts any value for them without validation.
+	UnknownNamespaceAccept
+	// UnknownNamespaceDelegate validates them with a catch-all validator.
+	UnknownNamespaceDelegate
+)
+
+// UnknownNamespaceGetAction says how value lookups for keys in a namespace
+// without a validator are handled, see UnknownNamespaceGetPolicy.
+type UnknownNamespaceGetAction int
+
+const (
+	// UnknownNamespaceGetReject fails them without querying the network.
+	UnknownNamespaceGetReject UnknownNamespaceGetAction = iota
+	// UnknownNamespaceGetFirst returns the first value received, without
+	// validation or selection.
+	UnknownNamespaceGetFirst
+)
+
+// IPv6Scope is a set of non-global IPv6 address scopes, see IPv6ScopePolicy.
+type IPv6Scope int
+
+const (
+	// IPv6LinkLocal is the link-local scope, fe80::/10.
+	IPv6LinkLocal IPv6Scope = 1 << iota
+	// IPv6UniqueLocal is the unique local scope, fc00::/7.
+	IPv6UniqueLocal
+)
+
+// PeerSource is a source of peers used to seed the initial frontier of DHT
+// queries. A *kbucket.RoutingTable is a PeerSource.
+type PeerSource interface {
+	// NearestPeers returns up to count peers closest to the given ID.
+	NearestPeers(id kb.ID, count int) []peer.ID
+}
+
+// ContentSource enumerates the content a node provides, so the DHT can
+// reprovide it. See WithReprovideSource.
+type ContentSource interface {
+	// Keys returns the keys to reprovide. It's called at the beginning of
+	// every reprovide cycle and the returned channel must be closed once all
+	// keys have been sent or when the context is cancelled.
+	Keys(ctx context.Context) (<-chan cid.Cid, error)
+}
+
+// RefreshResult is the outcome of a routing table refresh, see
+// OnRefreshComplete.
+type RefreshResult struct {
+	// SelfWalkErr is the error of the lookup for our own peer ID, if any.
+	SelfWalkErr error
+
+	// Buckets are the buckets walked, farthest first. Buckets skipped because
+	// they're full or were recently refreshed aren't listed.
+	Buckets   []BucketRefresh
+	Succeeded int
+	Failed    int
+
+	// Aggressive is set if the refresh was escalated, see EscalatingRefresh.
+	Aggressive bool
+
+	// Isolated is set if the routing table was still empty once the walks
+	// were done: none of them reached another peer. See OnIsolation.
+	Isolated bool
+	// ReBootstrapErr is the error reconnecting to the bootstrap peers when
+	// Isolated is set, if the ReBootstrapOnIsolation option is set.
+	ReBootstrapErr error
+
+	Duration time.Duration
+}
+
+// BucketRefresh is the outcome of the random walk refreshing a bucket.
+type BucketRefresh struct {
+	Bucket int
+	Err    error
+}
+
 // Options is a structure containing all the options that can be used when constructing a DHT.
 type Options struct {
 	Datastore  ds.Batching
@@ -27,10 +152,142 @@ type Options struct {
 	Protocols  []protocol.ID
 	BucketSize int
 
+	UnknownNamespace struct {
+		Action   UnknownNamespaceAction
+		Fallback record.Validator
+	}
+	UnknownNamespaceGet UnknownNamespaceGetAction
+
+	DatastoreErrorPolicy DatastoreErrorPolicy
+
+	SelfInResults SelfMode
+
+	ProvideExtraFanout int
+
+	MaxMessageSize            int
+	PenalizeOversizedMessages bool
+	MaxMessagesPerStream      int
+
+	MaxRecordSizes map[string]int
+
+	MaxCloserPeersPerResponse int
+
+	MaxProviderRecordsPerPeer int
+
+	MinProviderRefreshInterval time.Duration
+
+	ProviderRecordLimits struct {
+		Soft, Hard                    int
+		RecencyWeight, DistanceWeight float64
+	}
+
+	ServeProvidersFreshnessThreshold time.Duration
+
+	MergeProviderAddrs bool
+
+	QuerySeedSources []PeerSource
+	PeerstoreSeeds   int
+
+	NewPeerGracePeriod time.Duration
+
+	EvictionCooldown time.Duration
+
+	OnInvalidRecord func(from peer.ID, key string, err error)
+
+	OnAddrAttributionAnomaly func(from, claimed peer.ID, addr ma.Multiaddr)
+
+	OnCloserPeersSelected func(to peer.ID, target []byte, selected []peer.ID, distances []kb.ID)
+
+	OnProviderRecordServed func(to peer.ID, key cid.Cid, numProviders int)
+
+	OnRecordConflict func(key string, records [][]byte, selected int)
+
+	OnStalePutRejected          func(from peer.ID, key string, stale, held []byte)
+	ReturnNewerRecordOnStalePut bool
+
+	OnBucketSplit func(newBucketCount int)
+
+	OnRoutingTableHealthChange func(healthy bool, size int)
+
+	DatastoreLatencyHook func(op string, d time.Duration)
+
+	OnRefreshComplete func(RefreshResult)
+
+	OnIsolation            func(RefreshResult)
+	ReBootstrapOnIsolation struct {
+		Enabled bool
+		Peers   []peer.AddrInfo
+	}
+
+	OnRefreshTarget func(bucketID int, target peer.ID)
+
+	BootstrapDialConcurrency int
+	IdentifyWaitTimeout      time.Duration
+	BootstrapBackoff         struct {
+		Base time.Duration
+		Max  time.Duration
+	}
+
+	SeedFromExistingConnections bool
+
+	HealthyAfterQueries int
+
+	QueryConcurrency struct {
+		Initial int
+		Max     int
+	}
+
+	QueryTraceHistory int
+
+	PenalizeSelfOnlyResponses bool
+
+	SkipRelayOnlyPeers bool
+	IPv6Scopes         IPv6Scope
+	OnQueryDial        func(ctx context.Context, p peer.AddrInfo) bool
+
+	FailFastWhenOffline bool
+
+	OutboundQueryTransform func(key string) string
+
+	Replica bool
+
+	KeyDenylist func(key []byte) bool
+
+	SerializePuts bool
+
+	RecentResults struct {
+		TTL  time.Duration
+		Size int
+	}
+
+	ValueCache struct {
+		TTL  time.Duration
+		Size int
+	}
+
+	Reprovide struct {
+		Source   ContentSource
+		Interval time.Duration
+
+		RegionBits        int
+		RegionConcurrency int
+	}
+
 	RoutingTable struct {
 		RefreshQueryTimeout time.Duration
 		RefreshPeriod       time.Duration
 		AutoRefresh         bool
+
+		SparseBucketThreshold float64
+		MinBucketFullness     float64
+		MaxRefreshBuckets     int
+
+		EscalateAfter    int
+		EscalationWindow time.Duration
+
+		MaxPeerAge time.Duration
+
+		PrioritizeClosestBucket bool
 	}
 }
 
@@ -55,10 +312,18 @@ var Defaults = func(o *Options) error {
 	}
 	o.Datastore = dssync.MutexWrap(ds.NewMapDatastore())
 	o.Protocols = DefaultProtocols
+	o.DatastoreErrorPolicy = DatastoreErrorDefault
+	o.MaxMessageSize = network.MessageSizeMax
+	o.ProviderRecordLimits.RecencyWeight = 1
+	o.ProviderRecordLimits.DistanceWeight = 1
+	o.BootstrapDialConcurrency = 8
+	o.IPv6Scopes = IPv6UniqueLocal
 
 	o.RoutingTable.RefreshQueryTimeout = 10 * time.Second
 	o.RoutingTable.RefreshPeriod = 1 * time.Hour
 	o.RoutingTable.AutoRefresh = true
+	o.RoutingTable.SparseBucketThreshold = 1
+	o.RoutingTable.MaxRefreshBuckets = refreshBucketsLimit
 
 	return nil
 }
@@ -85,6 +350,115 @@ func RoutingTableRefreshPeriod(period time.Duration) Option {
 	}
 }
 
+// RefreshSparseBucketsOnly configures periodic routing table refreshes to skip
+// buckets that are fuller than the given threshold, expressed as the fraction
+// of the bucket size (from 0 to 1). Stale buckets are only refreshed if they
+// are also sparse; a threshold of 0 only refreshes empty buckets.
+//
+// Defaults to 1 (refresh all stale buckets).
+func RefreshSparseBucketsOnly(threshold float64) Option {
+	return func(o *Options) error {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("sparse bucket threshold must be between 0 and 1, got %f", threshold)
+		}
+		o.RoutingTable.SparseBucketThreshold = threshold
+		return nil
+	}
+}
+
+// MinBucketFullness configures periodic routing table refreshes to refresh
+// buckets holding fewer peers than the given fraction of the bucket size (from
+// 0 to 1) every time, even if they were refreshed within the refresh period.
+// Such buckets are refreshed until they fill up past the ratio, as sparse
+// buckets leave parts of the keyspace poorly covered. Buckets at or above
+// the ratio are still only refreshed when stale, see RoutingTableRefreshPeriod
+// and RefreshSparseBucketsOnly.
+//
+// Defaults to 0 (only refresh stale buckets).
+func MinBucketFullness(ratio float64) Option {
+	return func(o *Options) error {
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("min bucket fullness must be between 0 and 1, got %f", ratio)
+		}
+		o.RoutingTable.MinBucketFullness = ratio
+		return nil
+	}
+}
+
+// EscalatingRefresh makes the next routing table refresh aggressive once a
+// refresh was triggered n times within the window, e.g. because the routing
+// table keeps dropping below the minimum size. An aggressive refresh walks all
+// buckets, however full and recently refreshed, and walks them in parallel
+// instead of one after the other.
+//
+// Triggers are counted whether or not they start a refresh right away. There's
+// no MinRefreshInterval for routing table refreshes to throttle them
+// (MinProviderRefreshInterval only applies to provider records), so a trigger
+// starts a refresh unless one is already running, in which case the refresh
+// is skipped but the trigger still counts. Periodic refreshes don't count as
+// triggers, but are made aggressive too if an escalation is pending.
+//
+// With n = 1 every trigger escalates and the window doesn't matter. Otherwise
+// the window must be positive.
+//
+// Defaults to disabled.
+func EscalatingRefresh(n int, window time.Duration) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("escalating refresh needs at least 1 trigger, got %d", n)
+		}
+		if n > 1 && window <= 0 {
+			return fmt.Errorf("escalating refresh after %d triggers needs a positive window, got %s", n, window)
+		}
+		o.RoutingTable.EscalateAfter = n
+		o.RoutingTable.EscalationWindow = window
+		return nil
+	}
+}
+
+// PrioritizeClosestBucket makes the DHT work harder at knowing the peers
+// closest to its own ID, for nodes that must reliably store the records of
+// keys near it. The closest bucket is the routing table's last, holding the
+// peers sharing the longest prefix with us.
+//
+// On top of the periodic refreshes, every quarter of the refresh period (see
+// RoutingTableRefreshPeriod) the DHT walks toward its own ID and toward three
+// random IDs in the closest bucket, in parallel. Periodic refreshes always walk
+// the closest bucket, however full and recently refreshed. This costs about
+// four extra lookups every quarter of the refresh period, plus up to one per
+// refresh. It has no effect if auto-refresh is disabled.
+//
+// Defaults to disabled.
+func PrioritizeClosestBucket() Option {
+	return func(o *Options) error {
+		o.RoutingTable.PrioritizeClosestBucket = true
+		return nil
+	}
+}
+
+// refreshBucketsLimit is the number of buckets we can generate refresh targets
+// for. Targets are picked among peer IDs whose hash is known to start with a
+// given 16 bit prefix, so only the first 16 buckets can be targeted.
+const refreshBucketsLimit = 16
+
+// MaxRefreshBuckets sets how many buckets, starting from the farthest one,
+// routing table refreshes walk. Deeper buckets are never refreshed; they're
+// only filled by the self walk and regular queries.
+//
+// Refresh targets can't be generated beyond the first 16 buckets, so larger
+// values are rejected.
+//
+// Defaults to 16.
+func MaxRefreshBuckets(n int) Option {
+	return func(o *Options) error {
+		if n < 1 || n > refreshBucketsLimit {
+			return fmt.Errorf("max refresh buckets must be between 1 and %d, got %d", refreshBucketsLimit, n)
+		}
+		o.RoutingTable.MaxRefreshBuckets = n
+		return nil
+	}
+}
+
 // Datastore configures the DHT to use the specified datastore.
 //
 // Defaults to an in-memory (temporary) map.
@@ -95,40 +469,1048 @@ func Datastore(ds ds.Batching) Option {
 	}
 }
 
-// Client configures whether or not the DHT operates in client-only mode.
+// DatastoreErrors configures how the DHT reacts when its datastore returns an
+// error while storing or retrieving values and provider records. Context
+// errors always fail the operation.
+//
+// Defaults to DatastoreErrorDefault.
+func DatastoreErrors(policy DatastoreErrorPolicy) Option {
+	return func(o *Options) error {
+		o.DatastoreErrorPolicy = policy
+		return nil
+	}
+}
+
+// SelfInResults configures whether GetClosestPeers and FindPeer may return the
+// local node, e.g. for applications computing replication sets that should or
+// shouldn't count it. See SelfMode for the details of each mode.
+//
+// Defaults to SelfExclude.
+func SelfInResults(mode SelfMode) Option {
+	return func(o *Options) error {
+		switch mode {
+		case SelfExclude, SelfInclude, SelfError:
+		default:
+			return fmt.Errorf("unknown self mode %d", mode)
+		}
+		o.SelfInResults = mode
+		return nil
+	}
+}
+
+// ProvideExtraFanout configures the DHT to also announce provider records to
+// n random peers from the routing table, in addition to the K closest peers to
+// the key.
+//
+// This is non-standard. It makes provider records more likely to survive churn
+// around the key at the cost of extra traffic, and the random peers will only
+// be found by lookups that happen to pass through them.
+//
+// Defaults to 0.
+func ProvideExtraFanout(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("provide extra fanout must be non-negative, got %d", n)
+		}
+		o.ProvideExtraFanout = n
+		return nil
+	}
+}
+
+// MaxMessageSize sets the maximum size of a message we're willing to read from
+// a peer. The length prefix of each message is checked against this limit
+// before allocating any memory for it, and streams carrying larger messages
+// are reset.
+//
+// Defaults to 4MiB (network.MessageSizeMax).
+func MaxMessageSize(bytes int) Option {
+	return func(o *Options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("max message size must be positive, got %d", bytes)
+		}
+		o.MaxMessageSize = bytes
+		return nil
+	}
+}
+
+// MaxMessagesPerStream sets the maximum number of messages we handle on a
+// single inbound stream. Any further message is dropped and the stream is
+// closed, so the peer has to send it again on a new stream. This bounds what a
+// single stream can commit us to and makes the peer go through any per-stream
+// accounting again.
+//
+// Defaults to 0 (unlimited).
+func MaxMessagesPerStream(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("max messages per stream must be non-negative, got %d", n)
+		}
+		o.MaxMessagesPerStream = n
+		return nil
+	}
+}
+
+// MaxRecordSize sets the maximum size, in bytes, of the values we accept for
+// records in the given namespace (e.g. "ipns" or "pk"), both from PutValue and
+// from peers storing records with us. The empty namespace sets the limit for
+// all namespaces without a limit of their own. Values larger than the limit
+// are rejected with a *dht.RecordTooLargeError.
+//
+// May be given several times. Defaults to no limit, apart from MaxMessageSize.
+func MaxRecordSize(namespace string, bytes int) Option {
+	return func(o *Options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("max record size for namespace %q must be positive, got %d", namespace, bytes)
+		}
+		if o.MaxRecordSizes == nil {
+			o.MaxRecordSizes = make(map[string]int)
+		}
+		o.MaxRecordSizes[namespace] = bytes
+		return nil
+	}
+}
+
+// MaxCloserPeersPerResponse limits how many closer peers we take from a single
+// response to one of our requests. Only the n closest to the key are kept and
+// the rest is ignored, so a peer can't make us process and store the
+// addresses of an arbitrary number of peers.
+//
+// Defaults to twice the bucket size. Honest peers return at most their bucket
+// size.
+func MaxCloserPeersPerResponse(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("max closer peers per response must be at least 1, got %d", n)
+		}
+		o.MaxCloserPeersPerResponse = n
+		return nil
+	}
+}
+
+// PenalizeOversizedMessages configures whether peers that send us messages
+// larger than MaxMessageSize should be evicted from the routing table.
 //
 // Defaults to false.
-func Client(only bool) Option {
+func PenalizeOversizedMessages(penalize bool) Option {
 	return func(o *Options) error {
-		o.Client = only
+		o.PenalizeOversizedMessages = penalize
 		return nil
 	}
 }
 
-// Validator configures the DHT to use the specified validator.
+// MaxProviderRecordsPerPeer limits the number of provider records any single
+// remote peer can store with us. Once the limit is reached, new ADD_PROVIDER
+// records from that peer are rejected until some of its records expire.
 //
-// Defaults to a namespaced validator that can only validate public keys.
-func Validator(v record.Validator) Option {
+// Defaults to 0 (unlimited).
+func MaxProviderRecordsPerPeer(n int) Option {
 	return func(o *Options) error {
-		o.Validator = v
+		if n < 0 {
+			return fmt.Errorf("max provider records per peer must be non-negative, got %d", n)
+		}
+		o.MaxProviderRecordsPerPeer = n
 		return nil
 	}
 }
 
-// NamespacedValidator adds a validator namespaced under `ns`. This option fails
-// if the DHT is not using a `record.NamespacedValidator` as it's validator (it
-// uses one by default but this can be overridden with the `Validator` option).
+// ServeProvidersFreshnessThreshold makes us only hand out provider records
+// refreshed less than d ago in response to GET_PROVIDERS, on the theory that
+// providers that announced themselves recently are more likely to be
+// reachable. Older records are still stored until they expire, and served
+// again if their provider refreshes them.
 //
-// Example: Given a validator registered as `NamespacedValidator("ipns",
-// myValidator)`, all records with keys starting with `/ipns/` will be validated
-// with `myValidator`.
-func NamespacedValidator(ns string, v record.Validator) Option {
+// This trades quantity for quality: requesters get fewer providers, possibly
+// none, for content whose providers reannounce it less often than d. It
+// should be well above the reprovide interval of the network.
+//
+// Defaults to 0 (serve all records until they expire).
+func ServeProvidersFreshnessThreshold(d time.Duration) Option {
 	return func(o *Options) error {
-		nsval, ok := o.Validator.(record.NamespacedValidator)
-		if !ok {
-			return fmt.Errorf("can only add namespaced validators to a NamespacedValidator")
+		if d < 0 {
+			return fmt.Errorf("provider freshness threshold must be non-negative, got %s", d)
 		}
-		nsval[ns] = v
+		o.ServeProvidersFreshnessThreshold = d
+		return nil
+	}
+}
+
+// MergeProviderAddrs makes FindProviders return, for each provider, the
+// addresses given for it by all the responses to the lookup, instead of only
+// the ones from the first response naming it. The lookup stops once it has
+// found enough providers, so addresses only given by later responses are
+// missed either way. FindProvidersAsync, which hands out providers as soon as
+// they're found, is unaffected.
+//
+// The merged addresses are a union: they may include addresses that only some
+// of the responders gave, possibly stale or bogus ones the others didn't
+// vouch for.
+//
+// Defaults to disabled (only dedupe providers by peer ID).
+func MergeProviderAddrs() Option {
+	return func(o *Options) error {
+		o.MergeProviderAddrs = true
+		return nil
+	}
+}
+
+// MinProviderRefreshInterval limits how often a remote peer can refresh the
+// provider record it stores with us for a given key. Repeated ADD_PROVIDER
+// messages always update the peer's existing record rather than adding a new
+// one; with this option, those arriving sooner than the given interval after
+// the last refresh are ignored altogether, sparing a datastore write.
+//
+// Defaults to 0 (every ADD_PROVIDER refreshes the record).
+func MinProviderRefreshInterval(d time.Duration) Option {
+	return func(o *Options) error {
+		o.MinProviderRefreshInterval = d
+		return nil
+	}
+}
+
+// ProviderRecordLimits bounds the number of provider records we store. Past
+// soft records, the records with the highest eviction scores (see
+// ProviderEvictionWeights) are evicted at each GC round until soft records
+// are left, rather than only expired ones. Past hard records, new ADD_PROVIDER
+// records are rejected and a GC round is started early. Our own records are
+// never evicted or rejected. See providers.RecordLimits for the details.
+//
+// Defaults to 0 for both (unlimited).
+func ProviderRecordLimits(soft, hard int) Option {
+	return func(o *Options) error {
+		if soft < 0 || hard < 0 {
+			return fmt.Errorf("provider record limits must be non-negative, got %d and %d", soft, hard)
+		}
+		if hard > 0 && hard < soft {
+			return fmt.Errorf("hard provider record limit %d is lower than the soft one %d", hard, soft)
+		}
+		o.ProviderRecordLimits.Soft = soft
+		o.ProviderRecordLimits.Hard = hard
+		return nil
+	}
+}
+
+// ProviderEvictionWeights sets the weights of the eviction score of provider
+// records used once the soft limit set with ProviderRecordLimits is exceeded:
+//
+//	score = recency * age + distance * dist
+//
+// where age is the time since the record was last refreshed, as a fraction of
+// its validity, and dist is the XOR distance between the key and our peer ID,
+// scaled to [0, 1). The records with the highest scores are evicted first, so
+// by default we keep fresh records and records for keys close to us, which we
+// are most responsible for.
+//
+// Defaults to 1 for both.
+func ProviderEvictionWeights(recency, distance float64) Option {
+	return func(o *Options) error {
+		if recency < 0 || distance < 0 {
+			return fmt.Errorf("provider eviction weights must be non-negative, got %v and %v", recency, distance)
+		}
+		o.ProviderRecordLimits.RecencyWeight = recency
+		o.ProviderRecordLimits.DistanceWeight = distance
+		return nil
+	}
+}
+
+// QuerySeedSources adds sources of peers (e.g. the routing table of another
+// DHT, such as a LAN DHT running alongside a WAN one) used to seed the initial
+// frontier of every query, in addition to the DHT's own routing table.
+//
+// The closest peers from each source are used and peers known to several
+// sources are only queried once. The DHT's host must be able to dial the peers
+// returned by these sources (e.g. because the DHTs share a host).
+func QuerySeedSources(sources ...PeerSource) Option {
+	return func(o *Options) error {
+		o.QuerySeedSources = append(o.QuerySeedSources, sources...)
+		return nil
+	}
+}
+
+// SeedFromPeerstore adds up to maxExtra peers we know addresses for but that
+// aren't in the routing table (or any QuerySeedSources) to the initial
+// frontier of every query, if they're closer to the target than the farthest
+// of the other initial peers, or if there are too few of those. The closest
+// such peers are picked.
+//
+// This helps nodes with a large peerstore and a small routing table converge
+// faster, at the cost of going through the whole peerstore at the start of
+// every query. Peers in the peerstore may well be gone: every extra seed is a
+// dial that may fail.
+//
+// Defaults to 0 (no extra seeds).
+func SeedFromPeerstore(maxExtra int) Option {
+	return func(o *Options) error {
+		if maxExtra < 0 {
+			return fmt.Errorf("max extra seeds must be non-negative, got %d", maxExtra)
+		}
+		o.PeerstoreSeeds = maxExtra
+		return nil
+	}
+}
+
+// NewPeerGracePeriod sets how long a peer that was just added to the routing
+// table is deprioritized when picking the initial peers of a query. Such peers
+// are only queried first if there aren't enough other peers to start with.
+// This avoids wasting queries on peers that haven't finished setting up their
+// connection yet.
+//
+// Defaults to 0 (no grace period).
+func NewPeerGracePeriod(d time.Duration) Option {
+	return func(o *Options) error {
+		o.NewPeerGracePeriod = d
+		return nil
+	}
+}
+
+// EvictionCooldown sets how long a peer removed from the routing table, e.g.
+// because it disconnected, is kept from being added back. This reduces churn
+// from peers flapping in and out of the table. A peer answering one of our
+// requests during its cooldown has shown it's useful and is added back right
+// away.
+//
+// The DHT has no notion of protected peers, so no peer bypasses the cooldown
+// other than by answering our requests.
+//
+// Defaults to 0 (no cooldown).
+func EvictionCooldown(d time.Duration) Option {
+	return func(o *Options) error {
+		o.EvictionCooldown = d
+		return nil
+	}
+}
+
+// MaxPeerAge starts a background verifier pinging routing table peers that
+// weren't heard from for longer than d, evicting those that don't answer.
+// Peers are aged from when they were added to the routing table or last
+// answered the verifier. Without it, peers that went offline may stay in the
+// routing table until a query happens to contact them.
+//
+// The verifier pings at most one peer per second, oldest first, so a large
+// table may take a while to be verified after d.
+//
+// Defaults to 0 (disabled).
+func MaxPeerAge(d time.Duration) Option {
+	return func(o *Options) error {
+		o.RoutingTable.MaxPeerAge = d
+		return nil
+	}
+}
+
+// OnInvalidRecord sets a function to be called whenever a peer responds to a
+// GET_VALUE request with a record that fails validation. The record is
+// discarded either way. The function is called synchronously from the query
+// and should not block.
+//
+// Defaults to nil (no hook).
+func OnInvalidRecord(f func(from peer.ID, key string, err error)) Option {
+	return func(o *Options) error {
+		o.OnInvalidRecord = f
+		return nil
+	}
+}
+
+// OnAddrAttributionAnomaly sets a function to be called whenever a peer
+// responds to a FIND_NODE request with addresses we can't attribute to the
+// peer they're given for: addresses embedding another peer ID (/p2p/...), or
+// any address of a peer ID that isn't a valid multihash, in which case addr is
+// nil. Such responses may come from buggy peers or from attempts to make us
+// dial the wrong peers.
+//
+// Misattributed addresses are always dropped from the response before it's
+// used, as are peers with invalid IDs, whether or not a function is set. The
+// function is called synchronously from the query and should not block.
+//
+// Defaults to nil (no hook).
+func OnAddrAttributionAnomaly(f func(from, claimed peer.ID, addr ma.Multiaddr)) Option {
+	return func(o *Options) error {
+		o.OnAddrAttributionAnomaly = f
+		return nil
+	}
+}
+
+// OnCloserPeersSelected sets a function to be called whenever the DHT picks
+// the closer peers to include in its answer to a FIND_NODE, GET_VALUE or
+// GET_PROVIDERS request from peer to, with the key looked up. The selected
+// peers are the ones the routing table returns as nearest to the key, in its
+// order, with the requester left out. distances[i] is the XOR distance
+// between kb.ConvertKey(string(target)) and kb.ConvertPeerID(selected[i]).
+// Peers we don't know an address for are left out of the response afterwards.
+//
+// The routing table sorts the peers of the buckets it looks at, but only
+// looks at as few buckets as it needs to fill the response, so the selected
+// peers aren't always the closest ones it holds. Comparing the distances with
+// those of the other peers in the table shows when that happens.
+//
+// The function is called synchronously from the handler and must neither
+// block nor modify its arguments.
+//
+// Defaults to nil (no hook).
+func OnCloserPeersSelected(f func(to peer.ID, target []byte, selected []peer.ID, distances []kb.ID)) Option {
+	return func(o *Options) error {
+		o.OnCloserPeersSelected = f
+		return nil
+	}
+}
+
+// OnProviderRecordServed sets a function to be called whenever the DHT answers a
+// GET_PROVIDERS request, with the number of providers included in the
+// response (possibly 0). The function is called synchronously from the
+// request handler, after the provider records have been read, and should not
+// block.
+//
+// Defaults to nil (no hook).
+func OnProviderRecordServed(f func(to peer.ID, key cid.Cid, numProviders int)) Option {
+	return func(o *Options) error {
+		o.OnProviderRecordServed = f
+		return nil
+	}
+}
+
+// OnRecordConflict sets a function to be called when a value lookup got more
+// than one distinct valid record for a key, e.g. competing IPNS records. It's
+// passed up to 8 of the distinct records and the index of the one selected by
+// the validator. The function is called synchronously once the lookup is over
+// and should not block.
+//
+// Defaults to nil (no hook).
+func OnRecordConflict(f func(key string, records [][]byte, selected int)) Option {
+	return func(o *Options) error {
+		o.OnRecordConflict = f
+		return nil
+	}
+}
+
+// OnStalePutRejected sets a function to be called whenever we reject a
+// PUT_VALUE record because the record we already hold for the key is better
+// according to the validator, e.g. an IPNS record with a higher sequence
+// number. It's passed the peer that sent the stale record, the key, and both
+// values. The function is called synchronously from the handler and should not
+// block.
+//
+// Defaults to nil (no hook).
+func OnStalePutRejected(f func(from peer.ID, key string, stale, held []byte)) Option {
+	return func(o *Options) error {
+		o.OnStalePutRejected = f
+		return nil
+	}
+}
+
+// ReturnNewerRecordOnStalePut makes us answer a PUT_VALUE carrying a record
+// worse than the one we hold with the record we hold, rather than resetting
+// the stream, so the putter learns it's behind. Our own PutValue recognizes
+// such answers from any peer: it still puts the record to the other closest
+// peers, then returns a *dht.NewerRecordError.
+//
+// Defaults to false.
+func ReturnNewerRecordOnStalePut(enable bool) Option {
+	return func(o *Options) error {
+		o.ReturnNewerRecordOnStalePut = enable
+		return nil
+	}
+}
+
+// OnBucketSplit sets a function to be called when the routing table splits
+// its last bucket to make room for a new peer, with the number of buckets
+// after the split. A single peer may cause several splits at once, in which
+// case the function is only called once. Splits are reported even when the
+// peer still doesn't fit in the table afterwards.
+//
+// The function is called synchronously, possibly while the routing table is
+// locked. It must not block or use the routing table.
+//
+// Defaults to nil (no hook).
+func OnBucketSplit(f func(newBucketCount int)) Option {
+	return func(o *Options) error {
+		o.OnBucketSplit = f
+		return nil
+	}
+}
+
+// OnRoutingTableHealthChange sets a function to be called when the routing
+// table becomes healthy or unhealthy, with its size at the time. It's healthy
+// while it holds more peers than the threshold below which a refresh is
+// triggered on each new connection (4), and starts out unhealthy.
+//
+// Changes are only reported once the new state has held for 5 seconds, so
+// the function isn't called when the table briefly flaps around the threshold,
+// and is called 5 seconds after the transition. It's called from its own
+// goroutine, and never after the DHT is closed.
+//
+// Defaults to nil (no hook).
+func OnRoutingTableHealthChange(f func(healthy bool, size int)) Option {
+	return func(o *Options) error {
+		o.OnRoutingTableHealthChange = f
+		return nil
+	}
+}
+
+// DatastoreLatencyHook sets a function to be called with the duration of each
+// operation on the datastore by the value store and the provider manager. op
+// is one of "get", "has", "getsize", "put", "delete", "query" and "batch". A
+// query is timed until its results are returned, not until they're all read,
+// and the provider manager writes in batches timed when they're committed.
+//
+// The function is called synchronously and should not block.
+//
+// Defaults to nil (no hook).
+func DatastoreLatencyHook(f func(op string, d time.Duration)) Option {
+	return func(o *Options) error {
+		o.DatastoreLatencyHook = f
+		return nil
+	}
+}
+
+// OnRefreshComplete sets a function to be called with the outcome of each
+// routing table refresh, periodic or triggered, once it's done.
+//
+// The function is called synchronously from the refresh worker, the next
+// refresh doesn't start until it returns.
+//
+// Defaults to nil (no hook).
+func OnRefreshComplete(f func(RefreshResult)) Option {
+	return func(o *Options) error {
+		o.OnRefreshComplete = f
+		return nil
+	}
+}
+
+// OnIsolation sets a function to be called when a routing table refresh finds
+// the node isolated: the routing table is still empty once the refresh is
+// done, as none of its walks reached another peer. It's called with the
+// outcome of the refresh, after trying to re-bootstrap if the
+// ReBootstrapOnIsolation option is set, and before OnRefreshComplete.
+//
+// The function is called synchronously from the refresh worker, the next
+// refresh doesn't start until it returns.
+//
+// Defaults to nil (no hook).
+func OnIsolation(f func(RefreshResult)) Option {
+	return func(o *Options) error {
+		o.OnIsolation = f
+		return nil
+	}
+}
+
+// ReBootstrapOnIsolation makes a routing table refresh finding the node
+// isolated (see OnIsolation) reconnect to the given bootstrap peers, as
+// ConnectBootstrapPeers does, then walk toward our own ID to fill the routing
+// table back up. Without peers, dht.DefaultBootstrapPeers are used.
+//
+// This happens on every refresh for as long as we're isolated, so at least
+// once per refresh period. Use BootstrapPeerBackoff to avoid hammering
+// bootstrap peers we can't reach.
+//
+// Defaults to disabled.
+func ReBootstrapOnIsolation(peers ...peer.AddrInfo) Option {
+	return func(o *Options) error {
+		o.ReBootstrapOnIsolation.Enabled = true
+		o.ReBootstrapOnIsolation.Peers = peers
+		return nil
+	}
+}
+
+// OnRefreshTarget sets a function to be called with the random target of each
+// bucket walk during routing table refreshes, before walking to it. The target
+// is generated to share exactly bucketID leading bits with our own ID, up to
+// the 16 bits GenRandPeerID supports.
+//
+// The function is called synchronously and should not block. It may be called
+// concurrently during aggressive refreshes, see EscalatingRefresh.
+//
+// Defaults to nil (no hook).
+func OnRefreshTarget(f func(bucketID int, target peer.ID)) Option {
+	return func(o *Options) error {
+		o.OnRefreshTarget = f
+		return nil
+	}
+}
+
+// BootstrapDialConcurrency sets how many bootstrap peers ConnectBootstrapPeers
+// dials in parallel.
+//
+// Defaults to 8.
+func BootstrapDialConcurrency(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("bootstrap dial concurrency must be at least 1, got %d", n)
+		}
+		o.BootstrapDialConcurrency = n
+		return nil
+	}
+}
+
+// BootstrapPeerBackoff makes ConnectBootstrapPeers skip bootstrap peers it
+// recently failed to connect to. A peer is skipped for base after its first
+// failure, and the backoff doubles with every failure in a row, up to max. A
+// successful connection clears it. Dials cancelled because enough peers were
+// already connected don't count as failures. The backoff of each peer is
+// available from IpfsDHT.BootstrapBackoffStates.
+//
+// If every bootstrap peer given is backing off, ConnectBootstrapPeers fails
+// without dialing any.
+//
+// Defaults to disabled.
+func BootstrapPeerBackoff(base, max time.Duration) Option {
+	return func(o *Options) error {
+		if base <= 0 || max < base {
+			return fmt.Errorf("invalid bootstrap peer backoff: base %s, max %s", base, max)
+		}
+		o.BootstrapBackoff.Base = base
+		o.BootstrapBackoff.Max = max
+		return nil
+	}
+}
+
+// IdentifyWaitTimeout makes ConnectBootstrapPeers wait for up to d for the
+// identify protocol to complete on each bootstrap connection before counting
+// the peer as connected. Peers advertising our protocols are then added to the
+// routing table right away, so they're usable as soon as
+// ConnectBootstrapPeers returns. Peers not identified in time count as failed
+// dials, although the connection is kept.
+//
+// This needs a host exposing its identify service, like the basic host. The
+// basic host already identifies new connections before Connect returns, but
+// without a deadline. With other hosts, this option has no effect.
+//
+// Defaults to 0 (don't wait).
+func IdentifyWaitTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		o.IdentifyWaitTimeout = d
+		return nil
+	}
+}
+
+// SeedFromExistingConnections makes New add the peers the host is already
+// connected to to the routing table, if they're DHT servers. Peers whose
+// protocols aren't known yet are asked, like on new connections, and added
+// asynchronously. The eviction cooldown applies to them as usual.
+//
+// Without this option, the routing table starts empty and is only filled by
+// connections opened once the DHT is running.
+//
+// Defaults to disabled.
+func SeedFromExistingConnections() Option {
+	return func(o *Options) error {
+		o.SeedFromExistingConnections = true
+		return nil
+	}
+}
+
+// HealthyAfterQueries makes IpfsDHT.HealthCheck report the DHT as unhealthy
+// until n of its queries got an answer from at least one peer. Having peers in
+// the routing table doesn't mean we can actually complete lookups, e.g. if
+// they're all unreachable.
+//
+// Defaults to 0: healthy as soon as the routing table isn't empty.
+func HealthyAfterQueries(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("healthy after queries must be non-negative, got %d", n)
+		}
+		o.HealthyAfterQueries = n
+		return nil
+	}
+}
+
+// AdaptiveConcurrency makes queries start with initial concurrent RPCs and
+// widen as the lookup stalls, instead of always sending AlphaValue RPCs in
+// parallel.
+//
+// A query proceeds in rounds, a round being as many responses as the current
+// concurrency. If no response in a round returned a peer closer to the key
+// than any seen before, the concurrency doubles, up to max. It never shrinks
+// again within a query. Easy lookups thus stay narrow and send few RPCs while
+// hard ones quickly get as wide as max.
+//
+// The growth doesn't affect the MaxRPCs budget, which is still checked before
+// each RPC; a narrow query just spends it more slowly.
+//
+// Defaults to AlphaValue concurrent RPCs, without growth.
+func AdaptiveConcurrency(initial, max int) Option {
+	return func(o *Options) error {
+		if initial < 1 || max < initial {
+			return fmt.Errorf("invalid adaptive concurrency: need 1 <= initial <= max, got %d and %d", initial, max)
+		}
+		o.QueryConcurrency.Initial = initial
+		o.QueryConcurrency.Max = max
+		return nil
+	}
+}
+
+// QueryTraceHistory keeps the traces of the last n queries in memory, for
+// post-mortem debugging. They're available from IpfsDHT.RecentQueryTraces.
+// Every query run by the DHT is traced, including routing table refreshes and
+// the lookups made by provides and puts. A trace has an entry per peer the
+// query contacted, so it can take a few kilobytes.
+//
+// Defaults to 0 (no traces).
+func QueryTraceHistory(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("query trace history must be non-negative, got %d", n)
+		}
+		o.QueryTraceHistory = n
+		return nil
+	}
+}
+
+// PenalizeSelfOnlyResponses makes queries skip peers that consistently respond
+// with only themselves as closer peers. Such responses don't help queries
+// converge and may be an attempt to eclipse the key. The offending peers can
+// be listed with IpfsDHT.SelfOnlyResponders, whether or not this option is
+// set.
+//
+// Defaults to disabled.
+func PenalizeSelfOnlyResponses() Option {
+	return func(o *Options) error {
+		o.PenalizeSelfOnlyResponses = true
+		return nil
+	}
+}
+
+// WithReprovideSource configures the DHT to reprovide every key yielded by the
+// given source, once every interval. Keys are announced concurrently; a cycle
+// that takes longer than the interval delays the next one.
+//
+// Defaults to no reproviding.
+func WithReprovideSource(src ContentSource, interval time.Duration) Option {
+	return func(o *Options) error {
+		if src == nil {
+			return fmt.Errorf("reprovide source must not be nil")
+		}
+		if interval <= 0 {
+			return fmt.Errorf("reprovide interval must be positive, got %s", interval)
+		}
+		o.Reprovide.Source = src
+		o.Reprovide.Interval = interval
+		return nil
+	}
+}
+
+// ReprovideRegionConcurrency limits how many keys the reprovider announces at
+// once within the same region of the keyspace, so a large reprovide doesn't
+// send bursts of ADD_PROVIDER messages to the same closest peers. Keys whose
+// SHA-256 hashes share their first bits bits are in the same region, and at
+// most n of them are announced in parallel; the others wait for their turn
+// while keys from other regions go ahead.
+//
+// The closest peers of a key are typically the peers sharing about
+// log2(network size / bucket size) bits with it, so bits should be around
+// that for keys sharing closest peers to be throttled together. Lower values
+// throttle more keys together. Many close keys can leave the reprovider
+// announcing fewer keys at once than its usual concurrency.
+//
+// Defaults to disabled (no limit besides the reprovider's concurrency).
+func ReprovideRegionConcurrency(bits, n int) Option {
+	return func(o *Options) error {
+		if bits < 1 || bits > 32 {
+			return fmt.Errorf("reprovide region bits must be between 1 and 32, got %d", bits)
+		}
+		if n < 1 {
+			return fmt.Errorf("reprovide region concurrency must be at least 1, got %d", n)
+		}
+		o.Reprovide.RegionBits = bits
+		o.Reprovide.RegionConcurrency = n
+		return nil
+	}
+}
+
+// ExcludeRelayAddrsInQueries keeps queries from dialing peers whose known
+// addresses are all circuit relay addresses. These peers are treated as
+// undialable by queries, so lookups on nodes behind NATs may find fewer peers
+// and records. Peers we're already connected to are still queried however
+// we're connected to them, and dials made outside of queries are unaffected.
+//
+// Only peers are filtered, not addresses: peers with both relay and direct
+// addresses are dialed as usual, and as the host dials every address it knows
+// for a peer, it may still connect to them through a relay.
+//
+// Defaults to disabled.
+func ExcludeRelayAddrsInQueries() Option {
+	return func(o *Options) error {
+		o.SkipRelayOnlyPeers = true
+		return nil
+	}
+}
+
+// SkipRelayOnlyPeersInQueries is the same as ExcludeRelayAddrsInQueries.
+func SkipRelayOnlyPeersInQueries() Option {
+	return ExcludeRelayAddrsInQueries()
+}
+
+// IPv6ScopePolicy sets the non-global IPv6 address scopes the DHT accepts from
+// other peers: the addresses of the peers in query responses, of the
+// providers they return, and of the providers announcing themselves to us.
+// Addresses in other scopes are dropped before they reach the peerstore, as
+// peers several hops away are unlikely to share a link or private network
+// with us. Global addresses are always accepted.
+//
+// Link-local addresses are only meaningful on the sender's own link, which
+// may not even be ours. Unique local addresses are routable within private
+// networks, so deployments spanning several such networks, or none, may want
+// to reject them too.
+//
+// Defaults to IPv6UniqueLocal (link-local addresses are rejected).
+func IPv6ScopePolicy(accept IPv6Scope) Option {
+	return func(o *Options) error {
+		o.IPv6Scopes = accept
+		return nil
+	}
+}
+
+// OnQueryDial sets a function to be called right before a query dials a peer,
+// with the context the query was started with (e.g. to read a correlation ID
+// set by the caller) and the addresses it's about to be dialed on. Returning
+// false skips the dial: the peer is treated as unreachable by that query only,
+// which goes on with the other peers.
+//
+// Peers we're already connected to are queried without dialing, so the
+// function isn't called for them, nor for the peers skipped by the
+// ExcludeRelayAddrsInQueries option. It's called concurrently from the
+// query's workers, and should not block.
+//
+// Defaults to nil (dial every peer).
+func OnQueryDial(f func(ctx context.Context, p peer.AddrInfo) bool) Option {
+	return func(o *Options) error {
+		o.OnQueryDial = f
+		return nil
+	}
+}
+
+// FailFastWhenOffline makes queries fail with dht.ErrOffline as soon as we
+// appear to have no network connectivity, rather than waiting for dials to
+// every peer in the routing table to time out. We consider ourselves offline
+// when we have no open connections and the last few dials made by queries
+// failed right away, as they do without connectivity.
+//
+// For a few seconds after the last such dial, queries fail without dialing
+// anyone. They then try again, so the DHT recovers when connectivity comes
+// back.
+//
+// Defaults to false.
+func FailFastWhenOffline(enable bool) Option {
+	return func(o *Options) error {
+		o.FailFastWhenOffline = enable
+		return nil
+	}
+}
+
+// SerializePutsPerKey makes concurrent PutValue calls for the same key run one
+// at a time, so they don't race to store their values on the closest peers.
+// Once a put is done, a put of a value the validator deems older fails like
+// any put of an older value, instead of reaching some of the closest peers
+// first. Waiting puts aren't guaranteed to run in the order they were made.
+//
+// Puts to other keys aren't affected, but a put waits for the whole of any
+// earlier put to the same key, lookup and replication included, which
+// easily takes seconds. A waiting put gives up with the context's error once
+// its context is done.
+//
+// Defaults to disabled.
+func SerializePutsPerKey() Option {
+	return func(o *Options) error {
+		o.SerializePuts = true
+		return nil
+	}
+}
+
+// OutboundQueryTransform sets a function rewriting the key of the query
+// messages the DHT sends to other peers (FIND_NODE, GET_VALUE and
+// GET_PROVIDERS). PUT_VALUE and ADD_PROVIDER messages are sent with their key
+// as is. Our side of a lookup still uses the original key, e.g. to order the
+// peers to query, but remote peers answer for the transformed key.
+//
+// EXPERIMENTAL: this is meant for studying query privacy techniques. Peers
+// answer for the key they receive, so any transform that doesn't map keys to
+// themselves breaks interoperability with the rest of the network, e.g.
+// records stored under a key can no longer be found under it.
+//
+// Defaults to nil (keys are sent as is).
+func OutboundQueryTransform(transform func(key string) string) Option {
+	return func(o *Options) error {
+		o.OutboundQueryTransform = transform
+		return nil
+	}
+}
+
+// RecentResultBuffer makes FindProvidersAsync buffer the providers it gets
+// from the network for ttl, so a request for the same key within that time
+// replays them immediately before querying the network again. Providers are
+// buffered for at most size keys.
+//
+// Defaults to disabled.
+func RecentResultBuffer(ttl time.Duration, size int) Option {
+	return func(o *Options) error {
+		if ttl <= 0 || size <= 0 {
+			return fmt.Errorf("recent result buffer ttl and size must be positive, got %s and %d", ttl, size)
+		}
+		o.RecentResults.TTL = ttl
+		o.RecentResults.Size = size
+		return nil
+	}
+}
+
+// GetValueCache makes GetValue cache the value it selects for each key for
+// ttl, answering requests for the key from the cache in the meantime. Values
+// are cached for at most size keys. An entry requested in the last quarter of
+// its lifetime is refreshed from the network in the background, keeping
+// whichever of the cached and the new values the validator selects, so
+// equivalent or older records found by the refresh don't replace it.
+//
+// Cached values are validated again each time they're served, so e.g. IPNS
+// records that expired in the meantime are dropped. SearchValue, offline
+// lookups and lookups with the NoCache option bypass the cache. PutValue
+// drops the cached value for its key.
+//
+// Defaults to disabled.
+func GetValueCache(ttl time.Duration, size int) Option {
+	return func(o *Options) error {
+		if ttl <= 0 || size <= 0 {
+			return fmt.Errorf("value cache ttl and size must be positive, got %s and %d", ttl, size)
+		}
+		o.ValueCache.TTL = ttl
+		o.ValueCache.Size = size
+		return nil
+	}
+}
+
+// ReplicaMode runs the DHT as a read-only mirror of another node, e.g. a hot
+// standby. The DHT takes part in queries and serves GET_VALUE and
+// GET_PROVIDERS from its datastore, but rejects inbound PUT_VALUE and
+// ADD_PROVIDER messages and fails local PutValue and Provide calls with
+// ErrReadOnlyReplica. Provider records are read from the datastore on every
+// request and never garbage collected.
+//
+// The datastore (see the Datastore option) must be the primary node's
+// datastore, shared or replicated. The replica only ever reads from it, even
+// stale records are left for the primary to remove, so it must be safe to read
+// while the primary writes to it. The replica serves whatever has reached the
+// datastore: the primary batches provider record writes, so its latest records
+// may take a while to show up. To take over from a failed primary, restart the
+// DHT without this option.
+//
+// Defaults to disabled.
+func ReplicaMode() Option {
+	return func(o *Options) error {
+		o.Replica = true
+		return nil
+	}
+}
+
+// KeyDenylist makes the DHT refuse to serve or store records for keys matched
+// by matcher. Inbound GET_VALUE and GET_PROVIDERS for a denied key get an
+// empty response, without closer peers, PUT_VALUE gets its stream reset and
+// ADD_PROVIDER is dropped. matcher is passed the key as sent in the message:
+// the record key for values and the CID bytes for providers. It is called
+// for every such message, so it should be fast.
+//
+// This only affects what this node serves. Other peers keep storing and
+// serving the denied keys, and local lookups for them are unaffected.
+//
+// Defaults to nil, serving all keys.
+func KeyDenylist(matcher func(key []byte) bool) Option {
+	return func(o *Options) error {
+		o.KeyDenylist = matcher
+		return nil
+	}
+}
+
+// Client configures whether or not the DHT operates in client-only mode.
+//
+// Defaults to false.
+func Client(only bool) Option {
+	return func(o *Options) error {
+		o.Client = only
+		return nil
+	}
+}
+
+// Validator configures the DHT to use the specified validator.
+//
+// Defaults to a namespaced validator that can only validate public keys.
+func Validator(v record.Validator) Option {
+	return func(o *Options) error {
+		o.Validator = v
+		return nil
+	}
+}
+
+// NamespacedValidator adds a validator namespaced under `ns`. This option fails
+// if the DHT is not using a `record.NamespacedValidator` as it's validator (it
+// uses one by default but this can be overridden with the `Validator` option).
+//
+// Example: Given a validator registered as `NamespacedValidator("ipns",
+// myValidator)`, all records with keys starting with `/ipns/` will be validated
+// with `myValidator`.
+func NamespacedValidator(ns string, v record.Validator) Option {
+	return func(o *Options) error {
+		nsval, ok := o.Validator.(record.NamespacedValidator)
+		if !ok {
+			return fmt.Errorf("can only add namespaced validators to a NamespacedValidator")
+		}
+		nsval[ns] = v
+		return nil
+	}
+}
+
+// UnknownNamespacePolicy sets how records with keys in a namespace no validator
+// is registered for (see NamespacedValidator) are handled. It applies wherever
+// the DHT validates records: inbound PUT_VALUE messages, PutValue and the
+// records received by GetValue. Keys without a namespace are always rejected.
+// The policy needs the validator to be a record.NamespacedValidator, as it is
+// by default.
+//
+// With UnknownNamespaceAccept, records for unknown namespaces are stored and
+// served without any validation, and the first of several records for the
+// same key is selected, as there is no way of knowing which one is best. This
+// lets anyone in the network overwrite or fill up these namespaces on our
+// node with whatever they like: only use it on networks of trusted peers, or
+// for data validated by the application after it's read back.
+//
+// With UnknownNamespaceDelegate, these records are validated and selected by
+// fallback, which must not be nil.
+//
+// Defaults to UnknownNamespaceReject.
+func UnknownNamespacePolicy(action UnknownNamespaceAction, fallback record.Validator) Option {
+	return func(o *Options) error {
+		switch action {
+		case UnknownNamespaceReject, UnknownNamespaceAccept:
+		case UnknownNamespaceDelegate:
+			if fallback == nil {
+				return fmt.Errorf("UnknownNamespaceDelegate needs a fallback validator")
+			}
+		default:
+			return fmt.Errorf("invalid unknown namespace action: %d", action)
+		}
+		o.UnknownNamespace.Action = action
+		o.UnknownNamespace.Fallback = fallback
+		return nil
+	}
+}
+
+// UnknownNamespaceGetPolicy sets how GetValue and SearchValue handle keys in a
+// namespace no validator is registered for. Namespaces handled by the
+// UnknownNamespacePolicy option have a validator, so this only applies with
+// UnknownNamespaceReject, and only to a record.NamespacedValidator.
+//
+// With UnknownNamespaceGetReject, lookups fail right away with a
+// dht.UnknownNamespaceError.
+//
+// With UnknownNamespaceGetFirst, the lookup stops at the first value received
+// (as with a Quorum of 1), which is returned as is. Without a validator there
+// is no defense against poisoning: any peer on the path of the lookup can
+// answer with whatever value it likes, and it will be returned. Only use it
+// for data the application validates itself.
+//
+// Defaults to UnknownNamespaceGetReject.
+func UnknownNamespaceGetPolicy(action UnknownNamespaceGetAction) Option {
+	return func(o *Options) error {
+		switch action {
+		case UnknownNamespaceGetReject, UnknownNamespaceGetFirst:
+		default:
+			return fmt.Errorf("invalid unknown namespace get action: %d", action)
+		}
+		o.UnknownNamespaceGet = action
 		return nil
 	}
 }
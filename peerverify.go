@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	process "github.com/jbenet/goprocess"
+	processctx "github.com/jbenet/goprocess/context"
+)
+
+// peerVerifyInterval is the time between two routing table peer
+// verifications, bounding the rate at which the verifier pings peers.
+var peerVerifyInterval = time.Second
+
+// peerVerifyTimeout bounds the time a peer has to answer a verification ping.
+var peerVerifyTimeout = 10 * time.Second
+
+// startVerifyingPeers starts the worker pinging routing table peers that
+// weren't verified for longer than the max peer age, one peer every
+// peerVerifyInterval, and evicting those that don't answer.
+func (dht *IpfsDHT) startVerifyingPeers() {
+	dht.peerVerifyProc = process.Go(func(proc process.Process) {
+		ctx := processctx.OnClosingContext(proc)
+
+		ticker := time.NewTicker(peerVerifyInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			dht.verifyOldestPeer(ctx)
+		}
+	})
+}
+
+// verifyOldestPeer pings the routing table peer verified the longest ago, if
+// that was more than the max peer age ago, and removes it from the routing
+// table unless it answers. Peers that were never verified are as old as their
+// routing table entry.
+func (dht *IpfsDHT) verifyOldestPeer(ctx context.Context) {
+	var (
+		oldest peer.ID
+		since  time.Time
+	)
+	dht.rtPeersLk.Lock()
+	for p, addedAt := range dht.rtPeersAddedAt {
+		last := addedAt
+		if pingedAt, ok := dht.rtPeersPingedAt[p]; ok && pingedAt.After(last) {
+			last = pingedAt
+		}
+		if oldest == "" || last.Before(since) {
+			oldest, since = p, last
+		}
+	}
+	dht.rtPeersLk.Unlock()
+
+	if oldest == "" || time.Since(since) < dht.maxPeerAge {
+		return
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, peerVerifyTimeout)
+	err := dht.Ping(pctx, oldest)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logger.Debugf("evicting unresponsive peer %s from the routing table: %s", oldest, err)
+		dht.routingTable.Remove(oldest)
+		return
+	}
+
+	dht.rtPeersLk.Lock()
+	if _, ok := dht.rtPeersAddedAt[oldest]; ok {
+		dht.rtPeersPingedAt[oldest] = time.Now()
+	}
+	dht.rtPeersLk.Unlock()
+}
@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+func TestVerifyOldestPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	connect(t, ctx, a, b)
+	offline := test.RandPeerIDFatal(t)
+	if _, err := a.routingTable.Update(offline); err != nil {
+		t.Fatal(err)
+	}
+
+	a.maxPeerAge = 50 * time.Millisecond
+	a.verifyOldestPeer(ctx)
+	if a.routingTable.Find(offline) == "" {
+		t.Fatal("expected young peers not to be verified")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	a.verifyOldestPeer(ctx)
+	a.verifyOldestPeer(ctx)
+	if a.routingTable.Find(offline) != "" {
+		t.Fatal("expected the unresponsive peer to be evicted")
+	}
+	if a.routingTable.Find(b.self) == "" {
+		t.Fatal("expected the responsive peer to be kept")
+	}
+
+	a.rtPeersLk.Lock()
+	_, pinged := a.rtPeersPingedAt[b.self]
+	a.rtPeersLk.Unlock()
+	if !pinged {
+		t.Fatal("expected the responsive peer to be marked as verified")
+	}
+}
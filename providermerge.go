@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// providerAddrs merges the addresses given for each provider by the responses
+// to a provider lookup, see the MergeProviderAddrs option.
+type providerAddrs struct {
+	lk    sync.Mutex
+	addrs map[peer.ID][]ma.Multiaddr
+}
+
+func newProviderAddrs() *providerAddrs {
+	return &providerAddrs{addrs: make(map[peer.ID][]ma.Multiaddr)}
+}
+
+// add merges the addresses of pi with the ones already known for it.
+func (m *providerAddrs) add(pi peer.AddrInfo) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	known := m.addrs[pi.ID]
+next:
+	for _, a := range pi.Addrs {
+		for _, k := range known {
+			if a.Equal(k) {
+				continue next
+			}
+		}
+		known = append(known, a)
+	}
+	m.addrs[pi.ID] = known
+}
+
+// get returns pi with all the addresses known for it.
+func (m *providerAddrs) get(pi peer.AddrInfo) peer.AddrInfo {
+	m.add(pi)
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return peer.AddrInfo{ID: pi.ID, Addrs: m.addrs[pi.ID]}
+}
@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	u "github.com/ipfs/go-ipfs-util"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// ProviderResult is a provider found by FindProvidersAsyncEx, along with how
+// close it is to the key in the keyspace.
+type ProviderResult struct {
+	peer.AddrInfo
+
+	// CommonPrefixLen is the number of leading bits the provider's position
+	// in the keyspace shares with the key's.
+	CommonPrefixLen int
+
+	// Rank is the number of peers known when the provider was found that are
+	// closer to the key: the closest peers in our routing table and every
+	// peer the lookup heard of so far. 0 means the provider was the closest
+	// peer we knew of. Ranks of providers found early are thus optimistic.
+	Rank int
+}
+
+// FindProvidersAsyncEx is like FindProvidersAsync, but also reports how close
+// each provider is to the key. Use it to tell whether providers are among the
+// closest peers to the content or further away.
+func (dht *IpfsDHT) FindProvidersAsyncEx(ctx context.Context, key cid.Cid, count int) <-chan ProviderResult {
+	logger.Event(ctx, "findProviders", key)
+	out := make(chan ProviderResult, count)
+
+	ranker := newProviderRanker(key)
+	ranker.add(dht.routingTable.NearestPeers(ranker.target, dht.bucketSize)...)
+	go func() {
+		defer close(out)
+		dht.findProvidersAsyncRoutine(ctx, key, count, ranker, nil, func(res ProviderResult) bool {
+			select {
+			case out <- res:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out
+}
+
+// providerRanker ranks providers among the peers seen by a lookup.
+type providerRanker struct {
+	target kb.ID
+
+	lk   sync.Mutex
+	seen map[peer.ID]kb.ID
+}
+
+func newProviderRanker(key cid.Cid) *providerRanker {
+	return &providerRanker{
+		target: kb.ConvertKey(key.KeyString()),
+		seen:   make(map[peer.ID]kb.ID),
+	}
+}
+
+func (r *providerRanker) add(peers ...peer.ID) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	for _, p := range peers {
+		if _, ok := r.seen[p]; !ok {
+			r.seen[p] = kb.ConvertPeerID(p)
+		}
+	}
+}
+
+func (r *providerRanker) addInfos(infos []*peer.AddrInfo) {
+	peers := make([]peer.ID, len(infos))
+	for i, pi := range infos {
+		peers[i] = pi.ID
+	}
+	r.add(peers...)
+}
+
+// rank returns pi with its distance to the key.
+func (r *providerRanker) rank(pi peer.AddrInfo) ProviderResult {
+	r.add(pi.ID)
+	id := kb.ConvertPeerID(pi.ID)
+	dist := u.XOR(id, r.target)
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	res := ProviderResult{AddrInfo: pi, CommonPrefixLen: kb.CommonPrefixLen(id, r.target)}
+	for _, other := range r.seen {
+		if bytes.Compare(u.XOR(other, r.target), dist) < 0 {
+			res.Rank++
+		}
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+package providers
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	base32 "github.com/whyrusleeping/base32"
+)
+
+// ErrStoreFull is returned by AddProvider when the provider store holds as
+// many records as its hard limit allows, see RecordLimits.
+var ErrStoreFull = errors.New("provider store is full")
+
+// minForcedGCInterval is the minimum time between the start of two GC rounds
+// when they're started early because the store hit its hard limit.
+var minForcedGCInterval = time.Minute
+
+// RecordLimits bounds the number of provider records stored.
+//
+// Past soft records, each GC round also evicts the records with the highest
+// eviction scores (see EvictionWeights) until soft records are left. Our own
+// records are never evicted, but count towards the limits.
+//
+// Past hard records, new records from other peers are rejected with
+// ErrStoreFull and a GC round is started early (at most once a minute)
+// instead of waiting for the next one. Refreshes are always allowed. As
+// records are only counted during a GC round, the count is approximate in
+// between. A hard limit lower than soft is raised to soft, and should be
+// well above it.
+//
+// Defaults to 0 for both (unlimited).
+func RecordLimits(soft, hard int) Option {
+	return func(pm *ProviderManager) {
+		pm.softLimit = soft
+		pm.hardLimit = hard
+	}
+}
+
+// EvictionWeights sets how the eviction score of a record, used once the store
+// exceeds its soft limit (see RecordLimits), is computed:
+//
+//	score = recency * age + distance * dist
+//
+// where age is the time since the record was last updated as a fraction of
+// ProvideValidity, and dist is the XOR distance between the key and our own
+// peer ID in the DHT keyspace, scaled to [0, 1). Both are in [0, 1], and the
+// records with the highest score are evicted first: with the default weights,
+// old records and records for keys far from us, which other peers are more
+// responsible for, go first.
+//
+// Defaults to 1 for both.
+func EvictionWeights(recency, distance float64) Option {
+	return func(pm *ProviderManager) {
+		pm.recencyWeight = recency
+		pm.distanceWeight = distance
+	}
+}
+
+// evictionCandidate is a provider record that may be evicted.
+type evictionCandidate struct {
+	dsk   string
+	p     peer.ID
+	score float64
+}
+
+// evictionCandidate returns the candidate for the record stored under dsk,
+// last updated at t. It returns false for our own records and records that
+// can't be parsed.
+func (pm *ProviderManager) evictionCandidate(dsk string, t, now time.Time) (evictionCandidate, bool) {
+	parts := strings.Split(strings.TrimPrefix(dsk, providersKeyPrefix), "/")
+	if len(parts) != 2 {
+		return evictionCandidate{}, false
+	}
+	key, err := base32.RawStdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return evictionCandidate{}, false
+	}
+	pid, err := base32.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || peer.ID(pid) == pm.local {
+		return evictionCandidate{}, false
+	}
+
+	age := math.Min(float64(now.Sub(t))/float64(ProvideValidity), 1)
+	if age < 0 {
+		age = 0
+	}
+	return evictionCandidate{
+		dsk:   dsk,
+		p:     peer.ID(pid),
+		score: pm.recencyWeight*age + pm.distanceWeight*pm.keyDistance(key),
+	}, true
+}
+
+// keyDistance returns the XOR distance between key and our own ID in the DHT
+// keyspace, scaled to [0, 1).
+func (pm *ProviderManager) keyDistance(key []byte) float64 {
+	a, b := kb.ConvertKey(string(key)), kb.ConvertPeerID(pm.local)
+	var d [8]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return float64(binary.BigEndian.Uint64(d[:])) / math.Exp2(64)
+}
+
+// evict removes the n candidates with the highest scores, except the ones in
+// skip, and returns how many were removed.
+func (pm *ProviderManager) evict(cands []evictionCandidate, n int, skip map[string]bool) int {
+	sort.Slice(cands, func(i, j int) bool { return cands[i].score > cands[j].score })
+
+	evicted := 0
+	for _, c := range cands {
+		if evicted == n {
+			break
+		}
+		if _, ok := skip[c.dsk]; ok {
+			// updated since the GC round started.
+			continue
+		}
+		if err := pm.dstore.Delete(ds.RawKey(c.dsk)); err != nil && err != ds.ErrNotFound {
+			log.Warning("failed to evict provider record: ", err)
+			continue
+		}
+		pm.untrackRecord(c.dsk, c.p)
+		evicted++
+	}
+	if evicted > 0 {
+		log.Debugf("evicted %d provider records", evicted)
+		pm.providers.Purge()
+	}
+	return evicted
+}
+
+// countRecords returns the number of provider records in the datastore.
+func (pm *ProviderManager) countRecords() (int, error) {
+	res, err := pm.dstore.Query(dsq.Query{Prefix: providersKeyPrefix, KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	n := 0
+	for e := range res.Next() {
+		if e.Error != nil {
+			return n, e.Error
+		}
+		n++
+	}
+	return n, nil
+}
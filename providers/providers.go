@@ -3,12 +3,14 @@ package providers
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 
+	tslru "github.com/hashicorp/golang-lru"
 	lru "github.com/hashicorp/golang-lru/simplelru"
 	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
@@ -28,17 +30,72 @@ var lruCacheSize = 256
 var ProvideValidity = time.Hour * 24
 var defaultCleanupInterval = time.Hour
 
+// limitHitsCacheSize is the number of peers for which we remember how many
+// times they hit the per-peer record limit.
+var limitHitsCacheSize = 256
+
+// ErrReadOnly is returned by AddProvider when the provider manager is
+// read-only.
+var ErrReadOnly = errors.New("provider store is read-only")
+
+// ErrTooManyRecords is returned by AddProvider when the providing peer already
+// stores the maximum number of provider records allowed per peer.
+var ErrTooManyRecords = errors.New("peer has too many provider records")
+
 type ProviderManager struct {
 	// all non channel fields are meant to be accessed only within
 	// the run method
 	providers *lru.LRU
 	dstore    *autobatch.Datastore
+	local     peer.ID
 
 	newprovs chan *addProv
 	getprovs chan *getProv
 	proc     goprocess.Process
 
 	cleanupInterval time.Duration
+
+	// maxRecordsPerPeer is the maximum number of (unexpired) provider records
+	// stored for any peer other than ourselves. Zero means unlimited.
+	maxRecordsPerPeer int
+	// peerRecords tracks the provider records stored for each peer (by
+	// datastore key) along with the time they were last updated. Only used
+	// when maxRecordsPerPeer is set.
+	peerRecords map[peer.ID]map[string]time.Time
+	// limitHits counts how many times each peer hit maxRecordsPerPeer. It's
+	// safe for concurrent use.
+	limitHits *tslru.Cache
+
+	// minRefreshInterval is the minimum time between two refreshes of a
+	// record by the same peer.
+	minRefreshInterval time.Duration
+
+	// readOnly is set when the datastore is written to by someone else.
+	readOnly bool
+
+	// softLimit and hardLimit bound the number of records stored, see
+	// RecordLimits. Zero means unlimited.
+	softLimit, hardLimit int
+	// recencyWeight and distanceWeight weigh the eviction score of records.
+	recencyWeight, distanceWeight float64
+	// numRecords is the number of records stored, as of the last GC round
+	// plus the records added since. Only used when limits are set.
+	numRecords int
+}
+
+// Option is a ProviderManager option.
+type Option func(*ProviderManager)
+
+// MaxRecordsPerPeer limits the number of provider records stored for any
+// single peer (other than ourselves). Once a peer reaches the limit, new
+// records from that peer are rejected with ErrTooManyRecords until some of its
+// existing records expire. Refreshing an existing record is always allowed.
+//
+// Defaults to 0 (unlimited).
+func MaxRecordsPerPeer(n int) Option {
+	return func(pm *ProviderManager) {
+		pm.maxRecordsPerPeer = n
+	}
 }
 
 type providerSet struct {
@@ -47,17 +104,70 @@ type providerSet struct {
 }
 
 type addProv struct {
-	k   cid.Cid
-	val peer.ID
+	k    cid.Cid
+	val  peer.ID
+	resp chan addProvResp
+}
+
+type addProvResp struct {
+	result AddResult
+	err    error
+}
+
+// AddResult tells what adding a provider record did.
+type AddResult int
+
+const (
+	// ProviderAdded means the record is a new one.
+	ProviderAdded AddResult = iota
+	// ProviderRefreshed means an existing record got its expiry extended.
+	// Unless MinRefreshInterval or RecordLimits is set, refreshes of records
+	// that aren't cached are reported as ProviderAdded.
+	ProviderRefreshed
+	// ProviderRefreshThrottled means an existing record was left as is as it
+	// was refreshed too recently. See MinRefreshInterval.
+	ProviderRefreshThrottled
+)
+
+// MinRefreshInterval limits how often a peer (other than ourselves) can
+// refresh one of its provider records. Refreshes coming sooner than the given
+// interval after the previous one are ignored, sparing a datastore write.
+//
+// Defaults to 0 (always refresh).
+func MinRefreshInterval(d time.Duration) Option {
+	return func(pm *ProviderManager) {
+		pm.minRefreshInterval = d
+	}
+}
+
+// ReadOnly makes the provider manager serve provider records straight from a
+// datastore written to by someone else, e.g. another node sharing it. Adding
+// providers fails with ErrReadOnly, records aren't garbage collected and
+// nothing is cached, so records written by the other node are visible
+// immediately.
+func ReadOnly() Option {
+	return func(pm *ProviderManager) {
+		pm.readOnly = true
+	}
 }
 
 type getProv struct {
 	k    cid.Cid
-	resp chan []peer.ID
+	resp chan getProvResp
+
+	// withExpiry asks for the expiry time of each record.
+	withExpiry bool
 }
 
-func NewProviderManager(ctx context.Context, local peer.ID, dstore ds.Batching) *ProviderManager {
+type getProvResp struct {
+	provs   []peer.ID
+	expires []time.Time
+	err     error
+}
+
+func NewProviderManager(ctx context.Context, local peer.ID, dstore ds.Batching, opts ...Option) *ProviderManager {
 	pm := new(ProviderManager)
+	pm.local = local
 	pm.getprovs = make(chan *getProv)
 	pm.newprovs = make(chan *addProv)
 	pm.dstore = autobatch.NewAutoBatching(dstore, batchBufferSize)
@@ -67,7 +177,25 @@ func NewProviderManager(ctx context.Context, local peer.ID, dstore ds.Batching)
 	}
 	pm.providers = cache
 
-	pm.proc = goprocessctx.WithContext(ctx)
+	limitHits, err := tslru.New(limitHitsCacheSize)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	pm.limitHits = limitHits
+	pm.recencyWeight = 1
+	pm.distanceWeight = 1
+
+	for _, opt := range opts {
+		opt(pm)
+	}
+	if pm.hardLimit > 0 && pm.hardLimit < pm.softLimit {
+		pm.hardLimit = pm.softLimit
+	}
+	if pm.maxRecordsPerPeer > 0 {
+		pm.peerRecords = make(map[peer.ID]map[string]time.Time)
+	}
+
+	pm.proc = goprocessctx.WithContextAndTeardown(ctx, pm.dstore.Flush)
 	pm.cleanupInterval = defaultCleanupInterval
 	pm.proc.Go(pm.run)
 
@@ -92,7 +220,37 @@ func (pm *ProviderManager) providersForKey(k cid.Cid) ([]peer.ID, error) {
 	return pset.providers, nil
 }
 
+// providersWithExpiry returns a copy of the unexpired providers for the given
+// key along with the time their records expire.
+func (pm *ProviderManager) providersWithExpiry(k cid.Cid) getProvResp {
+	pset, err := pm.getProvSet(k)
+	if err == ds.ErrNotFound {
+		err = nil
+	}
+	if err != nil {
+		log.Error("error reading providers: ", err)
+		return getProvResp{err: err}
+	}
+
+	now := time.Now()
+	var resp getProvResp
+	for _, p := range pset.providers {
+		expires := pset.set[p].Add(ProvideValidity)
+		if !expires.After(now) {
+			// the cache may still hold records the GC hasn't removed yet.
+			continue
+		}
+		resp.provs = append(resp.provs, p)
+		resp.expires = append(resp.expires, expires)
+	}
+	return resp
+}
+
 func (pm *ProviderManager) getProvSet(k cid.Cid) (*providerSet, error) {
+	if pm.readOnly {
+		return loadProvSet(pm.dstore, k)
+	}
+
 	cached, ok := pm.providers.Get(k)
 	if ok {
 		return cached.(*providerSet), nil
@@ -174,13 +332,169 @@ func readTimeValue(data []byte) (time.Time, error) {
 	return time.Unix(0, nsec), nil
 }
 
-func (pm *ProviderManager) addProv(k cid.Cid, p peer.ID) error {
+func (pm *ProviderManager) addProv(k cid.Cid, p peer.ID) (AddResult, error) {
+	if pm.readOnly {
+		return ProviderAdded, ErrReadOnly
+	}
 	now := time.Now()
+	result := ProviderAdded
+	if last, ok := pm.lastUpdated(k, p); ok && now.Sub(last) <= ProvideValidity {
+		if p != pm.local && now.Sub(last) < pm.minRefreshInterval {
+			return ProviderRefreshThrottled, nil
+		}
+		result = ProviderRefreshed
+	}
+	if result == ProviderAdded && p != pm.local && pm.hardLimit > 0 && pm.numRecords >= pm.hardLimit {
+		return result, ErrStoreFull
+	}
+
+	if !pm.trackRecord(mkProvKeyFor(k, p), p, now) {
+		pm.recordLimitHit(p)
+		return result, ErrTooManyRecords
+	}
 	if provs, ok := pm.providers.Get(k); ok {
 		provs.(*providerSet).setVal(p, now)
 	} // else not cached, just write through
 
-	return writeProviderEntry(pm.dstore, k, p, now)
+	err := writeProviderEntry(pm.dstore, k, p, now)
+	if err != nil {
+		// Keep the record around in the cache so callers that choose to
+		// tolerate datastore errors can still serve it.
+		if _, ok := pm.providers.Get(k); !ok {
+			pset := newProviderSet()
+			pset.setVal(p, now)
+			pm.providers.Add(k, pset)
+		}
+	}
+	return result, err
+}
+
+// lastUpdated returns when p last updated its provider record for k, if it
+// has one. Records that aren't cached are only looked up in the datastore when
+// refreshes are throttled or record limits are set, otherwise they are
+// reported as missing.
+func (pm *ProviderManager) lastUpdated(k cid.Cid, p peer.ID) (time.Time, bool) {
+	if provs, ok := pm.providers.Get(k); ok {
+		t, ok := provs.(*providerSet).set[p]
+		return t, ok
+	}
+	if pm.minRefreshInterval <= 0 && pm.softLimit <= 0 && pm.hardLimit <= 0 {
+		return time.Time{}, false
+	}
+	data, err := pm.dstore.Get(ds.NewKey(mkProvKeyFor(k, p)))
+	if err != nil {
+		if err != ds.ErrNotFound {
+			log.Warning("failed to read provider record: ", err)
+		}
+		return time.Time{}, false
+	}
+	t, err := readTimeValue(data)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// trackRecord records that the provider record stored under dsk was last
+// updated by p at time t. It returns false if p has already reached the
+// per-peer record limit and the record is a new one.
+func (pm *ProviderManager) trackRecord(dsk string, p peer.ID, t time.Time) bool {
+	if pm.peerRecords == nil || p == pm.local {
+		return true
+	}
+	recs, ok := pm.peerRecords[p]
+	if !ok {
+		recs = make(map[string]time.Time)
+		pm.peerRecords[p] = recs
+	}
+	if _, ok := recs[dsk]; !ok && len(recs) >= pm.maxRecordsPerPeer {
+		// Forget the records that have expired since (they get removed
+		// from the datastore lazily) and check again.
+		for k, rt := range recs {
+			if t.Sub(rt) > ProvideValidity {
+				delete(recs, k)
+			}
+		}
+		if len(recs) >= pm.maxRecordsPerPeer {
+			return false
+		}
+	}
+	recs[dsk] = t
+	return true
+}
+
+// untrackRecord forgets the provider record of p stored under dsk, once it's
+// been removed from the datastore.
+func (pm *ProviderManager) untrackRecord(dsk string, p peer.ID) {
+	recs, ok := pm.peerRecords[p]
+	if !ok {
+		return
+	}
+	delete(recs, dsk)
+	if len(recs) == 0 {
+		delete(pm.peerRecords, p)
+	}
+}
+
+// recordPeer returns the providing peer of the record stored under dsk.
+func recordPeer(dsk string) (peer.ID, bool) {
+	lix := strings.LastIndex(dsk, "/")
+	decstr, err := base32.RawStdEncoding.DecodeString(dsk[lix+1:])
+	if err != nil {
+		return "", false
+	}
+	return peer.ID(decstr), true
+}
+
+func (pm *ProviderManager) recordLimitHit(p peer.ID) {
+	hits := 1
+	if v, ok := pm.limitHits.Get(p); ok {
+		hits += v.(int)
+	}
+	pm.limitHits.Add(p, hits)
+}
+
+// LimitHits returns how many times each peer was denied storing a provider
+// record because it hit the per-peer record limit (see MaxRecordsPerPeer).
+// Only the most recent offenders are remembered.
+func (pm *ProviderManager) LimitHits() map[peer.ID]int {
+	out := make(map[peer.ID]int)
+	for _, k := range pm.limitHits.Keys() {
+		if v, ok := pm.limitHits.Peek(k); ok {
+			out[k.(peer.ID)] = v.(int)
+		}
+	}
+	return out
+}
+
+// loadPeerRecords initializes the per-peer record tracking from the records
+// already in the datastore.
+func (pm *ProviderManager) loadPeerRecords() error {
+	res, err := pm.dstore.Query(dsq.Query{Prefix: providersKeyPrefix})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for {
+		e, ok := res.NextSync()
+		if !ok {
+			return nil
+		}
+		if e.Error != nil {
+			return e.Error
+		}
+		t, err := readTimeValue(e.Value)
+		if err != nil {
+			// will be cleaned up by the GC.
+			continue
+		}
+		p, ok := recordPeer(e.Key)
+		if !ok {
+			continue
+		}
+		pm.trackRecord(e.Key, p, t)
+	}
 }
 
 func mkProvKeyFor(k cid.Cid, p peer.ID) string {
@@ -200,43 +514,94 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 	var (
 		gcQuery    dsq.Results
 		gcQueryRes <-chan dsq.Result
-		gcSkip     map[string]struct{}
+		gcSkip     map[string]bool // updated records, true if added during the round
 		gcTime     time.Time
 		gcTimer    = time.NewTimer(pm.cleanupInterval)
+
+		// used when record limits are set.
+		limited = pm.softLimit > 0 || pm.hardLimit > 0
+		gcKept  int // records found by the query, except those added during the round
+		gcAdded int // records added during the round
+		gcCands []evictionCandidate
 	)
 
+	if pm.readOnly {
+		// whoever writes to the datastore is in charge of the GC.
+		gcTimer.Stop()
+	}
+
+	if pm.peerRecords != nil {
+		if err := pm.loadPeerRecords(); err != nil {
+			log.Error("failed to load the provider records per peer: ", err)
+		}
+	}
+	if limited {
+		n, err := pm.countRecords()
+		if err != nil {
+			log.Error("failed to count the provider records: ", err)
+		}
+		pm.numRecords = n
+	}
+
 	defer func() {
 		gcTimer.Stop()
 		if gcQuery != nil {
 			// don't really care if this fails.
 			_ = gcQuery.Close()
 		}
-		if err := pm.dstore.Flush(); err != nil {
-			log.Error("failed to flush datastore: ", err)
-		}
+		// the datastore is flushed when the process is torn down.
 	}()
 
 	for {
 		select {
 		case np := <-pm.newprovs:
-			err := pm.addProv(np.k, np.val)
+			result, err := pm.addProv(np.k, np.val)
+			np.resp <- addProvResp{result: result, err: err}
+			if err == ErrStoreFull && gcQuery == nil && time.Since(gcTime) >= minForcedGCInterval {
+				// don't wait for the next GC round to make room.
+				gcTimer.Stop()
+				gcTimer.Reset(0)
+			}
+			if err == ErrTooManyRecords || err == ErrReadOnly || err == ErrStoreFull {
+				log.Debugf("rejecting provider record for %s from %s: %s", np.k, np.val, err)
+				continue
+			}
 			if err != nil {
 				log.Error("error adding new providers: ", err)
 				continue
 			}
+			if result == ProviderRefreshThrottled {
+				continue
+			}
+			if result == ProviderAdded {
+				pm.numRecords++
+			}
 			if gcSkip != nil {
 				// we have an gc, tell it to skip this provider
 				// as we've updated it since the GC started.
-				gcSkip[mkProvKeyFor(np.k, np.val)] = struct{}{}
+				dsk := mkProvKeyFor(np.k, np.val)
+				if result == ProviderAdded {
+					gcSkip[dsk] = true
+					gcAdded++
+				} else if _, ok := gcSkip[dsk]; !ok {
+					gcSkip[dsk] = false
+				}
 			}
 		case gp := <-pm.getprovs:
+			if gp.withExpiry {
+				gp.resp <- pm.providersWithExpiry(gp.k)
+				continue
+			}
 			provs, err := pm.providersForKey(gp.k)
-			if err != nil && err != ds.ErrNotFound {
+			if err == ds.ErrNotFound {
+				err = nil
+			}
+			if err != nil {
 				log.Error("error reading providers: ", err)
 			}
 
 			// set the cap so the user can't append to this.
-			gp.resp <- provs[0:len(provs):len(provs)]
+			gp.resp <- getProvResp{provs: provs[0:len(provs):len(provs)], err: err}
 		case res, ok := <-gcQueryRes:
 			if !ok {
 				if err := gcQuery.Close(); err != nil {
@@ -244,19 +609,35 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 				}
 				gcTimer.Reset(pm.cleanupInterval)
 
+				if limited {
+					// records added during the round may or may
+					// not have been found by the query.
+					pm.numRecords = gcKept + gcAdded
+					if pm.softLimit > 0 && pm.numRecords > pm.softLimit {
+						pm.numRecords -= pm.evict(gcCands, pm.numRecords-pm.softLimit, gcSkip)
+					}
+				}
+
 				// cleanup GC round
 				gcQueryRes = nil
 				gcSkip = nil
 				gcQuery = nil
+				gcKept = 0
+				gcAdded = 0
+				gcCands = nil
 				continue
 			}
 			if res.Error != nil {
 				log.Error("got error from GC query: ", res.Error)
 				continue
 			}
-			if _, ok := gcSkip[res.Key]; ok {
+			if added, ok := gcSkip[res.Key]; ok {
 				// We've updated this record since starting the
-				// GC round, skip it.
+				// GC round, skip it. It still counts, unless it's
+				// counted as added during the round.
+				if limited && !added {
+					gcKept++
+				}
 				continue
 			}
 
@@ -272,6 +653,19 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 				err = pm.dstore.Delete(ds.RawKey(res.Key))
 				if err != nil && err != ds.ErrNotFound {
 					log.Warning("failed to remove provider record from disk: ", err)
+					continue
+				}
+				if p, ok := recordPeer(res.Key); ok {
+					pm.untrackRecord(res.Key, p)
+				}
+				continue
+			}
+			if limited {
+				gcKept++
+			}
+			if pm.softLimit > 0 {
+				if c, ok := pm.evictionCandidate(res.Key, t, gcTime); ok {
+					gcCands = append(gcCands, c)
 				}
 			}
 
@@ -292,7 +686,7 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 			}
 			gcQuery = q
 			gcQueryRes = q.Next()
-			gcSkip = make(map[string]struct{})
+			gcSkip = make(map[string]bool)
 		case <-proc.Closing():
 			return
 		}
@@ -300,34 +694,84 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 }
 
 // AddProvider adds a provider.
-func (pm *ProviderManager) AddProvider(ctx context.Context, k cid.Cid, val peer.ID) {
+//
+// It returns the error returned by the datastore when the provider record
+// couldn't be persisted. In that case, the record is still kept in the
+// in-memory cache.
+func (pm *ProviderManager) AddProvider(ctx context.Context, k cid.Cid, val peer.ID) error {
+	_, err := pm.AddProviderRecord(ctx, k, val)
+	return err
+}
+
+// AddProviderRecord is like AddProvider but also tells whether the record was
+// a new one or a refresh of an existing one.
+func (pm *ProviderManager) AddProviderRecord(ctx context.Context, k cid.Cid, val peer.ID) (AddResult, error) {
 	prov := &addProv{
-		k:   k,
-		val: val,
+		k:    k,
+		val:  val,
+		resp: make(chan addProvResp, 1), // buffered to prevent sender from blocking
 	}
 	select {
 	case pm.newprovs <- prov:
 	case <-ctx.Done():
+		return ProviderAdded, ctx.Err()
+	}
+	select {
+	case r := <-prov.resp:
+		return r.result, r.err
+	case <-ctx.Done():
+		return ProviderAdded, ctx.Err()
 	}
 }
 
 // GetProviders returns the set of providers for the given key.
 // This method _does not_ copy the set. Do not modify it.
 func (pm *ProviderManager) GetProviders(ctx context.Context, k cid.Cid) []peer.ID {
+	provs, _ := pm.GetProvidersWithError(ctx, k)
+	return provs
+}
+
+// GetProvidersWithError is like GetProviders but also returns the error
+// returned by the datastore, if any. The returned providers are whatever could
+// be served regardless of the error (e.g. from the cache).
+// This method _does not_ copy the set. Do not modify it.
+func (pm *ProviderManager) GetProvidersWithError(ctx context.Context, k cid.Cid) ([]peer.ID, error) {
 	gp := &getProv{
 		k:    k,
-		resp: make(chan []peer.ID, 1), // buffered to prevent sender from blocking
+		resp: make(chan getProvResp, 1), // buffered to prevent sender from blocking
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case pm.getprovs <- gp:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-gp.resp:
+		return r.provs, r.err
+	}
+}
+
+// GetProvidersWithExpiry returns the unexpired providers for the given key
+// along with the time each of their records expires, in the same order.
+// Unlike GetProviders, the returned slices are copies.
+func (pm *ProviderManager) GetProvidersWithExpiry(ctx context.Context, k cid.Cid) ([]peer.ID, []time.Time, error) {
+	gp := &getProv{
+		k:          k,
+		resp:       make(chan getProvResp, 1), // buffered to prevent sender from blocking
+		withExpiry: true,
 	}
 	select {
 	case <-ctx.Done():
-		return nil
+		return nil, nil, ctx.Err()
 	case pm.getprovs <- gp:
 	}
 	select {
 	case <-ctx.Done():
-		return nil
-	case peers := <-gp.resp:
-		return peers
+		return nil, nil, ctx.Err()
+	case r := <-gp.resp:
+		return r.provs, r.expires, r.err
 	}
 }
 
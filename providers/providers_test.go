@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 
 	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/failstore"
 	dsq "github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	u "github.com/ipfs/go-ipfs-util"
@@ -301,3 +304,434 @@ func TestWriteUpdatesCache(t *testing.T) {
 		t.Fatalf("expected c1 to be provided by 2 peers, is by %d", len(c1Provs))
 	}
 }
+
+func TestDatastoreErrors(t *testing.T) {
+	old := batchBufferSize
+	batchBufferSize = 0
+	defer func() { batchBufferSize = old }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errFailed := fmt.Errorf("failed")
+	fstore := failstore.NewFailstore(ds.NewMapDatastore(), func(op string) error {
+		switch op {
+		case "query", "batch":
+			return errFailed
+		}
+		return nil
+	})
+
+	p1 := peer.ID("a")
+	c1 := cid.NewCidV1(cid.DagCBOR, u.Hash([]byte("1")))
+	c2 := cid.NewCidV1(cid.DagCBOR, u.Hash([]byte("2")))
+	pm := NewProviderManager(ctx, p1, fstore)
+	defer pm.proc.Close()
+
+	if err := pm.AddProvider(ctx, c1, p1); err != errFailed {
+		t.Fatalf("expected the datastore error, got: %v", err)
+	}
+
+	// the provider record should still be served from the cache.
+	c1Provs, err := pm.GetProvidersWithError(ctx, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c1Provs) != 1 || c1Provs[0] != p1 {
+		t.Fatalf("expected c1 to be provided by %s, got %v", p1, c1Provs)
+	}
+
+	if _, err := pm.GetProvidersWithError(ctx, c2); err != errFailed {
+		t.Fatalf("expected the datastore error, got: %v", err)
+	}
+	if provs := pm.GetProviders(ctx, c2); len(provs) != 0 {
+		t.Fatalf("expected no providers for c2, got %v", provs)
+	}
+}
+
+func TestMaxRecordsPerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, p1, p2 := peer.ID("local"), peer.ID("a"), peer.ID("b")
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+
+	// p1 is already storing a record.
+	c0 := cid.NewCidV0(u.Hash([]byte("0")))
+	if err := writeProviderEntry(dstore, c0, p1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	pm := NewProviderManager(ctx, local, dstore, MaxRecordsPerPeer(2))
+	defer pm.proc.Close()
+
+	var cids []cid.Cid
+	for i := 1; i <= 3; i++ {
+		cids = append(cids, cid.NewCidV0(u.Hash([]byte(fmt.Sprint(i)))))
+	}
+
+	if err := pm.AddProvider(ctx, cids[0], p1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.AddProvider(ctx, cids[1], p1); err != ErrTooManyRecords {
+		t.Fatalf("expected ErrTooManyRecords, got: %v", err)
+	}
+	// refreshing an existing record is fine.
+	if err := pm.AddProvider(ctx, c0, p1); err != nil {
+		t.Fatal(err)
+	}
+	// other peers aren't affected.
+	if err := pm.AddProvider(ctx, cids[1], p2); err != nil {
+		t.Fatal(err)
+	}
+	// we aren't limited.
+	for _, c := range cids {
+		if err := pm.AddProvider(ctx, c, local); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if provs := pm.GetProviders(ctx, cids[1]); len(provs) != 2 {
+		t.Fatalf("expected 2 providers for cid 1, got %v", provs)
+	}
+	if hits := pm.LimitHits(); len(hits) != 1 || hits[p1] != 1 {
+		t.Fatalf("expected a single limit hit from %s, got %v", p1, hits)
+	}
+}
+
+func TestMaxRecordsPerPeerExpire(t *testing.T) {
+	pval := ProvideValidity
+	cleanup := defaultCleanupInterval
+	ProvideValidity = time.Second / 4
+	defaultCleanupInterval = time.Second / 4
+	defer func() {
+		ProvideValidity = pval
+		defaultCleanupInterval = cleanup
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm := NewProviderManager(ctx, peer.ID("local"), dssync.MutexWrap(ds.NewMapDatastore()), MaxRecordsPerPeer(2))
+	for i := 0; i < 10; i++ {
+		c := cid.NewCidV0(u.Hash([]byte(fmt.Sprint(i))))
+		if err := pm.AddProvider(ctx, c, peer.ID(fmt.Sprint("peer", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Second)
+
+	// Stop to prevent data races
+	pm.Process().Close()
+
+	if len(pm.peerRecords) != 0 {
+		t.Fatalf("expected the expired records to be forgotten, still tracking %d peers", len(pm.peerRecords))
+	}
+}
+
+func TestGetProvidersWithExpiry(t *testing.T) {
+	pval := ProvideValidity
+	defer func() { ProvideValidity = pval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewProviderManager(ctx, peer.ID("testing"), dssync.MutexWrap(ds.NewMapDatastore()))
+	defer p.proc.Close()
+
+	a := cid.NewCidV0(u.Hash([]byte("test")))
+	before := time.Now()
+	if err := p.AddProvider(ctx, a, peer.ID("testingprovider")); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	provs, expires, err := p.GetProvidersWithExpiry(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provs) != 1 || len(expires) != 1 || provs[0] != peer.ID("testingprovider") {
+		t.Fatalf("expected a single provider, got %v", provs)
+	}
+	if expires[0].Before(before.Add(ProvideValidity)) || expires[0].After(after.Add(ProvideValidity)) {
+		t.Fatalf("unexpected expiry time %s", expires[0])
+	}
+
+	// Expired records still in the cache must not be returned.
+	ProvideValidity = 0
+	provs, _, err = p.GetProvidersWithExpiry(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provs) != 0 {
+		t.Fatalf("expected no unexpired providers, got %v", provs)
+	}
+}
+
+func TestProviderRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	local := peer.ID("testing")
+	p := NewProviderManager(ctx, local, dstore, MinRefreshInterval(time.Hour))
+	defer p.proc.Close()
+
+	a := cid.NewCidV0(u.Hash([]byte("test")))
+	for i, expected := range []AddResult{ProviderAdded, ProviderRefreshThrottled, ProviderRefreshThrottled} {
+		result, err := p.AddProviderRecord(ctx, a, peer.ID("provider"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != expected {
+			t.Fatalf("add %d: expected result %d, got %d", i, expected, result)
+		}
+	}
+	if provs := p.GetProviders(ctx, a); len(provs) != 1 {
+		t.Fatalf("expected a single provider, got %v", provs)
+	}
+
+	// we can always refresh our own records.
+	for i, expected := range []AddResult{ProviderAdded, ProviderRefreshed} {
+		result, err := p.AddProviderRecord(ctx, a, local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != expected {
+			t.Fatalf("local add %d: expected result %d, got %d", i, expected, result)
+		}
+	}
+
+	// refreshes are detected even when the record isn't cached.
+	p.providers.Purge()
+	b := cid.NewCidV0(u.Hash([]byte("other")))
+	if _, err := p.AddProviderRecord(ctx, b, local); err != nil {
+		t.Fatal(err)
+	}
+	p.providers.Purge()
+	if result, _ := p.AddProviderRecord(ctx, b, local); result != ProviderRefreshed {
+		t.Fatalf("expected the uncached record to be refreshed, got %d", result)
+	}
+}
+
+func TestNoLookupWithoutRefreshLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var gets int32
+	fstore := failstore.NewFailstore(ds.NewMapDatastore(), func(op string) error {
+		if op == "get" {
+			atomic.AddInt32(&gets, 1)
+		}
+		return nil
+	})
+	p := NewProviderManager(ctx, peer.ID("testing"), fstore)
+	defer p.proc.Close()
+
+	a := cid.NewCidV0(u.Hash([]byte("test")))
+	for i := 0; i < 2; i++ {
+		p.providers.Purge()
+		result, err := p.AddProviderRecord(ctx, a, peer.ID("provider"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != ProviderAdded {
+			t.Fatalf("add %d: expected result %d, got %d", i, ProviderAdded, result)
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Fatalf("expected no datastore lookups, got %d", n)
+	}
+}
+
+func TestRecordLimits(t *testing.T) {
+	forced := minForcedGCInterval
+	minForcedGCInterval = 0
+	defer func() { minForcedGCInterval = forced }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, remote := peer.ID("local"), peer.ID("remote")
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	pm := NewProviderManager(ctx, local, dstore, RecordLimits(4, 6), EvictionWeights(0, 1))
+	defer pm.proc.Close()
+
+	var cids []cid.Cid
+	for i := 0; i < 8; i++ {
+		cids = append(cids, cid.NewCidV0(u.Hash([]byte(fmt.Sprint(i)))))
+	}
+	for _, c := range cids[:5] {
+		if err := pm.AddProvider(ctx, c, remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pm.AddProvider(ctx, cids[5], local); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store is full: refreshes and our own records are still accepted.
+	if err := pm.AddProvider(ctx, cids[6], remote); err != ErrStoreFull {
+		t.Fatalf("expected ErrStoreFull, got %v", err)
+	}
+	if err := pm.AddProvider(ctx, cids[0], remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.AddProvider(ctx, cids[7], local); err != nil {
+		t.Fatal(err)
+	}
+
+	// the GC started early keeps the 2 remote records closest to us, along
+	// with our own, making room for one more.
+	sorted := append([]cid.Cid{}, cids[:5]...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return pm.keyDistance(sorted[i].Bytes()) < pm.keyDistance(sorted[j].Bytes())
+	})
+	expected := map[string]bool{
+		mkProvKeyFor(sorted[0], remote): true,
+		mkProvKeyFor(sorted[1], remote): true,
+		mkProvKeyFor(cids[5], local):    true,
+		mkProvKeyFor(cids[7], local):    true,
+	}
+	var err error
+	for i := 0; i < 100; i++ {
+		// there's room again once the GC is done.
+		time.Sleep(10 * time.Millisecond)
+		if err = pm.AddProvider(ctx, cids[6], remote); err != ErrStoreFull {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected[mkProvKeyFor(cids[6], remote)] = true
+
+	// flush the datastore.
+	pm.proc.Close()
+	stored := storedProvKeys(t, dstore)
+	if len(stored) != len(expected) {
+		t.Fatalf("expected %d records left, got %d", len(expected), len(stored))
+	}
+	for _, k := range stored {
+		if !expected[k] {
+			t.Fatalf("unexpected record left: %s", k)
+		}
+	}
+}
+
+// gcGatedStore hands the results of the GC queries over to the test.
+type gcGatedStore struct {
+	ds.Batching
+	queries chan []dsq.Entry
+	results chan dsq.Result
+}
+
+func (s *gcGatedStore) Query(q dsq.Query) (dsq.Results, error) {
+	if q.KeysOnly {
+		return s.Batching.Query(q)
+	}
+	res, err := s.Batching.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	s.queries <- entries
+	return dsq.ResultsWithChan(q, s.results), nil
+}
+
+func TestRecordCountDuringGC(t *testing.T) {
+	cleanup := defaultCleanupInterval
+	defaultCleanupInterval = 10 * time.Millisecond
+	defer func() { defaultCleanupInterval = cleanup }()
+	old := batchBufferSize
+	batchBufferSize = 0
+	defer func() { batchBufferSize = old }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	remote := peer.ID("remote")
+	store := &gcGatedStore{
+		Batching: dssync.MutexWrap(ds.NewMapDatastore()),
+		queries:  make(chan []dsq.Entry, 1),
+		results:  make(chan dsq.Result),
+	}
+	var cids []cid.Cid
+	for i := 0; i < 3; i++ {
+		cids = append(cids, cid.NewCidV0(u.Hash([]byte(fmt.Sprint(i)))))
+	}
+	for _, c := range cids[:2] {
+		if err := writeProviderEntry(store, c, remote, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pm := NewProviderManager(ctx, peer.ID("local"), store, RecordLimits(100, 100))
+	entries := <-store.queries
+	// no more rounds, the next one would count the records again.
+	pm.cleanupInterval = time.Hour
+	if len(entries) != 2 {
+		t.Fatalf("expected the GC to find 2 records, got %d", len(entries))
+	}
+
+	// refreshed before the GC gets to it.
+	if err := pm.AddProvider(ctx, cids[1], remote); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		store.results <- dsq.Result{Entry: e}
+	}
+	// refreshed after the GC got to it, and a new record.
+	if err := pm.AddProvider(ctx, cids[0], remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.AddProvider(ctx, cids[2], remote); err != nil {
+		t.Fatal(err)
+	}
+	close(store.results)
+	time.Sleep(50 * time.Millisecond)
+
+	// Stop to prevent data races
+	pm.proc.Close()
+	if pm.numRecords != 3 {
+		t.Fatalf("expected 3 records, counted %d", pm.numRecords)
+	}
+}
+
+func TestEvictionScore(t *testing.T) {
+	pm := &ProviderManager{local: "local", recencyWeight: 1}
+	now := time.Now()
+	c := cid.NewCidV0(u.Hash([]byte("0")))
+	dsk := mkProvKeyFor(c, "remote")
+
+	fresh, ok := pm.evictionCandidate(dsk, now, now)
+	if !ok {
+		t.Fatal("expected a candidate")
+	}
+	old, _ := pm.evictionCandidate(dsk, now.Add(-ProvideValidity/2), now)
+	if old.score <= fresh.score {
+		t.Fatalf("expected older records to score higher, got %v and %v", old.score, fresh.score)
+	}
+	if _, ok := pm.evictionCandidate(mkProvKeyFor(c, "local"), now, now); ok {
+		t.Fatal("our own records can't be evicted")
+	}
+}
+
+func storedProvKeys(t *testing.T, dstore ds.Datastore) []string {
+	res, err := dstore.Query(dsq.Query{Prefix: providersKeyPrefix, KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	return keys
+}
@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ProvideToPeers announces that we can provide the given key to the given
+// peers only, e.g. dedicated content indexers, instead of the closest peers to
+// the key. Call Provide as well to also announce it to the closest peers. The
+// peers are dialed if we aren't connected to them, so their addresses should
+// already be known to the peerstore.
+//
+// It returns, for each peer, nil if the record was delivered to it or the
+// error sending it. As with ProvideTraced, peers don't acknowledge the record,
+// so one delivered may still be dropped. An error is only returned, before
+// anything is sent, if the key can't be announced at all, e.g. because we
+// don't know our own addresses.
+func (dht *IpfsDHT) ProvideToPeers(ctx context.Context, key cid.Cid, peers []peer.ID) (_ map[peer.ID]error, err error) {
+	eip := logger.EventBegin(ctx, "ProvideToPeers", key, logging.LoggableMap{"peers": len(peers)})
+	defer func() {
+		if err != nil {
+			eip.SetError(err)
+		}
+		eip.Done()
+	}()
+
+	if dht.replica {
+		return nil, ErrReadOnlyReplica
+	}
+
+	// add self locally, as Provide does.
+	err = dht.providers.AddProvider(ctx, key, dht.self)
+	if err := dht.checkProviderDatastoreError(err); err != nil {
+		return nil, err
+	}
+
+	mes, err := dht.makeProvRecord(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// dedup the peers before sending, results is written to concurrently.
+	results := make(map[peer.ID]error, len(peers))
+	targets := make([]peer.ID, 0, len(peers))
+	for _, p := range peers {
+		if _, ok := results[p]; ok {
+			continue
+		}
+		results[p] = nil
+		if p != dht.self { // already stored above.
+			targets = append(targets, p)
+		}
+	}
+
+	var resultsLk sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range targets {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			logger.Debugf("putProvider(%s, %s)", key, p)
+			err := dht.sendMessage(ctx, p, mes)
+			if err != nil {
+				logger.Debug(err)
+				resultsLk.Lock()
+				results[p] = err
+				resultsLk.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return results, nil
+}
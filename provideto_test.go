@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+func TestProvideToPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	a, indexer, other := dhts[0], dhts[1], dhts[2]
+	connect(t, ctx, a, other)
+	// we aren't connected to the indexer, only know its addresses.
+	a.peerstore.AddAddrs(indexer.self, indexer.host.Addrs(), peerstore.TempAddrTTL)
+	unknown := test.RandPeerIDFatal(t)
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	key := testCaseCids[0]
+	results, err := a.ProvideToPeers(ctxT, key, []peer.ID{indexer.self, unknown, indexer.self})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected a result per peer, got %v", results)
+	}
+	if err := results[indexer.self]; err != nil {
+		t.Fatalf("expected the record to be delivered to the indexer, got %s", err)
+	}
+	if results[unknown] == nil {
+		t.Fatal("expected the record not to be delivered to an unknown peer")
+	}
+
+	if provs := a.providers.GetProviders(ctx, key); len(provs) != 1 || provs[0] != a.self {
+		t.Fatalf("expected to provide the key locally, got %v", provs)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(indexer.providers.GetProviders(ctx, key)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the indexer to store the record")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if provs := other.providers.GetProviders(ctx, key); len(provs) != 0 {
+		t.Fatalf("expected the record not to be sent to other peers, got %v", provs)
+	}
+}
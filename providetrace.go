@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ProvideTrace records the steps of a single announcement of a provider
+// record, see ProvideTraced.
+type ProvideTrace struct {
+	// Closest are the closest peers to the key found by the lookup, closest
+	// first. They're all sent the record.
+	Closest []peer.ID
+
+	// Sends has an entry for each ADD_PROVIDER message sent, including to the
+	// random peers of the ProvideExtraFanout option, in the order they
+	// completed.
+	Sends []ProvideSend
+
+	// Stats are the totals, as returned by ProvideWithStats.
+	Stats ProvideStats
+
+	// Concurrency is how many RPCs the lookup for the closest peers actually
+	// had in flight, to compare with the configured concurrency.
+	Concurrency QueryConcurrencyStats
+
+	// Duration is how long the whole announcement took.
+	Duration time.Duration
+}
+
+// ProvideSend is the outcome of sending a provider record to a single peer.
+//
+// Peers don't acknowledge ADD_PROVIDER messages, so a nil Err only means the
+// record was delivered. The peer may still drop it, e.g. if we have too many
+// records with it (see the MaxProviderRecordsPerPeer option).
+type ProvideSend struct {
+	Peer     peer.ID
+	Random   bool  // sent because of the ProvideExtraFanout option
+	Err      error // nil if the record was delivered
+	Duration time.Duration
+}
+
+// Delivered returns the number of peers the record was delivered to.
+func (t *ProvideTrace) Delivered() int {
+	return t.Stats.ClosestAccepted + t.Stats.RandomAccepted
+}
+
+// ProvideTraced announces that we can provide the given key, like Provide with
+// brdcst set, and reports each step along the way. Regular provides don't pay
+// for the tracing.
+//
+// The trace is returned even if the announcement failed, with whatever steps
+// were completed.
+func (dht *IpfsDHT) ProvideTraced(ctx context.Context, key cid.Cid) (ProvideTrace, error) {
+	var trace ProvideTrace
+	start := time.Now()
+	stats, err := dht.provide(ctx, key, true, &trace)
+	trace.Stats = stats
+	trace.Duration = time.Since(start)
+	return trace, err
+}
@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProvideTraced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	trace, err := dhts[0].ProvideTraced(ctxT, testCaseCids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trace.Closest) != 3 {
+		t.Fatalf("expected 3 closest peers, got %d", len(trace.Closest))
+	}
+	if len(trace.Sends) != 3 {
+		t.Fatalf("expected 3 sends, got %d", len(trace.Sends))
+	}
+	for _, s := range trace.Sends {
+		if s.Err != nil || s.Random {
+			t.Fatalf("unexpected send to %s: %v", s.Peer, s.Err)
+		}
+	}
+	if trace.Delivered() != 3 || trace.Stats.ClosestSent != 3 {
+		t.Fatalf("expected the record to be delivered to 3 peers, got %+v", trace.Stats)
+	}
+	// the lookup can't have more RPCs in flight than there are peers.
+	if c := trace.Concurrency; c.Peak < 1 || c.Peak > 3 || c.Average <= 0 || c.Average > float64(c.Peak) {
+		t.Fatalf("unexpected lookup concurrency: %+v", c)
+	}
+	if trace.Duration <= 0 {
+		t.Fatal("expected the trace to be timed")
+	}
+}
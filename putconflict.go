@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+)
+
+// PutConflictAction says what PutValue does when one of the closest peers
+// already holds a newer record than the one being put.
+type PutConflictAction int
+
+const (
+	// PutConflictProceed puts our record anyway. Peers holding the newer
+	// record will usually refuse it.
+	PutConflictProceed PutConflictAction = iota
+	// PutConflictAbort stops the put before anything is stored, locally or
+	// remotely, and returns a *NewerRecordError.
+	PutConflictAbort
+	// PutConflictMerge puts the value returned by the policy's Merge
+	// callback instead.
+	PutConflictMerge
+)
+
+// PutValueConflictPolicy configures how PutValue handles newer records found
+// on the closest peers, see OnPutValueConflict.
+type PutValueConflictPolicy struct {
+	Action PutConflictAction
+
+	// Merge is called with the value being put and the newest remote value
+	// when Action is PutConflictMerge. It returns the value to put instead,
+	// which must pass validation. Returning an error aborts the put.
+	Merge func(key string, ours, newer []byte) ([]byte, error)
+}
+
+// NewerRecordError is returned by PutValue when the put was aborted because
+// a peer already holds a newer record for the key, or once the put is done
+// when one of the closest peers refused our record and answered with the
+// newer one it holds (see opts.ReturnNewerRecordOnStalePut).
+type NewerRecordError struct {
+	Key    string
+	Peer   peer.ID
+	Record *recpb.Record
+}
+
+func (e *NewerRecordError) Error() string {
+	return fmt.Sprintf("peer %s holds a newer record for key %q", e.Peer, e.Key)
+}
+
+// resolvePutConflict fetches the record for key from each of the given peers
+// and applies policy if any of them is newer than value, according to the
+// validator. It returns the value to put.
+func (dht *IpfsDHT) resolvePutConflict(ctx context.Context, key string, value []byte, peers []peer.ID, policy PutValueConflictPolicy) ([]byte, error) {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		newest = value
+		from   peer.ID
+		rec    *recpb.Record
+	)
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			remote, _, err := dht.getValueOrPeers(ctx, p, key)
+			if err != nil || remote == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if bytes.Equal(remote.GetValue(), newest) {
+				return
+			}
+			i, err := dht.validatorFor(key).Select(key, [][]byte{newest, remote.GetValue()})
+			if err != nil || i != 1 {
+				return
+			}
+			newest, from, rec = remote.GetValue(), p, remote
+		}(p)
+	}
+	wg.Wait()
+
+	if rec == nil {
+		return value, nil
+	}
+	logger.Debugf("PutValue: peer %s holds a newer record for %s", from, key)
+
+	switch policy.Action {
+	case PutConflictAbort:
+		return nil, &NewerRecordError{Key: key, Peer: from, Record: rec}
+	case PutConflictMerge:
+		if policy.Merge == nil {
+			return nil, errors.New("PutConflictMerge requires a Merge callback")
+		}
+		merged, err := policy.Merge(key, value, newest)
+		if err != nil {
+			return nil, err
+		}
+		if err := dht.validatorFor(key).Validate(key, merged); err != nil {
+			return nil, err
+		}
+		if err := dht.checkRecordSize(key, merged); err != nil {
+			return nil, err
+		}
+		return merged, nil
+	default:
+		return value, nil
+	}
+}
@@ -1,13 +1,17 @@
 package dht
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 
+	u "github.com/ipfs/go-ipfs-util"
 	logging "github.com/ipfs/go-log"
 	todoctr "github.com/ipfs/go-todocounter"
 	process "github.com/jbenet/goprocess"
@@ -18,18 +22,46 @@ import (
 	"github.com/libp2p/go-libp2p-core/routing"
 	queue "github.com/libp2p/go-libp2p-peerstore/queue"
 	notif "github.com/libp2p/go-libp2p-routing/notifications"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // ErrNoPeersQueried is returned when we failed to connect to any peers.
 var ErrNoPeersQueried = errors.New("failed to query any peers")
 
+// ErrRPCBudgetExhausted is returned when a query stopped early because it sent
+// as many RPCs as allowed by the MaxRPCs option. Any result returned along
+// with it is best-effort.
+var ErrRPCBudgetExhausted = errors.New("query RPC budget exhausted")
+
 var maxQueryConcurrency = AlphaValue
 
 type dhtQuery struct {
 	dht         *IpfsDHT
+	op          string    // the operation running the query, see QueryInfo
 	key         string    // the key we're querying for
 	qfunc       queryFunc // the function to execute per peer
 	concurrency int       // the concurrency parameter
+	maxRPCs     int       // the maximum number of peers to query, 0 for no limit
+
+	// maxConcurrency is how far concurrency may grow when the query stalls,
+	// see the AdaptiveConcurrency option.
+	maxConcurrency int
+
+	freshDials bool // see the ForceFreshDials option
+
+	// concurrencyStats is filled in once the query is done if set.
+	concurrencyStats *QueryConcurrencyStats
+}
+
+// QueryConcurrencyStats reports how many RPCs a query actually had in flight.
+// Both are below the configured concurrency when there weren't enough peers
+// left to query, e.g. with a sparse routing table.
+type QueryConcurrencyStats struct {
+	// Peak is the largest number of RPCs in flight at once.
+	Peak int
+	// Average is the mean number of RPCs in flight over the whole query,
+	// including time spent dialing.
+	Average float64
 }
 
 type dhtQueryResult struct {
@@ -43,12 +75,190 @@ type dhtQueryResult struct {
 
 // constructs query
 func (dht *IpfsDHT) newQuery(k string, f queryFunc) *dhtQuery {
-	return &dhtQuery{
-		key:         k,
-		dht:         dht,
-		qfunc:       f,
-		concurrency: maxQueryConcurrency,
+	q := &dhtQuery{
+		key:            k,
+		dht:            dht,
+		qfunc:          f,
+		concurrency:    maxQueryConcurrency,
+		maxConcurrency: maxQueryConcurrency,
+	}
+	if dht.queryConcurrencyInitial > 0 {
+		q.concurrency = dht.queryConcurrencyInitial
+		q.maxConcurrency = dht.queryConcurrencyMax
+	}
+	return q
+}
+
+// seedPeers returns the peers to start a query for the given target with: the
+// count closest peers from our routing table and from each additional seed
+// source, and the extra peers from the peerstore with the SeedFromPeerstore
+// option. Peers known to several sources are only returned once.
+func (dht *IpfsDHT) seedPeers(target kb.ID, count int) []peer.ID {
+	peers := dht.nearestEligiblePeers(target, count)
+	if len(dht.seedSources) == 0 && dht.peerstoreSeeds == 0 {
+		return peers
+	}
+
+	seen := peer.NewSet()
+	for _, p := range peers {
+		seen.Add(p)
+	}
+	for _, src := range dht.seedSources {
+		for _, p := range src.NearestPeers(target, count) {
+			if seen.TryAdd(p) {
+				peers = append(peers, p)
+			}
+		}
+	}
+	peers = kb.SortClosestPeers(peers, target)
+	if dht.peerstoreSeeds > 0 {
+		peers = kb.SortClosestPeers(append(peers, dht.peerstoreSeedPeers(target, count, peers, seen)...), target)
+	}
+	return peers
+}
+
+// peerstoreSeedPeers returns up to peerstoreSeeds peers from the peerstore we
+// know addresses for and that aren't in seen, closest to the target first. If
+// there are at least count seeds, sorted closest first, only the peers closer
+// than the farthest of them are returned.
+func (dht *IpfsDHT) peerstoreSeedPeers(target kb.ID, count int, seeds []peer.ID, seen *peer.Set) []peer.ID {
+	var bound kb.ID
+	if len(seeds) >= count && len(seeds) > 0 {
+		bound = kb.ID(u.XOR(kb.ConvertPeerID(seeds[len(seeds)-1]), target))
+	}
+
+	// keep the closest candidates, farthest on top.
+	peers := dht.peerstore.PeersWithAddrs()
+	keys := dht.peerstoreKeys.get(peers)
+	closest := make(farthestFirst, 0, dht.peerstoreSeeds)
+	for i, p := range peers {
+		if p == dht.self || seen.Contains(p) {
+			continue
+		}
+		d := kb.ID(u.XOR(keys[i], target))
+		if bound != nil && bytes.Compare(d, bound) >= 0 {
+			continue
+		}
+		if len(closest) < dht.peerstoreSeeds {
+			heap.Push(&closest, peerDistance{p, d})
+		} else if bytes.Compare(d, closest[0].distance) < 0 {
+			closest[0] = peerDistance{p, d}
+			heap.Fix(&closest, 0)
+		}
+	}
+
+	extra := make([]peer.ID, len(closest))
+	for i := len(extra) - 1; i >= 0; i-- {
+		extra[i] = heap.Pop(&closest).(peerDistance).p
+	}
+	return extra
+}
+
+type peerDistance struct {
+	p        peer.ID
+	distance kb.ID
+}
+
+// farthestFirst is a heap of peers, the farthest from the target on top.
+type farthestFirst []peerDistance
+
+func (h farthestFirst) Len() int { return len(h) }
+func (h farthestFirst) Less(i, j int) bool {
+	return bytes.Compare(h[i].distance, h[j].distance) > 0
+}
+func (h farthestFirst) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *farthestFirst) Push(x interface{}) { *h = append(*h, x.(peerDistance)) }
+func (h *farthestFirst) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// peerKeys caches the keyspace locations of the peers in the peerstore, so
+// queries don't hash them all again.
+type peerKeys struct {
+	lk   sync.Mutex
+	keys map[peer.ID]kb.ID
+}
+
+// get returns the keyspace locations of peers, in the same order. Peers that
+// aren't among them anymore are forgotten once they make up most of the cache.
+func (c *peerKeys) get(peers []peer.ID) []kb.ID {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if len(c.keys) > 2*len(peers) {
+		keys := make(map[peer.ID]kb.ID, len(peers))
+		for _, p := range peers {
+			if k, ok := c.keys[p]; ok {
+				keys[p] = k
+			}
+		}
+		c.keys = keys
+	} else if c.keys == nil {
+		c.keys = make(map[peer.ID]kb.ID, len(peers))
+	}
+
+	out := make([]kb.ID, len(peers))
+	for i, p := range peers {
+		k, ok := c.keys[p]
+		if !ok {
+			k = kb.ConvertPeerID(p)
+			c.keys[p] = k
+		}
+		out[i] = k
+	}
+	return out
+}
+
+// nearestEligiblePeers returns the count closest peers to the target from our
+// routing table. Peers still in their grace period (see the NewPeerGracePeriod
+// option) are only returned if there aren't enough other peers.
+func (dht *IpfsDHT) nearestEligiblePeers(target kb.ID, count int) []peer.ID {
+	if dht.newPeerGracePeriod <= 0 {
+		return dht.routingTable.NearestPeers(target, count)
+	}
+
+	// look a bit further so we can skip over new peers.
+	candidates := dht.routingTable.NearestPeers(target, count+dht.bucketSize)
+	peers := make([]peer.ID, 0, count)
+	var fresh []peer.ID
+	for _, p := range candidates {
+		if len(peers) >= count {
+			break
+		}
+		if dht.inGracePeriod(p) {
+			fresh = append(fresh, p)
+			continue
+		}
+		peers = append(peers, p)
 	}
+	for _, p := range fresh {
+		if len(peers) >= count {
+			break
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// valuesCtx is a context with the deadline and cancellation of its embedded
+// context, but the values of another one.
+type valuesCtx struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesCtx) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// withValuesOf returns ctx with the values of values, so the contexts derived
+// from a query's process still carry what the caller put in its context (e.g.
+// a tracing span or a correlation ID) down to the RPCs and hooks.
+func withValuesOf(ctx, values context.Context) context.Context {
+	return valuesCtx{Context: ctx, values: values}
 }
 
 // QueryFunc is a function that runs a particular query with a given peer.
@@ -70,12 +280,47 @@ func (q *dhtQuery) Run(ctx context.Context, peers []peer.ID) (*dhtQueryResult, e
 		return nil, ctx.Err()
 	default:
 	}
+	if q.dht.isOffline() {
+		return nil, ErrOffline
+	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	runner := newQueryRunner(q)
-	return runner.Run(ctx, peers)
+	// abort the query if the DHT shuts down.
+	go func() {
+		select {
+		case <-q.dht.queryCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	runner := newQueryRunner(ctx, q)
+	if q.dht.queryTraces != nil {
+		runner.trace = &QueryTrace{Key: q.key, Start: time.Now(), Seeds: peers}
+	}
+	q.dht.addActiveQuery(runner)
+	res, err := runner.Run(ctx, peers)
+	q.dht.removeActiveQuery(runner)
+	runner.closeFreshConns()
+	if q.concurrencyStats != nil {
+		*q.concurrencyStats = runner.concurrencyStats()
+	}
+	if runner.trace != nil {
+		stats := runner.concurrencyStats()
+		runner.Lock()
+		trace := *runner.trace
+		runner.Unlock()
+		trace.Err = err
+		trace.Concurrency = stats
+		trace.Duration = time.Since(trace.Start)
+		q.dht.queryTraces.add(trace)
+	}
+	if runner.answered() {
+		q.dht.recordWarmUpQuery()
+	}
+	return res, err
 }
 
 type dhtQueryRunner struct {
@@ -91,23 +336,53 @@ type dhtQueryRunner struct {
 	rateLimit chan struct{} // processing semaphore
 	log       logging.EventLogger
 
+	rpcs      int  // peers we started querying, only used by spawnWorkers
+	truncated bool // the query ran out of RPC budget
+	responses int  // peers that answered without error
+
+	// adaptive concurrency state, see growConcurrency.
+	concurrency    int     // current number of rateLimit tokens
+	roundResponses int     // responses in the current round
+	roundProgress  bool    // whether the current round got closer to the key
+	closest        peer.ID // closest peer to the key seen so far
+
+	// peers we weren't connected to before dialing them for a ForceFreshDials
+	// query, disconnected once it's done.
+	freshConns  []peer.ID
+	freshClosed bool
+
+	// RPCs in flight, only tracked if the query wants concurrency stats.
+	inFlight     int
+	peakInFlight int
+	inFlightArea float64   // RPCs in flight integrated over time, in seconds
+	lastInFlight time.Time // when inFlight last changed
+	start        time.Time
+
+	trace       *QueryTrace // nil unless the query is traced
+	dialsFailed int
+
+	offline bool // the query was aborted as we appear to be offline
+
 	runCtx context.Context
 
 	proc process.Process
 	sync.RWMutex
 }
 
-func newQueryRunner(q *dhtQuery) *dhtQueryRunner {
+// newQueryRunner returns a runner for q, called with the caller's context.
+func newQueryRunner(runCtx context.Context, q *dhtQuery) *dhtQueryRunner {
 	proc := process.WithParent(process.Background())
-	ctx := ctxproc.OnClosingContext(proc)
+	ctx := withValuesOf(ctxproc.OnClosingContext(proc), runCtx)
 	peersToQuery := queue.NewChanQueue(ctx, queue.NewXORDistancePQ(string(q.key)))
 	r := &dhtQueryRunner{
 		query:          q,
 		peersRemaining: todoctr.NewSyncCounter(),
 		peersSeen:      peer.NewSet(),
 		peersQueried:   peer.NewSet(),
-		rateLimit:      make(chan struct{}, q.concurrency),
+		rateLimit:      make(chan struct{}, q.maxConcurrency),
+		concurrency:    q.concurrency,
 		peersToQuery:   peersToQuery,
+		runCtx:         runCtx,
 		proc:           proc,
 	}
 	dq, err := newDialQueue(&dqParams{
@@ -126,7 +401,8 @@ func newQueryRunner(q *dhtQuery) *dhtQueryRunner {
 
 func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (*dhtQueryResult, error) {
 	r.log = logger
-	r.runCtx = ctx
+	r.start = time.Now()
+	r.lastInFlight = r.start
 
 	// setup concurrency rate limiting
 	for i := 0; i < r.query.concurrency; i++ {
@@ -136,6 +412,7 @@ func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (*dhtQueryRes
 	// add all the peers we got first.
 	for _, p := range peers {
 		r.addPeerToQuery(p)
+		r.closerToKey(p)
 	}
 
 	// start the dial queue only after we've added the initial set of peers.
@@ -172,6 +449,13 @@ func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (*dhtQueryRes
 	r.RLock()
 	defer r.RUnlock()
 
+	if r.offline && (r.result == nil || !r.result.success) {
+		err = ErrOffline
+	}
+	if err == nil && r.truncated {
+		err = ErrRPCBudgetExhausted
+	}
+
 	if r.result != nil && r.result.success {
 		return r.result, nil
 	}
@@ -182,6 +466,42 @@ func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (*dhtQueryRes
 	}, err
 }
 
+// trackInFlight adds delta to the number of RPCs in flight.
+func (r *dhtQueryRunner) trackInFlight(delta int) {
+	if r.query.concurrencyStats == nil && r.trace == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	r.inFlightArea += float64(r.inFlight) * now.Sub(r.lastInFlight).Seconds()
+	r.lastInFlight = now
+	r.inFlight += delta
+	if r.inFlight > r.peakInFlight {
+		r.peakInFlight = r.inFlight
+	}
+}
+
+// concurrencyStats returns the concurrency reached by the query, once it's
+// done.
+func (r *dhtQueryRunner) concurrencyStats() QueryConcurrencyStats {
+	r.trackInFlight(0)
+	r.RLock()
+	defer r.RUnlock()
+	stats := QueryConcurrencyStats{Peak: r.peakInFlight}
+	if elapsed := r.lastInFlight.Sub(r.start).Seconds(); elapsed > 0 {
+		stats.Average = r.inFlightArea / elapsed
+	}
+	return stats
+}
+
+// answered returns true if at least one peer answered the query.
+func (r *dhtQueryRunner) answered() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.responses > 0
+}
+
 func (r *dhtQueryRunner) addPeerToQuery(next peer.ID) {
 	// if new peer is ourselves...
 	if next == r.query.dht.self {
@@ -189,6 +509,11 @@ func (r *dhtQueryRunner) addPeerToQuery(next peer.ID) {
 		return
 	}
 
+	if r.query.dht.penalizeSelfOnlyResponses && r.query.dht.selfOnly.flagged(next) {
+		r.log.Debugf("addPeerToQuery skip %s: it only ever returns itself", next)
+		return
+	}
+
 	if !r.peersSeen.TryAdd(next) {
 		return
 	}
@@ -215,6 +540,10 @@ func (r *dhtQueryRunner) spawnWorkers(proc process.Process) {
 			return
 
 		case <-r.rateLimit:
+			if r.query.maxRPCs > 0 && r.rpcs >= r.query.maxRPCs {
+				r.exhaustBudget()
+				return
+			}
 			ch := r.peersDialed.Consume()
 			select {
 			case p, ok := <-ch:
@@ -222,6 +551,7 @@ func (r *dhtQueryRunner) spawnWorkers(proc process.Process) {
 					// this signals context cancellation.
 					return
 				}
+				r.rpcs++
 				// do it as a child func to make sure Run exits
 				// ONLY AFTER spawn workers has exited.
 				proc.Go(func(proc process.Process) {
@@ -236,7 +566,79 @@ func (r *dhtQueryRunner) spawnWorkers(proc process.Process) {
 	}
 }
 
+// exhaustBudget ends the query once the RPCs still in flight are done, as they
+// may still yield a result. The caller must hold one rateLimit token.
+func (r *dhtQueryRunner) exhaustBudget() {
+	for held := 1; ; held++ {
+		// RPCs in flight may still grow the concurrency, handing out more
+		// tokens we need to collect.
+		r.RLock()
+		concurrency := r.concurrency
+		r.RUnlock()
+		if held >= concurrency {
+			break
+		}
+		select {
+		case <-r.rateLimit:
+		case <-r.proc.Closing():
+			return
+		}
+	}
+	r.log.Debugf("query for %s ran out of RPC budget after %d RPCs", r.query.key, r.rpcs)
+
+	r.Lock()
+	r.truncated = true
+	r.Unlock()
+	go r.proc.Close() // must be async, as we're one of the children.
+}
+
+// closerToKey records p as the closest peer to the key if it's closer than any
+// seen so far, and reports whether it was.
+func (r *dhtQueryRunner) closerToKey(p peer.ID) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.closest != "" && !kb.Closer(p, r.closest, r.query.key) {
+		return false
+	}
+	r.closest = p
+	return true
+}
+
+// growConcurrency ends the round once it got as many responses as the current
+// concurrency. If none of them got us closer to the key, the concurrency is
+// doubled, up to the query's maxConcurrency.
+func (r *dhtQueryRunner) growConcurrency(progress bool) {
+	r.Lock()
+	r.roundProgress = r.roundProgress || progress
+	r.roundResponses++
+	if r.roundResponses < r.concurrency {
+		r.Unlock()
+		return
+	}
+	extra := 0
+	if !r.roundProgress && r.concurrency < r.query.maxConcurrency {
+		extra = r.concurrency
+		if r.concurrency+extra > r.query.maxConcurrency {
+			extra = r.query.maxConcurrency - r.concurrency
+		}
+		r.concurrency += extra
+		r.log.Debugf("query for %s stalled, growing concurrency to %d", r.query.key, r.concurrency)
+	}
+	r.roundResponses = 0
+	r.roundProgress = false
+	r.Unlock()
+
+	// rateLimit has room for maxConcurrency tokens, this never blocks.
+	for i := 0; i < extra; i++ {
+		r.rateLimit <- struct{}{}
+	}
+}
+
 func (r *dhtQueryRunner) dialPeer(ctx context.Context, p peer.ID) error {
+	if r.query.freshDials {
+		return r.dialFresh(ctx, p)
+	}
+
 	// short-circuit if we're already connected.
 	if r.query.dht.host.Network().Connectedness(p) == network.Connected {
 		return nil
@@ -248,14 +650,14 @@ func (r *dhtQueryRunner) dialPeer(ctx context.Context, p peer.ID) error {
 		ID:   p,
 	})
 
-	pi := peer.AddrInfo{ID: p}
-	if err := r.query.dht.host.Connect(ctx, pi); err != nil {
+	if err := r.connect(ctx, p); err != nil {
 		logger.Debugf("error connecting: %s", err)
 		notif.PublishQueryEvent(r.runCtx, &notif.QueryEvent{
 			Type:  notif.QueryError,
 			Extra: err.Error(),
 			ID:    p,
 		})
+		r.dialFailed(p, err)
 
 		// This peer is dropping out of the race.
 		r.peersRemaining.Decrement(1)
@@ -265,24 +667,171 @@ func (r *dhtQueryRunner) dialPeer(ctx context.Context, p peer.ID) error {
 	return nil
 }
 
+// errAlreadyConnected is returned when skipping a peer we're already connected
+// to with the ForceFreshDials option set.
+var errAlreadyConnected = errors.New("already connected to peer")
+
+// dialFresh dials p for a query with the ForceFreshDials option set. Peers
+// we're already connected to are skipped: the host reuses existing
+// connections, and closing them would cut off the other protocols using them.
+// The connections dialed are closed once the query is done.
+func (r *dhtQueryRunner) dialFresh(ctx context.Context, p peer.ID) error {
+	net := r.query.dht.host.Network()
+	if net.Connectedness(p) == network.Connected {
+		logger.Debugf("not querying %s, we're already connected to it", p)
+		r.peersRemaining.Decrement(1)
+		return errAlreadyConnected
+	}
+
+	notif.PublishQueryEvent(r.runCtx, &notif.QueryEvent{
+		Type: notif.DialingPeer,
+		ID:   p,
+	})
+
+	start := time.Now()
+	if err := r.connect(ctx, p); err != nil {
+		logger.Debugf("error connecting: %s", err)
+		notif.PublishQueryEvent(r.runCtx, &notif.QueryEvent{
+			Type:  notif.QueryError,
+			Extra: err.Error(),
+			ID:    p,
+		})
+		r.dialFailed(p, err)
+		r.peersRemaining.Decrement(1)
+		return err
+	}
+	logger.Debugf("fresh dial to %s took %s", p, time.Since(start))
+
+	r.Lock()
+	closed := r.freshClosed
+	if !closed {
+		r.freshConns = append(r.freshConns, p)
+	}
+	r.Unlock()
+	if closed {
+		// the query ended while we were dialing.
+		net.ClosePeer(p)
+	}
+	return nil
+}
+
+// closeFreshConns closes the connections opened by dialFresh.
+func (r *dhtQueryRunner) closeFreshConns() {
+	r.Lock()
+	peers := r.freshConns
+	r.freshConns = nil
+	r.freshClosed = true
+	r.Unlock()
+
+	net := r.query.dht.host.Network()
+	for _, p := range peers {
+		net.ClosePeer(p)
+	}
+}
+
+// errRelayOnly is returned when dialing a peer only reachable through relays
+// with the ExcludeRelayAddrsInQueries option set.
+var errRelayOnly = errors.New("peer only has relay addresses")
+
+// errDialDenied is returned when dialing a peer the OnQueryDial hook refused to
+// dial.
+var errDialDenied = errors.New("dial denied by the query dial hook")
+
+// connect connects to p, unless the ExcludeRelayAddrsInQueries or
+// OnQueryDial options rule it out.
+func (r *dhtQueryRunner) connect(ctx context.Context, p peer.ID) error {
+	dht := r.query.dht
+	pi := peer.AddrInfo{ID: p}
+	if dht.skipRelayOnly || dht.onQueryDial != nil {
+		pi.Addrs = dht.peerstore.Addrs(p)
+	}
+	if dht.skipRelayOnly && relayOnly(pi.Addrs) {
+		return errRelayOnly
+	}
+	if dht.onQueryDial != nil && !dht.onQueryDial(r.runCtx, pi) {
+		return errDialDenied
+	}
+	start := time.Now()
+	err := dht.host.Connect(ctx, pi)
+	r.observeDial(ctx, err, time.Since(start))
+	return err
+}
+
+// pCircuit is the multiaddr code of circuit relay addresses, registered by
+// go-libp2p-circuit.
+const pCircuit = 0x0122
+
+// relayOnly returns true if all of addrs, and at least one, are circuit relay
+// addresses.
+func relayOnly(addrs []ma.Multiaddr) bool {
+	for _, a := range addrs {
+		relay := false
+		ma.ForEach(a, func(c ma.Component) bool {
+			relay = c.Protocol().Code == pCircuit
+			return !relay
+		})
+		if !relay {
+			return false
+		}
+	}
+	return len(addrs) > 0
+}
+
+// recordQueryStats records the outcome of querying p if p is in our routing
+// table. Queries aborted on our side don't count against the peer.
+func (r *dhtQueryRunner) recordQueryStats(ctx context.Context, p peer.ID, res *dhtQueryResult, err error) {
+	dht := r.query.dht
+	if ctx.Err() != nil || dht.routingTable.Find(p) == "" {
+		return
+	}
+	switch {
+	case err != nil:
+		dht.queryStats.record(p, queryOutcomeFailure)
+	case res.success || len(res.closerPeers) > 0:
+		dht.queryStats.record(p, queryOutcomeUseful)
+	default:
+		dht.queryStats.record(p, queryOutcomeUseless)
+	}
+}
+
 func (r *dhtQueryRunner) queryPeer(proc process.Process, p peer.ID) {
 	// ok let's do this!
 
-	// create a context from our proc.
-	ctx := ctxproc.OnClosingContext(proc)
+	// create a context from our proc, keeping the caller's values.
+	ctx := withValuesOf(ctxproc.OnClosingContext(proc), r.runCtx)
+
+	r.trackInFlight(1)
 
 	// make sure we do this when we exit
+	progress := false
 	defer func() {
+		r.trackInFlight(-1)
+		r.growConcurrency(progress)
 		// signal we're done processing peer p
 		r.peersRemaining.Decrement(1)
 		r.rateLimit <- struct{}{}
 	}()
 
 	// finally, run the query against this peer
+	start := time.Now()
 	res, err := r.query.qfunc(ctx, p)
+	r.traceRPC(p, res, err, time.Since(start))
 
 	r.peersQueried.Add(p)
 
+	r.recordQueryStats(ctx, p, res, err)
+	if err == nil {
+		r.Lock()
+		r.responses++
+		r.Unlock()
+		if r.query.dht.offline != nil {
+			r.query.dht.offline.reached()
+		}
+	}
+	if err == nil && !res.success {
+		r.query.dht.selfOnly.record(p, isSelfOnlyResponse(p, res.closerPeers))
+	}
+
 	if err != nil {
 		logger.Debugf("ERROR worker for: %v %v", p, err)
 	} else if res.success {
@@ -291,6 +840,7 @@ func (r *dhtQueryRunner) queryPeer(proc process.Process, p peer.ID) {
 		r.result = res
 		r.Unlock()
 		if res.peer != nil {
+			res.peer.Addrs = r.query.dht.withAcceptedScopes(res.peer.Addrs)
 			r.query.dht.peerstore.AddAddrs(res.peer.ID, res.peer.Addrs, pstore.TempAddrTTL)
 		}
 		go r.proc.Close() // signal to everyone that we're done.
@@ -305,8 +855,12 @@ func (r *dhtQueryRunner) queryPeer(proc process.Process, p peer.ID) {
 			}
 
 			// add their addresses to the dialer's peerstore
+			next.Addrs = r.query.dht.withAcceptedScopes(next.Addrs)
 			r.query.dht.peerstore.AddAddrs(next.ID, next.Addrs, pstore.TempAddrTTL)
 			r.addPeerToQuery(next.ID)
+			if r.closerToKey(next.ID) {
+				progress = true
+			}
 			logger.Debugf("PEERS CLOSER -- worker for: %v added %v (%v)", p, next.ID, next.Addrs)
 		}
 	} else {
@@ -0,0 +1,412 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pstore "github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/routing"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	ma "github.com/multiformats/go-multiaddr"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+)
+
+func TestSeedPeersFromMultipleSources(t *testing.T) {
+	dht := newTestRoutingTableDHT(t, 10)
+	other := newTestRoutingTableDHT(t, 10)
+
+	// a peer known to both tables.
+	shared := test.RandPeerIDFatal(t)
+	dht.routingTable.Update(shared)
+	other.routingTable.Update(shared)
+
+	dht.seedSources = []opts.PeerSource{other.routingTable}
+
+	target := kb.ConvertPeerID(shared)
+	seeds := dht.seedPeers(target, 3)
+	if len(seeds) != 5 {
+		t.Fatalf("expected 5 seed peers, got %d", len(seeds))
+	}
+	if seeds[0] != shared {
+		t.Fatal("expected seed peers to be sorted by distance to the target")
+	}
+	seen := make(map[string]struct{})
+	for _, p := range seeds {
+		if _, ok := seen[string(p)]; ok {
+			t.Fatalf("expected seed peers to be unique, got %s twice", p)
+		}
+		seen[string(p)] = struct{}{}
+	}
+}
+
+func TestSeedPeersFromPeerstore(t *testing.T) {
+	dht := newTestRoutingTableDHT(t, 10)
+	dht.peerstore = pstoremem.NewPeerstore()
+	dht.peerstoreSeeds = 2
+
+	addr := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+	for _, p := range dht.routingTable.ListPeers() {
+		dht.peerstore.AddAddr(p, addr, pstore.PermanentAddrTTL)
+	}
+	outside := make(map[peer.ID]bool)
+	for i := 0; i < 50; i++ {
+		p := test.RandPeerIDFatal(t)
+		dht.peerstore.AddAddr(p, addr, pstore.PermanentAddrTTL)
+		outside[p] = true
+	}
+	// peers without addresses aren't used.
+	dht.peerstore.AddProtocols(test.RandPeerIDFatal(t), "/test")
+
+	target := kb.ConvertPeerID(test.RandPeerIDFatal(t))
+	nearest := dht.routingTable.NearestPeers(target, 3)
+	farthest := nearest[len(nearest)-1]
+	closer := 0
+	for p := range outside {
+		if kb.SortClosestPeers([]peer.ID{p, farthest}, target)[0] == p {
+			closer++
+		}
+	}
+	if closer > 2 {
+		closer = 2
+	}
+
+	seeds := dht.seedPeers(target, 3)
+	if len(seeds) != 3+closer {
+		t.Fatalf("expected %d seed peers, got %d", 3+closer, len(seeds))
+	}
+	extra := 0
+	for i, p := range seeds {
+		if i > 0 && kb.SortClosestPeers([]peer.ID{seeds[i-1], p}, target)[0] != seeds[i-1] {
+			t.Fatal("expected seed peers to be sorted by distance to the target")
+		}
+		if !outside[p] {
+			continue
+		}
+		extra++
+		if kb.SortClosestPeers([]peer.ID{p, farthest}, target)[0] != p {
+			t.Fatalf("expected extra seed %s to be closer than the farthest routing table seed", p)
+		}
+	}
+	if extra != closer {
+		t.Fatalf("expected %d extra seeds, got %d", closer, extra)
+	}
+}
+
+func TestSeedPeersDeprioritizesNewPeers(t *testing.T) {
+	dht := newTestRoutingTableDHT(t, 10)
+	dht.newPeerGracePeriod = time.Minute
+	dht.rtPeersAddedAt = make(map[peer.ID]time.Time)
+
+	target := kb.ConvertPeerID(test.RandPeerIDFatal(t))
+	nearest := dht.routingTable.NearestPeers(target, 10)
+	dht.rtPeersAddedAt[nearest[0]] = time.Now()
+
+	seeds := dht.seedPeers(target, 3)
+	if len(seeds) != 3 {
+		t.Fatalf("expected 3 seed peers, got %d", len(seeds))
+	}
+	for _, p := range seeds {
+		if p == nearest[0] {
+			t.Fatal("expected the new peer to be skipped")
+		}
+	}
+
+	// with nothing else to query, the new peer is still used.
+	seeds = dht.seedPeers(target, 10)
+	if len(seeds) != 10 || seeds[9] != nearest[0] {
+		t.Fatal("expected the new peer to be queried last")
+	}
+}
+
+func TestQueryAdaptiveConcurrency(t *testing.T) {
+	dht := newTestRoutingTableDHT(t, 10)
+	q := &dhtQuery{
+		dht:            dht,
+		key:            "hello",
+		concurrency:    1,
+		maxConcurrency: 4,
+	}
+
+	r := newQueryRunner(context.Background(), q)
+	defer r.proc.Close()
+	r.log = logger
+
+	// a round making progress keeps the query narrow.
+	r.growConcurrency(true)
+	if r.concurrency != 1 || len(r.rateLimit) != 0 {
+		t.Fatalf("expected concurrency to stay at 1, got %d", r.concurrency)
+	}
+
+	// stalled rounds double it.
+	r.growConcurrency(false)
+	if r.concurrency != 2 || len(r.rateLimit) != 1 {
+		t.Fatalf("expected concurrency to grow to 2, got %d", r.concurrency)
+	}
+	r.growConcurrency(true)
+	r.growConcurrency(false)
+	if r.concurrency != 2 {
+		t.Fatalf("expected concurrency to stay at 2 after progress, got %d", r.concurrency)
+	}
+	r.growConcurrency(false)
+	r.growConcurrency(false)
+	if r.concurrency != 4 || len(r.rateLimit) != 3 {
+		t.Fatalf("expected concurrency to grow to 4, got %d", r.concurrency)
+	}
+
+	// but never past the maximum.
+	for i := 0; i < 8; i++ {
+		r.growConcurrency(false)
+	}
+	if r.concurrency != 4 || len(r.rateLimit) != 3 {
+		t.Fatalf("expected concurrency to be capped at 4, got %d", r.concurrency)
+	}
+}
+
+func TestQuerySkipRelayOnlyPeers(t *testing.T) {
+	if ma.ProtocolWithCode(pCircuit).Code == 0 {
+		err := ma.AddProtocol(ma.Protocol{
+			Name:  "p2p-circuit",
+			Code:  pCircuit,
+			VCode: ma.CodeToVarint(pCircuit),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	direct := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	relay := ma.StringCast("/ip4/1.2.3.4/tcp/4001/ipfs/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ/p2p-circuit")
+
+	if !relayOnly([]ma.Multiaddr{relay, relay}) {
+		t.Fatal("expected relay addresses only to be relay-only")
+	}
+	if relayOnly([]ma.Multiaddr{relay, direct}) || relayOnly(nil) {
+		t.Fatal("expected a direct address or no address not to be relay-only")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer a.host.Close()
+	a.skipRelayOnly = true
+
+	relayOnly := test.RandPeerIDFatal(t)
+	a.peerstore.AddAddr(relayOnly, relay, pstore.TempAddrTTL)
+
+	queried := false
+	q := a.newQuery("hello", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		queried = true
+		return &dhtQueryResult{success: true}, nil
+	})
+	if _, err := q.Run(ctx, []peer.ID{relayOnly}); err != ErrNoPeersQueried {
+		t.Fatalf("expected ErrNoPeersQueried, got %v", err)
+	}
+	if queried {
+		t.Fatal("expected the relay-only peer not to be queried")
+	}
+}
+
+type correlationKey struct{}
+
+func TestQueryOnQueryDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = context.WithValue(ctx, correlationKey{}, "op-1")
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	c := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{a, b, c} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	a.peerstore.AddAddrs(b.self, b.host.Addrs(), pstore.TempAddrTTL)
+	a.peerstore.AddAddrs(c.self, c.host.Addrs(), pstore.TempAddrTTL)
+
+	var lk sync.Mutex
+	dialed := make(map[peer.ID]int)
+	a.onQueryDial = func(ctx context.Context, pi peer.AddrInfo) bool {
+		lk.Lock()
+		defer lk.Unlock()
+		if ctx.Value(correlationKey{}) != "op-1" {
+			t.Error("expected the hook to get the caller's context values")
+		}
+		if len(pi.Addrs) == 0 {
+			t.Errorf("expected the addresses of %s to be passed to the hook", pi.ID)
+		}
+		dialed[pi.ID]++
+		return pi.ID != c.self
+	}
+
+	var queried []peer.ID
+	q := a.newQuery("hello", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		lk.Lock()
+		defer lk.Unlock()
+		if ctx.Value(correlationKey{}) != "op-1" {
+			t.Error("expected the query function to get the caller's context values")
+		}
+		queried = append(queried, p)
+		return &dhtQueryResult{}, nil
+	})
+	// the query runs out of peers without finding anything.
+	if _, err := q.Run(ctx, []peer.ID{c.self, b.self}); err != routing.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	if len(queried) != 1 || queried[0] != b.self {
+		t.Fatalf("expected only the approved peer to be queried, got %v", queried)
+	}
+	if dialed[b.self] != 1 || dialed[c.self] != 1 {
+		t.Fatalf("expected the hook to be called once per peer, got %v", dialed)
+	}
+	if a.host.Network().Connectedness(c.self) == network.Connected {
+		t.Fatal("expected the denied peer not to be dialed")
+	}
+}
+
+func TestQueryForceFreshDials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	c := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{a, b, c} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, a, b)
+	a.peerstore.AddAddrs(c.self, c.host.Addrs(), pstore.TempAddrTTL)
+
+	net := a.host.Network()
+	old := net.ConnsToPeer(b.self)[0]
+
+	var mu sync.Mutex
+	var queried []peer.ID
+	q := a.newQuery("hello", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried = append(queried, p)
+		return &dhtQueryResult{}, nil
+	})
+	q.freshDials = true
+	if _, err := q.Run(ctx, []peer.ID{b.self, c.self}); err != routing.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	mu.Lock()
+	if len(queried) != 1 || queried[0] != c.self {
+		t.Fatalf("expected only the peer we weren't connected to to be queried, got %v", queried)
+	}
+	mu.Unlock()
+	if conns := net.ConnsToPeer(b.self); len(conns) != 1 || conns[0] != old {
+		t.Fatal("expected the existing connection to be left alone")
+	}
+	if net.Connectedness(c.self) == network.Connected {
+		t.Fatal("expected the connection opened for the query to be closed")
+	}
+}
+
+func TestPeerKeys(t *testing.T) {
+	var c peerKeys
+	var peers []peer.ID
+	for i := 0; i < 10; i++ {
+		peers = append(peers, test.RandPeerIDFatal(t))
+	}
+	for i, k := range c.get(peers) {
+		if !bytes.Equal(k, kb.ConvertPeerID(peers[i])) {
+			t.Fatalf("wrong key for %s", peers[i])
+		}
+	}
+	// peers gone from the peerstore are forgotten.
+	c.get(peers[:2])
+	if len(c.keys) != 2 {
+		t.Fatalf("expected 2 cached keys, got %d", len(c.keys))
+	}
+}
+
+func TestQueryFailFastWhenOffline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer a.host.Close()
+	a.offline = new(offlineDetector)
+
+	var (
+		lk     sync.Mutex
+		dialed int
+	)
+	a.onQueryDial = func(_ context.Context, pi peer.AddrInfo) bool {
+		lk.Lock()
+		defer lk.Unlock()
+		dialed++
+		return true
+	}
+
+	// peers refusing connections, as they do when we're offline.
+	refused := ma.StringCast("/ip4/127.0.0.1/tcp/1")
+	var peers []peer.ID
+	for i := 0; i < 2*offlineDialFailures; i++ {
+		p := test.RandPeerIDFatal(t)
+		a.peerstore.AddAddr(p, refused, pstore.TempAddrTTL)
+		peers = append(peers, p)
+	}
+	q := a.newQuery("hello", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		t.Error("no peer should be queried")
+		return &dhtQueryResult{}, nil
+	})
+	if _, err := q.Run(ctx, peers); err != ErrOffline {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+
+	// queries fail without dialing anyone for a while.
+	lk.Lock()
+	before := dialed
+	lk.Unlock()
+	if _, err := q.Run(ctx, peers); err != ErrOffline {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+	lk.Lock()
+	if dialed != before {
+		t.Fatalf("expected no dials while offline, got %d", dialed-before)
+	}
+	lk.Unlock()
+
+	// we're online as soon as we have a connection.
+	b := setupDHT(ctx, t, false)
+	defer b.Close()
+	defer b.host.Close()
+	connect(t, ctx, a, b)
+	if a.isOffline() {
+		t.Fatal("expected to be online with an open connection")
+	}
+}
+
+func TestOfflineDetectorIgnoresSkippedDials(t *testing.T) {
+	o := new(offlineDetector)
+	for i := 0; i < offlineDialFailures; i++ {
+		o.dialed(swarm.ErrDialBackoff, 0)
+		o.dialed(&swarm.DialError{Cause: swarm.ErrNoAddresses}, 0)
+		o.dialed(&swarm.DialError{Cause: swarm.ErrNoGoodAddresses}, 0)
+	}
+	if o.failures != 0 {
+		t.Fatalf("expected dials that didn't reach the network to be ignored, got %d failures", o.failures)
+	}
+	o.dialed(&swarm.DialError{}, 0)
+	if o.failures != 1 {
+		t.Fatalf("expected a failed dial to count, got %d failures", o.failures)
+	}
+}
@@ -0,0 +1,122 @@
+package dht
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// queryStatsWindow is the number of most recent queries per peer that
+// QueryStats are computed over.
+var queryStatsWindow = 64
+
+// queryStatsPeers is the maximum number of peers we keep query stats for.
+var queryStatsPeers = 1024
+
+// QueryStats summarizes how a peer behaved in the queries we sent it, over a
+// window of the most recent queries.
+type QueryStats struct {
+	// Queries is the number of queries the peer participated in.
+	Queries int
+	// Useful is the number of queries in which the peer returned what we were
+	// looking for or closer peers.
+	Useful int
+	// Failures is the number of queries in which the peer failed to respond.
+	Failures int
+}
+
+// FailureRate returns the fraction of queries the peer failed to respond to.
+func (s QueryStats) FailureRate() float64 {
+	if s.Queries == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Queries)
+}
+
+type queryOutcome uint8
+
+const (
+	queryOutcomeUseless queryOutcome = iota
+	queryOutcomeUseful
+	queryOutcomeFailure
+)
+
+// peerQueryHistory is a ring buffer of the most recent query outcomes for a
+// peer.
+type peerQueryHistory struct {
+	lk       sync.Mutex
+	outcomes []queryOutcome
+	next     int
+}
+
+func (h *peerQueryHistory) add(o queryOutcome) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if len(h.outcomes) < queryStatsWindow {
+		h.outcomes = append(h.outcomes, o)
+		return
+	}
+	h.outcomes[h.next] = o
+	h.next = (h.next + 1) % len(h.outcomes)
+}
+
+func (h *peerQueryHistory) stats() QueryStats {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	s := QueryStats{Queries: len(h.outcomes)}
+	for _, o := range h.outcomes {
+		switch o {
+		case queryOutcomeUseful:
+			s.Useful++
+		case queryOutcomeFailure:
+			s.Failures++
+		}
+	}
+	return s
+}
+
+// queryStatsTracker keeps the query history of a bounded number of peers.
+type queryStatsTracker struct {
+	lk    sync.Mutex
+	peers *lru.Cache
+}
+
+func newQueryStatsTracker() *queryStatsTracker {
+	peers, err := lru.New(queryStatsPeers)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	return &queryStatsTracker{peers: peers}
+}
+
+func (t *queryStatsTracker) record(p peer.ID, o queryOutcome) {
+	t.lk.Lock()
+	v, ok := t.peers.Get(p)
+	if !ok {
+		v = new(peerQueryHistory)
+		t.peers.Add(p, v)
+	}
+	t.lk.Unlock()
+	v.(*peerQueryHistory).add(o)
+}
+
+func (t *queryStatsTracker) stats(p peer.ID) (QueryStats, bool) {
+	v, ok := t.peers.Get(p)
+	if !ok {
+		return QueryStats{}, false
+	}
+	return v.(*peerQueryHistory).stats(), true
+}
+
+func (t *queryStatsTracker) remove(p peer.ID) {
+	t.peers.Remove(p)
+}
+
+// PeerQueryStats returns how the given routing table peer behaved in our
+// recent queries. It returns false if we don't have any stats for the peer,
+// either because we never queried it or because it's not in our routing table
+// anymore.
+func (dht *IpfsDHT) PeerQueryStats(p peer.ID) (QueryStats, bool) {
+	return dht.queryStats.stats(p)
+}
@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestQueryStatsWindow(t *testing.T) {
+	old := queryStatsWindow
+	queryStatsWindow = 4
+	defer func() { queryStatsWindow = old }()
+
+	tracker := newQueryStatsTracker()
+	p := peer.ID("peer")
+
+	if _, ok := tracker.stats(p); ok {
+		t.Fatal("didn't expect stats for an unknown peer")
+	}
+
+	for _, o := range []queryOutcome{
+		queryOutcomeFailure, queryOutcomeFailure,
+		queryOutcomeUseful, queryOutcomeUseful, queryOutcomeUseless, queryOutcomeFailure,
+	} {
+		tracker.record(p, o)
+	}
+
+	// the first two failures fell out of the window.
+	stats, ok := tracker.stats(p)
+	if !ok {
+		t.Fatal("expected stats for the peer")
+	}
+	expected := QueryStats{Queries: 4, Useful: 2, Failures: 1}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	if stats.FailureRate() != 0.25 {
+		t.Fatalf("expected a failure rate of 0.25, got %f", stats.FailureRate())
+	}
+
+	tracker.remove(p)
+	if _, ok := tracker.stats(p); ok {
+		t.Fatal("didn't expect stats for a removed peer")
+	}
+}
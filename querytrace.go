@@ -0,0 +1,119 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// QueryTrace records what a single query did, see the QueryTraceHistory
+// option.
+type QueryTrace struct {
+	// Key is the key the query was for, as sent to peers: a record key, the
+	// bytes of a CID or a peer ID.
+	Key   string
+	Start time.Time
+
+	// Seeds are the peers the query started with.
+	Seeds []peer.ID
+
+	// RPCs has an entry for each peer queried, in the order they completed.
+	RPCs []QueryRPC
+
+	// FailedDials has an entry for each peer the query couldn't dial, and thus
+	// didn't query.
+	FailedDials []QueryDial
+
+	// Err is the error the query ended with. Queries for the closest peers
+	// end with routing.ErrNotFound once they've run out of peers to query,
+	// even if they found the closest peers.
+	Err error
+
+	Concurrency QueryConcurrencyStats
+	Duration    time.Duration
+}
+
+// QueryRPC is the outcome of querying a single peer.
+type QueryRPC struct {
+	Peer peer.ID
+	// Success is set if the peer's response ended the query, e.g. with the
+	// peer being looked for.
+	Success bool
+	// CloserPeers is the number of closer peers the peer sent.
+	CloserPeers int
+	Err         error // nil if the peer answered
+	Duration    time.Duration
+}
+
+// QueryDial is a dial a query failed.
+type QueryDial struct {
+	Peer peer.ID
+	Err  error
+}
+
+// queryTraceHistory keeps the traces of the most recent queries in a ring
+// buffer.
+type queryTraceHistory struct {
+	lk     sync.Mutex
+	traces []QueryTrace
+	next   int // index of the oldest trace once the buffer is full
+}
+
+func newQueryTraceHistory(n int) *queryTraceHistory {
+	return &queryTraceHistory{traces: make([]QueryTrace, 0, n)}
+}
+
+func (h *queryTraceHistory) add(t QueryTrace) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if len(h.traces) < cap(h.traces) {
+		h.traces = append(h.traces, t)
+		return
+	}
+	h.traces[h.next] = t
+	h.next = (h.next + 1) % len(h.traces)
+}
+
+// recent returns the traces, oldest first.
+func (h *queryTraceHistory) recent() []QueryTrace {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	out := make([]QueryTrace, 0, len(h.traces))
+	out = append(out, h.traces[h.next:]...)
+	return append(out, h.traces[:h.next]...)
+}
+
+// RecentQueryTraces returns the traces of the most recent queries, oldest
+// first. It returns nil unless the QueryTraceHistory option is set.
+func (dht *IpfsDHT) RecentQueryTraces() []QueryTrace {
+	if dht.queryTraces == nil {
+		return nil
+	}
+	return dht.queryTraces.recent()
+}
+
+// traceRPC records the outcome of querying p, if the query is traced.
+func (r *dhtQueryRunner) traceRPC(p peer.ID, res *dhtQueryResult, err error, d time.Duration) {
+	if r.trace == nil {
+		return
+	}
+	rpc := QueryRPC{Peer: p, Err: err, Duration: d}
+	if err == nil {
+		rpc.Success = res.success
+		rpc.CloserPeers = len(res.closerPeers)
+	}
+	r.Lock()
+	r.trace.RPCs = append(r.trace.RPCs, rpc)
+	r.Unlock()
+}
+
+// dialFailed records a failed dial to p, in the trace if the query is traced.
+func (r *dhtQueryRunner) dialFailed(p peer.ID, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.dialsFailed++
+	if r.trace != nil {
+		r.trace.FailedDials = append(r.trace.FailedDials, QueryDial{Peer: p, Err: err})
+	}
+}
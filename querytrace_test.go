@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+func TestQueryTraceHistoryRing(t *testing.T) {
+	h := newQueryTraceHistory(2)
+	if traces := h.recent(); len(traces) != 0 {
+		t.Fatalf("expected no traces, got %d", len(traces))
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		h.add(QueryTrace{Key: k})
+	}
+	traces := h.recent()
+	if len(traces) != 2 || traces[0].Key != "b" || traces[1].Key != "c" {
+		t.Fatalf("expected the last 2 traces, oldest first, got %+v", traces)
+	}
+}
+
+func TestRecentQueryTraces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	if traces := a.RecentQueryTraces(); traces != nil {
+		t.Fatalf("expected no traces by default, got %v", traces)
+	}
+
+	a.queryTraces = newQueryTraceHistory(4)
+	connect(t, ctx, a, b)
+	peers, err := a.GetClosestPeers(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range peers {
+	}
+
+	traces := a.RecentQueryTraces()
+	if len(traces) != 1 {
+		t.Fatalf("expected 1 trace, got %d", len(traces))
+	}
+	trace := traces[0]
+	if trace.Key != "hello" || len(trace.Seeds) != 1 || trace.Seeds[0] != b.self {
+		t.Fatalf("unexpected trace: %+v", trace)
+	}
+	if len(trace.RPCs) != 1 || trace.RPCs[0].Peer != b.self || trace.RPCs[0].Err != nil {
+		t.Fatalf("expected a single successful RPC to b, got %+v", trace.RPCs)
+	}
+	if trace.Err != routing.ErrNotFound || trace.Concurrency.Peak != 1 || trace.Duration <= 0 {
+		t.Fatalf("unexpected trace outcome: %+v", trace)
+	}
+}
@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// recentResultsPerKey bounds the number of providers buffered per key.
+var recentResultsPerKey = 64
+
+// recentResults buffers the providers FindProvidersAsync recently got from the
+// network, so a caller re-requesting a key shortly after giving up on it is
+// answered immediately. See the RecentResultBuffer option.
+type recentResults struct {
+	ttl  time.Duration
+	lk   sync.Mutex
+	keys *lru.Cache
+}
+
+type recentResult struct {
+	lk      sync.Mutex
+	expires time.Time
+	provs   []peer.AddrInfo
+}
+
+func newRecentResults(ttl time.Duration, size int) *recentResults {
+	keys, err := lru.New(size)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	return &recentResults{ttl: ttl, keys: keys}
+}
+
+// get returns a copy of the unexpired providers buffered for the key.
+func (r *recentResults) get(key cid.Cid) []peer.AddrInfo {
+	v, ok := r.keys.Get(key)
+	if !ok {
+		return nil
+	}
+	res := v.(*recentResult)
+	res.lk.Lock()
+	defer res.lk.Unlock()
+	if time.Now().After(res.expires) {
+		return nil
+	}
+	return append([]peer.AddrInfo(nil), res.provs...)
+}
+
+// add buffers a provider for the key, extending the lifetime of the key's
+// buffered providers.
+func (r *recentResults) add(key cid.Cid, pi peer.AddrInfo) {
+	r.lk.Lock()
+	v, ok := r.keys.Get(key)
+	if !ok {
+		v = new(recentResult)
+		r.keys.Add(key, v)
+	}
+	r.lk.Unlock()
+
+	res := v.(*recentResult)
+	res.lk.Lock()
+	defer res.lk.Unlock()
+
+	now := time.Now()
+	if now.After(res.expires) {
+		res.provs = res.provs[:0]
+	}
+	res.expires = now.Add(r.ttl)
+	for _, p := range res.provs {
+		if p.ID == pi.ID {
+			return
+		}
+	}
+	if len(res.provs) < recentResultsPerKey {
+		res.provs = append(res.provs, pi)
+	}
+}
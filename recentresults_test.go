@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestRecentResults(t *testing.T) {
+	r := newRecentResults(50*time.Millisecond, 1)
+	a, b := testCaseCids[0], testCaseCids[1]
+
+	if provs := r.get(a); len(provs) != 0 {
+		t.Fatalf("expected nothing buffered, got %v", provs)
+	}
+
+	r.add(a, peer.AddrInfo{ID: "p1"})
+	r.add(a, peer.AddrInfo{ID: "p2"})
+	r.add(a, peer.AddrInfo{ID: "p1"})
+	if provs := r.get(a); len(provs) != 2 {
+		t.Fatalf("expected 2 buffered providers, got %v", provs)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if provs := r.get(a); len(provs) != 0 {
+		t.Fatalf("expected buffered providers to expire, got %v", provs)
+	}
+
+	// the buffer only holds one key.
+	r.add(a, peer.AddrInfo{ID: "p1"})
+	r.add(b, peer.AddrInfo{ID: "p1"})
+	if provs := r.get(a); len(provs) != 0 {
+		t.Fatalf("expected the first key to be evicted, got %v", provs)
+	}
+	if provs := r.get(b); len(provs) != 1 {
+		t.Fatalf("expected 1 buffered provider, got %v", provs)
+	}
+}
+
+func TestFindProvidersReplaysRecentResults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	d.recentResults = newRecentResults(time.Minute, 16)
+	d.recentResults.add(testCaseCids[0], peer.AddrInfo{ID: "buffered"})
+
+	// we aren't connected to anyone, the provider can only come from the
+	// buffer.
+	var provs []peer.AddrInfo
+	for pi := range d.FindProvidersAsync(ctx, testCaseCids[0], 1) {
+		provs = append(provs, pi)
+	}
+	if len(provs) != 1 || provs[0].ID != "buffered" {
+		t.Fatalf("expected the buffered provider to be replayed, got %v", provs)
+	}
+}
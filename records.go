@@ -9,6 +9,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/routing"
 
 	ci "github.com/libp2p/go-libp2p-core/crypto"
+	record "github.com/libp2p/go-libp2p-record"
 )
 
 // MaxRecordAge specifies the maximum time that any node will hold onto a record
@@ -19,6 +20,38 @@ import (
 // it must be rebroadcasted more frequently than once every 'MaxRecordAge'
 var MaxRecordAge = time.Hour * 36
 
+// RecordTooLargeError is returned when a record's value is larger than the
+// limit configured for its namespace with the MaxRecordSize option.
+type RecordTooLargeError struct {
+	Namespace string
+	Size      int
+	Limit     int
+}
+
+func (e *RecordTooLargeError) Error() string {
+	return fmt.Sprintf("record in namespace %q is %d bytes, over the limit of %d bytes", e.Namespace, e.Size, e.Limit)
+}
+
+// checkRecordSize returns a *RecordTooLargeError if value is larger than the
+// limit configured for the namespace of key.
+func (dht *IpfsDHT) checkRecordSize(key string, value []byte) error {
+	if len(dht.maxRecordSizes) == 0 {
+		return nil
+	}
+	ns, _, err := record.SplitKey(key)
+	if err != nil {
+		ns = ""
+	}
+	limit, ok := dht.maxRecordSizes[ns]
+	if !ok {
+		limit, ok = dht.maxRecordSizes[""]
+	}
+	if ok && len(value) > limit {
+		return &RecordTooLargeError{Namespace: ns, Size: len(value), Limit: limit}
+	}
+	return nil
+}
+
 type pubkrs struct {
 	pubk ci.PubKey
 	err  error
@@ -0,0 +1,190 @@
+package dht
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+)
+
+// WorkerStatus describes the state of a background worker, see
+// RefreshWorkerStatus.
+type WorkerStatus struct {
+	// Alive is false once the worker has stopped.
+	Alive bool
+	// Started is when the worker was last started.
+	Started time.Time
+	// LastRun is when the worker last started a refresh, zero if it hasn't
+	// run yet, and LastDuration how long that refresh took, zero while it's
+	// running.
+	LastRun      time.Time
+	LastDuration time.Duration
+	// Runs is the number of refreshes started since the DHT was created.
+	Runs int
+	// Restarts is the number of times RestartRefreshWorker restarted it.
+	Restarts int
+}
+
+// refreshWorker tracks the status of the routing table refresh worker. Its
+// lock also guards IpfsDHT.rtRefreshProc.
+type refreshWorker struct {
+	restartMu sync.Mutex // serializes restarts
+
+	mu     sync.Mutex
+	closed bool // set once the DHT stopped the worker for good
+	status WorkerStatus
+
+	// waiters are the RefreshRoutingTableAsync callers waiting for the next
+	// refresh. wake has room for one signal, so a waiter added while the
+	// worker is busy still wakes it up once it's done.
+	waiters []chan opts.RefreshResult
+	wake    chan struct{}
+}
+
+// pending returns true if callers are waiting for the next refresh.
+func (w *refreshWorker) pending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.waiters) > 0
+}
+
+// takeWaiters returns the callers waiting for the refresh about to start.
+func (w *refreshWorker) takeWaiters() []chan opts.RefreshResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiters := w.waiters
+	w.waiters = nil
+	return waiters
+}
+
+// started records that the worker was just started, unless the DHT is
+// closing, in which case it returns false.
+func (w *refreshWorker) started() bool {
+	if w.closed {
+		return false
+	}
+	w.status.Started = time.Now()
+	return true
+}
+
+// ran records that a refresh started at start and took d, or is still running
+// if d is zero.
+func (w *refreshWorker) ran(start time.Time, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if d == 0 {
+		w.status.Runs++
+	}
+	w.status.LastRun = start
+	w.status.LastDuration = d
+}
+
+// RefreshRoutingTableAsync triggers a routing table refresh like
+// RefreshRoutingTable, and returns a channel receiving its outcome once it's
+// done.
+//
+// Callers don't join a refresh already in progress, which may have looked at
+// the routing table before they called: they all wait for the next one, which
+// starts as soon as the one in progress is done and is shared by every caller
+// that came in the meantime. Concurrent calls thus cause a single refresh, and
+// all get its result.
+//
+// The channel is closed without a result if the DHT is closed first. Should
+// the refresh worker stop on its own, callers wait until it's restarted, see
+// RestartRefreshWorker.
+func (dht *IpfsDHT) RefreshRoutingTableAsync() <-chan opts.RefreshResult {
+	ch := make(chan opts.RefreshResult, 1)
+	w := &dht.rtRefreshWorker
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		close(ch)
+		return ch
+	}
+	w.waiters = append(w.waiters, ch)
+	w.mu.Unlock()
+
+	if dht.rtRefreshEscalation != nil {
+		dht.rtRefreshEscalation.trigger()
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+		// already signalled.
+	}
+	return ch
+}
+
+// ErrRefreshWorkerClosed is returned by RestartRefreshWorker once the DHT is
+// closed.
+var ErrRefreshWorkerClosed = errors.New("can't restart the refresh worker of a closed dht")
+
+// RefreshWorkerStatus returns the state of the worker refreshing the routing
+// table in the background, see the RoutingTableRefreshPeriod option.
+func (dht *IpfsDHT) RefreshWorkerStatus() WorkerStatus {
+	w := &dht.rtRefreshWorker
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := w.status
+	if dht.rtRefreshProc != nil {
+		select {
+		case <-dht.rtRefreshProc.Closing():
+		default:
+			status.Alive = true
+		}
+	}
+	return status
+}
+
+// RestartRefreshWorker stops the routing table refresh worker, waiting for any
+// refresh in progress to be cancelled, and starts a new one. With
+// auto-refresh enabled, the new worker refreshes the routing table right
+// away. It's meant as a recovery lever should the worker ever stop, but
+// restarts a worker that's alive just the same.
+func (dht *IpfsDHT) RestartRefreshWorker() error {
+	select {
+	case <-dht.proc.Closing():
+		return ErrRefreshWorkerClosed
+	default:
+	}
+
+	w := &dht.rtRefreshWorker
+	w.restartMu.Lock()
+	defer w.restartMu.Unlock()
+
+	w.mu.Lock()
+	proc := dht.rtRefreshProc
+	w.mu.Unlock()
+	if proc != nil {
+		if err := proc.Close(); err != nil {
+			logger.Warningf("error stopping the refresh worker: %s", err)
+		}
+	}
+	logger.Infof("restarting the refresh worker")
+	if err := dht.startRefreshing(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.status.Restarts++
+	w.mu.Unlock()
+	return nil
+}
+
+// stopRefreshing stops the refresh worker for good.
+func (dht *IpfsDHT) stopRefreshing() error {
+	w := &dht.rtRefreshWorker
+	w.mu.Lock()
+	w.closed = true
+	proc := dht.rtRefreshProc
+	w.mu.Unlock()
+	var err error
+	if proc != nil {
+		err = proc.Close()
+	}
+	for _, ch := range w.takeWaiters() {
+		close(ch)
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+// replicationProbeConcurrency is the number of peers CheckReplication probes
+// in parallel.
+var replicationProbeConcurrency = AlphaValue
+
+// ReplicationStatus reports how well a record is replicated at the closest
+// peers to its key.
+type ReplicationStatus struct {
+	// Closest is the number of closest peers to the key that were probed.
+	Closest int
+	// Holders are the probed peers that returned a valid record for the key.
+	Holders []peer.ID
+	// Invalid is the number of probed peers that returned an invalid record.
+	Invalid int
+	// Unreachable is the number of probed peers that failed to respond.
+	Unreachable int
+}
+
+// CheckReplication finds the closest peers to the given key and asks each of
+// them for the record, to tell whether it's still stored in the network or
+// needs to be republished. It doesn't compare the records returned, only that
+// they're valid.
+func (dht *IpfsDHT) CheckReplication(ctx context.Context, key string) (ReplicationStatus, error) {
+	var status ReplicationStatus
+
+	pchan, err := dht.getClosestPeers(ctx, key, nil, nil)
+	if err != nil {
+		return status, err
+	}
+
+	var (
+		wg  sync.WaitGroup
+		lk  sync.Mutex
+		sem = make(chan struct{}, replicationProbeConcurrency)
+	)
+	for p := range pchan {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue // drain pchan
+		}
+		status.Closest++
+
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			rec, _, err := dht.getValueOrPeers(ctx, p, key)
+
+			lk.Lock()
+			defer lk.Unlock()
+			switch {
+			case err == nil && rec != nil:
+				status.Holders = append(status.Holders, p)
+			case err == errInvalidRecord:
+				status.Invalid++
+			case err == nil, err == routing.ErrNotFound:
+				// responded without the record.
+			default:
+				logger.Debugf("failed to probe %s for %s: %s", p, key, err)
+				status.Unreachable++
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	return status, ctx.Err()
+}
@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	u "github.com/ipfs/go-ipfs-util"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+func TestCheckReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+
+	for _, d := range dhts {
+		d.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
+	}
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	for _, d := range dhts[1:3] {
+		if err := d.putLocal("/v/hello", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	status, err := dhts[0].CheckReplication(ctxT, "/v/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Closest != 3 {
+		t.Errorf("expected 3 closest peers to be probed, got %d", status.Closest)
+	}
+	if len(status.Holders) != 2 {
+		t.Errorf("expected 2 peers to hold the record, got %v", status.Holders)
+	}
+	if status.Unreachable != 0 || status.Invalid != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+// cancelValidator cancels the context once a record gets validated.
+type cancelValidator struct {
+	blankValidator
+	cancel context.CancelFunc
+}
+
+func (v cancelValidator) Validate(_ string, _ []byte) error {
+	v.cancel()
+	return nil
+}
+
+func TestCheckReplicationCanceled(t *testing.T) {
+	concurrency := replicationProbeConcurrency
+	replicationProbeConcurrency = 1
+	defer func() { replicationProbeConcurrency = concurrency }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+
+	for _, d := range dhts[1:] {
+		d.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
+		connect(t, ctx, dhts[0], d)
+	}
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	for _, d := range dhts[1:] {
+		if err := d.putLocal("/v/hello", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first record received cancels the check, so that the peers left
+	// aren't probed.
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	dhts[0].Validator.(record.NamespacedValidator)["v"] = cancelValidator{cancel: cancel}
+	status, err := dhts[0].CheckReplication(ctxT, "/v/hello")
+	if err != context.Canceled {
+		t.Fatalf("expected the check to be canceled, got %v", err)
+	}
+	if probed := len(status.Holders) + status.Invalid + status.Unreachable; status.Closest != probed {
+		t.Errorf("expected only the %d probed peers to be counted, got %+v", probed, status)
+	}
+}
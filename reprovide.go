@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	process "github.com/jbenet/goprocess"
+	processctx "github.com/jbenet/goprocess/context"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// reprovideConcurrency is the number of keys the reprovide worker announces in
+// parallel.
+var reprovideConcurrency = 8
+
+// reprovideTimeout bounds the time spent announcing a single key.
+var reprovideTimeout = time.Minute
+
+// startReproviding starts the worker reproviding the keys yielded by the
+// reprovide source every reprovide interval. The first cycle runs one interval
+// after startup, once the routing table has had a chance to fill up.
+func (dht *IpfsDHT) startReproviding() {
+	dht.reprovideProc = process.Go(func(proc process.Process) {
+		ctx := processctx.OnClosingContext(proc)
+
+		ticker := time.NewTicker(dht.reprovideInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			dht.reprovide(ctx)
+		}
+	})
+}
+
+// reprovide announces every key yielded by the reprovide source. The source is
+// asked for its keys anew every cycle so it may change between cycles, and keys
+// are streamed so large sets are never held in memory at once.
+func (dht *IpfsDHT) reprovide(ctx context.Context) {
+	keys, err := dht.reprovideSource.Keys(ctx)
+	if err != nil {
+		logger.Warningf("failed to list keys to reprovide: %s", err)
+		return
+	}
+
+	start := time.Now()
+	var (
+		wg               sync.WaitGroup
+		lk               sync.Mutex
+		provided, failed int
+	)
+	for i := 0; i < reprovideConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range keys {
+				err := dht.reprovideKey(ctx, c)
+
+				lk.Lock()
+				if err != nil {
+					logger.Debugf("failed to reprovide %s: %s", c, err)
+					failed++
+				} else {
+					provided++
+				}
+				lk.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+	logger.Infof("reprovided %d keys in %s (%d failed)", provided, time.Since(start), failed)
+}
+
+func (dht *IpfsDHT) reprovideKey(ctx context.Context, c cid.Cid) error {
+	if dht.reprovideRegions != nil {
+		release, err := dht.reprovideRegions.acquire(ctx, c.KeyString())
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	ctx, cancel := context.WithTimeout(ctx, reprovideTimeout)
+	defer cancel()
+	return dht.Provide(ctx, c, true)
+}
+
+// regionLimiter limits the number of concurrent operations on keys in the same
+// region of the keyspace, see the ReprovideRegionConcurrency option.
+type regionLimiter struct {
+	bits int
+	n    int
+
+	lk      sync.Mutex
+	regions map[uint32]*keyRegion
+}
+
+type keyRegion struct {
+	sem   chan struct{}
+	users int // holders and waiters, the region is forgotten once there are none
+}
+
+func newRegionLimiter(bits, n int) *regionLimiter {
+	return &regionLimiter{bits: bits, n: n, regions: make(map[uint32]*keyRegion)}
+}
+
+// region returns the first bits of the hash of key.
+func (l *regionLimiter) region(key string) uint32 {
+	return binary.BigEndian.Uint32(kb.ConvertKey(key)) >> uint(32-l.bits)
+}
+
+// acquire waits for a slot in the region of key, and returns the function
+// releasing it.
+func (l *regionLimiter) acquire(ctx context.Context, key string) (func(), error) {
+	id := l.region(key)
+	l.lk.Lock()
+	r, ok := l.regions[id]
+	if !ok {
+		r = &keyRegion{sem: make(chan struct{}, l.n)}
+		l.regions[id] = r
+	}
+	r.users++
+	l.lk.Unlock()
+
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.leave(id, r)
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-r.sem
+		l.leave(id, r)
+	}, nil
+}
+
+func (l *regionLimiter) leave(id uint32, r *keyRegion) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if r.users--; r.users == 0 {
+		delete(l.regions, id)
+	}
+}
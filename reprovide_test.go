@@ -0,0 +1,136 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+)
+
+type testContentSource struct {
+	keys  []cid.Cid
+	calls int
+}
+
+func (s *testContentSource) Keys(ctx context.Context) (<-chan cid.Cid, error) {
+	s.calls++
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		for _, k := range s.keys {
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func TestReprovide(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+
+	src := &testContentSource{keys: testCaseCids[:3]}
+	dhts[0].reprovideSource = src
+	dhts[0].reprovide(ctx)
+
+	if src.calls != 1 {
+		t.Fatalf("expected the source to be listed once, got %d", src.calls)
+	}
+	// ADD_PROVIDER messages are processed asynchronously by the other peer.
+	waitForProvider := func(k cid.Cid) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			provs := dhts[1].providers.GetProviders(ctx, k)
+			if len(provs) == 1 && provs[0] == dhts[0].self {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s to be reprovided to the other peer, got %v", k, provs)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, k := range src.keys {
+		waitForProvider(k)
+	}
+
+	// the source is listed again on the next cycle, picking up new keys.
+	src.keys = testCaseCids[3:4]
+	dhts[0].reprovide(ctx)
+	waitForProvider(testCaseCids[3])
+}
+
+func TestReprovideSourceOption(t *testing.T) {
+	var cfg opts.Options
+	if err := cfg.Apply(opts.WithReprovideSource(&testContentSource{}, 0)); err == nil {
+		t.Error("expected a zero interval to be rejected")
+	}
+	if err := cfg.Apply(opts.WithReprovideSource(&testContentSource{}, time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Reprovide.Interval != time.Hour {
+		t.Errorf("expected an interval of 1h, got %s", cfg.Reprovide.Interval)
+	}
+}
+
+func TestReprovideRegionLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := newRegionLimiter(1, 1)
+	// find two keys in one half of the keyspace and one in the other.
+	var same, other []string
+	for i := 0; len(same) < 2 || len(other) < 1; i++ {
+		k := string(rune('a' + i))
+		if l.region(k) == l.region("a") {
+			same = append(same, k)
+		} else {
+			other = append(other, k)
+		}
+	}
+
+	release, err := l.acquire(ctx, same[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx, tcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer tcancel()
+	if _, err := l.acquire(tctx, same[1]); err != context.DeadlineExceeded {
+		t.Fatalf("expected keys in the same region to wait, got %v", err)
+	}
+	releaseOther, err := l.acquire(ctx, other[0])
+	if err != nil {
+		t.Fatalf("expected keys in another region to go ahead, got %v", err)
+	}
+	releaseOther()
+
+	release()
+	release, err = l.acquire(ctx, same[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if len(l.regions) != 0 {
+		t.Fatalf("expected idle regions to be forgotten, got %d", len(l.regions))
+	}
+
+	var cfg opts.Options
+	if err := cfg.Apply(opts.ReprovideRegionConcurrency(33, 1)); err == nil {
+		t.Error("expected more than 32 region bits to be rejected")
+	}
+}
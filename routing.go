@@ -3,7 +3,9 @@ package dht
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"runtime"
 	"sync"
 	"time"
@@ -44,13 +46,33 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	}()
 	logger.Debugf("PutValue %s", key)
 
+	if dht.replica {
+		return ErrReadOnlyReplica
+	}
+
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return err
+	}
+
 	// don't even allow local users to put bad values.
-	if err := dht.Validator.Validate(key, value); err != nil {
+	if err := dht.validatorFor(key).Validate(key, value); err != nil {
 		return err
 	}
+	if err := dht.checkRecordSize(key, value); err != nil {
+		return err
+	}
+
+	if dht.putLocks != nil {
+		unlock, err := dht.putLocks.lock(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
 
 	old, err := dht.getLocal(key)
-	if err != nil {
+	if err := dht.checkDatastoreError(err); err != nil {
 		// Means something is wrong with the datastore.
 		return err
 	}
@@ -58,7 +80,7 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	// Check if we have an old value that's not the same as the new one.
 	if old != nil && !bytes.Equal(old.GetValue(), value) {
 		// Check to see if the new one is better.
-		i, err := dht.Validator.Select(key, [][]byte{value, old.GetValue()})
+		i, err := dht.validatorFor(key).Select(key, [][]byte{value, old.GetValue()})
 		if err != nil {
 			return err
 		}
@@ -67,20 +89,42 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 		}
 	}
 
+	// With a conflict policy, the closest peers are asked for their record
+	// before we store anything.
+	var closest []peer.ID
+	policy, checkConflicts := getPutValueConflictPolicy(&cfg)
+	if checkConflicts {
+		if closest, err = dht.closestPeerList(ctx, key); err != nil {
+			return err
+		}
+		if value, err = dht.resolvePutConflict(ctx, key, value, closest, policy); err != nil {
+			return err
+		}
+	}
+
+	if dht.valueCache != nil {
+		dht.valueCache.remove(key)
+	}
+
 	rec := record.MakePutRecord(key, value)
 	rec.TimeReceived = u.FormatRFC3339(time.Now())
 	err = dht.putLocal(key, rec)
-	if err != nil {
+	if err := dht.checkDatastoreError(err); err != nil {
 		return err
 	}
 
-	pchan, err := dht.GetClosestPeers(ctx, key)
-	if err != nil {
-		return err
+	if !checkConflicts {
+		if closest, err = dht.closestPeerList(ctx, key); err != nil {
+			return err
+		}
 	}
 
-	wg := sync.WaitGroup{}
-	for p := range pchan {
+	var (
+		wg     sync.WaitGroup
+		newerL sync.Mutex
+		newer  *NewerRecordError
+	)
+	for _, p := range closest {
 		wg.Add(1)
 		go func(p peer.ID) {
 			ctx, cancel := context.WithCancel(ctx)
@@ -95,13 +139,42 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 			if err != nil {
 				logger.Debugf("failed putting value to peer: %s", err)
 			}
+			if nerr, ok := err.(*NewerRecordError); ok {
+				newerL.Lock()
+				if newer == nil {
+					newer = nerr
+				}
+				newerL.Unlock()
+			}
 		}(p)
 	}
 	wg.Wait()
 
+	if newer != nil {
+		// the other peers got our record, but it's already been superseded.
+		return newer
+	}
 	return nil
 }
 
+func (dht *IpfsDHT) closestPeerList(ctx context.Context, key string) ([]peer.ID, error) {
+	pchan, err := dht.getClosestPeers(ctx, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var peers []peer.ID
+	for p := range pchan {
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// ErrNotCorroborated is returned by GetValue when trusted corroboration is
+// required and none of the trusted peers returned the best value found.
+var ErrNotCorroborated = errors.New("value not corroborated by a trusted peer")
+
+var errNoTrustedPeers = errors.New("trusted corroboration requires at least one trusted peer")
+
 // RecvdVal stores a value and the peer from which we got the value.
 type RecvdVal struct {
 	Val  []byte
@@ -126,7 +199,15 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 	}
 	opts = append(opts, Quorum(getQuorum(&cfg, defaultQuorum)))
 
-	responses, err := dht.SearchValue(ctx, key, opts...)
+	// cached values may not have been corroborated by trusted peers.
+	useCache := dht.valueCache != nil && !cfg.Offline && !getNoCache(&cfg) && !getTrustedCorroboration(&cfg)
+	if useCache {
+		if val := dht.valueFromCache(key); val != nil {
+			return val, nil
+		}
+	}
+
+	responses, search, err := dht.searchValue(ctx, key, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -140,33 +221,105 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 		return best, ctx.Err()
 	}
 
+	if search.truncated {
+		return best, ErrRPCBudgetExhausted
+	}
+
 	if best == nil {
+		if search.uncorroborated {
+			return nil, ErrNotCorroborated
+		}
 		return nil, routing.ErrNotFound
 	}
 	logger.Debugf("GetValue %v %v", key, best)
+	if useCache {
+		dht.valueCache.put(key, best)
+	}
 	return best, nil
 }
 
 func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	out, _, err := dht.searchValue(ctx, key, opts...)
+	return out, err
+}
+
+// valueSearch reports on a value search once its output channel is closed.
+type valueSearch struct {
+	// uncorroborated is set when values were found but none of them was
+	// returned by a trusted peer.
+	uncorroborated bool
+
+	// truncated is set when the query ran out of RPC budget.
+	truncated bool
+}
+
+func (dht *IpfsDHT) searchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, *valueSearch, error) {
 	var cfg routing.Options
 	if err := cfg.Apply(opts...); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	unvalidated := dht.unvalidatedGet(key)
+	if ns, ok := dht.unknownNamespace(key); ok && !unvalidated {
+		return nil, nil, &UnknownNamespaceError{Namespace: ns}
 	}
 
 	responsesNeeded := 0
 	if !cfg.Offline {
 		responsesNeeded = getQuorum(&cfg, -1)
+		if unvalidated {
+			// there's no way to select among several values.
+			responsesNeeded = 1
+		}
+
+		if policy, ok := getValueFreshness(&cfg); ok {
+			if val := dht.cachedValue(key, policy, getBackgroundRefresh(&cfg)); val != nil {
+				out := make(chan []byte, 1)
+				out <- val
+				close(out)
+				return out, new(valueSearch), nil
+			}
+		}
+	}
+
+	trusted := getTrustedPeers(&cfg)
+	requireCorroboration := getTrustedCorroboration(&cfg)
+	if requireCorroboration && (trusted == nil || trusted.Size() == 0) {
+		return nil, nil, errNoTrustedPeers
+	}
+	vq := &valueQuery{
+		maxRPCs:    getMaxRPCs(&cfg),
+		freshDials: getForceFreshDials(&cfg),
+		negative:   getNegativeResultPolicy(&cfg),
+	}
+	if trusted != nil {
+		vq.seeds = trusted.Peers()
 	}
 
-	valCh, err := dht.getValues(ctx, key, responsesNeeded)
+	valCh, err := dht.getValues(ctx, key, responsesNeeded, vq)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	search := new(valueSearch)
 	out := make(chan []byte)
 	go func() {
 		defer close(out)
 
+		// corroborated tracks the values returned by at least one trusted
+		// peer. Values are only sent out once corroborated.
+		var corroborated map[string]struct{}
+		if requireCorroboration {
+			corroborated = make(map[string]struct{})
+		}
+		isCorroborated := func(val []byte) bool {
+			if corroborated == nil {
+				return true
+			}
+			_, ok := corroborated[string(val)]
+			return ok
+		}
+
 		maxVals := responsesNeeded
 		if maxVals < 0 {
 			maxVals = defaultQuorum * 4 // we want some upper bound on how
@@ -177,18 +330,40 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing
 		// when we exit this function
 		vals := make([]RecvdVal, 0, maxVals)
 		var best *RecvdVal
+		var sent bool
 
 		defer func() {
-			if len(vals) <= 1 || best == nil {
+			search.uncorroborated = best != nil && !sent
+			// only safe to read once valCh is closed.
+			search.truncated = ctx.Err() == nil && vq.truncated
+		}()
+
+		// distinct collects the distinct valid values we got, for the
+		// OnRecordConflict hook.
+		var distinct [][]byte
+		defer func() {
+			if best != nil && len(distinct) > 1 {
+				dht.reportRecordConflict(key, distinct, best.Val)
+			}
+		}()
+
+		defer func() {
+			// don't spread a value no trusted peer vouched for
+			if len(vals) <= 1 || best == nil || !isCorroborated(best.Val) {
 				return
 			}
 			fixupRec := record.MakePutRecord(key, best.Val)
+			localRec := record.MakePutRecord(key, best.Val)
+			localRec.TimeReceived = u.FormatRFC3339(time.Now())
 			for _, v := range vals {
 				// if someone sent us a different 'less-valid' record, lets correct them
 				if !bytes.Equal(v.Val, best.Val) {
 					go func(v RecvdVal) {
 						if v.From == dht.self {
-							err := dht.putLocal(key, fixupRec)
+							if dht.replica {
+								return
+							}
+							err := dht.putLocal(key, localRec)
 							if err != nil {
 								logger.Error("Error correcting local dht entry:", err)
 							}
@@ -219,21 +394,31 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing
 				if v.Val == nil {
 					continue
 				}
+				if dht.onRecordConflict != nil {
+					distinct = appendDistinct(distinct, v.Val)
+				}
+				if corroborated != nil && trusted.Contains(v.From) {
+					corroborated[string(v.Val)] = struct{}{}
+				}
 				// Select best value
-				if best != nil {
-					if bytes.Equal(best.Val, v.Val) {
-						continue
-					}
-					sel, err := dht.Validator.Select(key, [][]byte{best.Val, v.Val})
-					if err != nil {
-						logger.Warning("Failed to select dht key: ", err)
-						continue
-					}
-					if sel != 1 {
-						continue
+				if best == nil || !bytes.Equal(best.Val, v.Val) {
+					if best != nil {
+						sel, err := dht.validatorFor(key).Select(key, [][]byte{best.Val, v.Val})
+						if err != nil {
+							logger.Warning("Failed to select dht key: ", err)
+							continue
+						}
+						if sel != 1 {
+							continue
+						}
 					}
+					best = &v
+					sent = false
+				}
+				if sent || !isCorroborated(best.Val) {
+					continue
 				}
-				best = &v
+				sent = true
 				select {
 				case out <- v.Val:
 				case <-ctx.Done():
@@ -245,7 +430,101 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing
 		}
 	}()
 
-	return out, nil
+	return out, search, nil
+}
+
+// revalidateTimeout bounds the background lookups refreshing stale local
+// records, see ValueFreshnessPolicy.
+var revalidateTimeout = time.Minute
+
+// cachedValue returns our local value for key if the freshness policy allows
+// returning it without a lookup. If it's only returned because the policy
+// doesn't prefer fresh values, or if refreshOnHit is set, it's refreshed from
+// the network in the background.
+func (dht *IpfsDHT) cachedValue(key string, policy ValueFreshnessPolicy, refreshOnHit bool) []byte {
+	rec, err := dht.getLocal(key)
+	if err != nil || rec == nil {
+		return nil
+	}
+	if err := dht.validatorFor(key).Validate(key, rec.GetValue()); err != nil {
+		logger.Debugf("local record for %s is invalid: %s", key, err)
+		return nil
+	}
+
+	fresh := false
+	if recvtime, err := u.ParseRFC3339(rec.GetTimeReceived()); err == nil {
+		fresh = time.Since(recvtime) <= policy.MaxStaleness
+	}
+	if !fresh && policy.PreferFresh {
+		return nil
+	}
+	if !fresh || refreshOnHit {
+		dht.refreshLocalValue(key)
+	}
+	return rec.GetValue()
+}
+
+// refreshLocalValue looks key up in the background, unless that's already
+// being done. The lookup fixes up our local record if it finds a better one.
+func (dht *IpfsDHT) refreshLocalValue(key string) {
+	dht.refreshingLk.Lock()
+	defer dht.refreshingLk.Unlock()
+	if _, ok := dht.refreshing[key]; ok {
+		return
+	}
+	if dht.refreshing == nil {
+		dht.refreshing = make(map[string]struct{})
+	}
+	dht.refreshing[key] = struct{}{}
+
+	go func() {
+		defer func() {
+			dht.refreshingLk.Lock()
+			delete(dht.refreshing, key)
+			dht.refreshingLk.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(dht.Context(), revalidateTimeout)
+		defer cancel()
+		if _, err := dht.GetValue(ctx, key); err != nil {
+			logger.Debugf("failed to refresh local record for %s: %s", key, err)
+		}
+	}()
+}
+
+// maxConflictRecords bounds the number of distinct records reported to the
+// OnRecordConflict hook.
+var maxConflictRecords = 8
+
+// appendDistinct appends val to vals unless it's already there or there are
+// already maxConflictRecords values.
+func appendDistinct(vals [][]byte, val []byte) [][]byte {
+	if len(vals) >= maxConflictRecords {
+		return vals
+	}
+	for _, v := range vals {
+		if bytes.Equal(v, val) {
+			return vals
+		}
+	}
+	return append(vals, val)
+}
+
+// reportRecordConflict calls the OnRecordConflict hook with the distinct
+// records we got for the key and the index of the selected one. The selected
+// record replaces the last one if it didn't make the cut.
+func (dht *IpfsDHT) reportRecordConflict(key string, records [][]byte, selected []byte) {
+	idx := -1
+	for i, r := range records {
+		if bytes.Equal(r, selected) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		idx = len(records) - 1
+		records[idx] = selected
+	}
+	dht.onRecordConflict(key, records, idx)
 }
 
 // GetValues gets nvals values corresponding to the given key.
@@ -255,7 +534,7 @@ func (dht *IpfsDHT) GetValues(ctx context.Context, key string, nvals int) (_ []R
 	eip.Append(loggableKey(key))
 	defer eip.Done()
 
-	valCh, err := dht.getValues(ctx, key, nvals)
+	valCh, err := dht.getValues(ctx, key, nvals, &valueQuery{})
 	if err != nil {
 		eip.SetError(err)
 		return nil, err
@@ -269,7 +548,21 @@ func (dht *IpfsDHT) GetValues(ctx context.Context, key string, nvals int) (_ []R
 	return out, ctx.Err()
 }
 
-func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-chan RecvdVal, error) {
+// valueQuery configures a getValues query and reports how it went.
+type valueQuery struct {
+	seeds   []peer.ID // queried along with the closest peers in the routing table
+	maxRPCs int       // see the MaxRPCs option
+
+	freshDials bool                 // see the ForceFreshDials option
+	negative   NegativeResultPolicy // see the NegativeResults option
+
+	// truncated is set before the values channel is closed if the query ran
+	// out of RPC budget.
+	truncated bool
+}
+
+// getValues queries the network for values of the given key.
+func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int, vq *valueQuery) (<-chan RecvdVal, error) {
 	vals := make(chan RecvdVal, 1)
 
 	done := func(err error) (<-chan RecvdVal, error) {
@@ -279,7 +572,7 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 
 	// If we have it local, don't bother doing an RPC!
 	lrec, err := dht.getLocal(key)
-	if err != nil {
+	if err := dht.checkDatastoreError(err); err != nil {
 		// something is wrong with the datastore.
 		return done(err)
 	}
@@ -302,8 +595,19 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 	}
 
 	// get closest peers in the routing table
-	rtp := dht.routingTable.NearestPeers(kb.ConvertKey(key), AlphaValue)
+	rtp := dht.seedPeers(kb.ConvertKey(key), AlphaValue)
 	logger.Debugf("peers in rt: %d %s", len(rtp), rtp)
+	if len(vq.seeds) > 0 {
+		set := peer.NewSet()
+		for _, p := range rtp {
+			set.Add(p)
+		}
+		for _, p := range vq.seeds {
+			if set.TryAdd(p) {
+				rtp = append(rtp, p)
+			}
+		}
+	}
 	if len(rtp) == 0 {
 		logger.Warning("No peers from routing table!")
 		return done(kb.ErrLookupFailure)
@@ -312,6 +616,27 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 	var valslock sync.Mutex
 	var got int
 
+	// authoritativeMiss reports whether p answering it has no record, along
+	// with peers, ends the query under the NegativeResultsAuthoritative
+	// policy.
+	authoritativeMiss := func(p peer.ID, peers []*peer.AddrInfo) bool {
+		if vq.negative != NegativeResultsAuthoritative || lrec != nil {
+			return false
+		}
+		for _, pi := range peers {
+			if kb.Closer(pi.ID, p, key) {
+				return false
+			}
+		}
+		valslock.Lock()
+		defer valslock.Unlock()
+		if got > 0 {
+			return false
+		}
+		logger.Debugf("%s has no record for %s and knows no closer peer, ending query", p, loggableKey(key))
+		return true
+	}
+
 	// setup the Query
 	parent := ctx
 	query := dht.newQuery(key, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
@@ -330,6 +655,9 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 				Type: routing.PeerResponse,
 				ID:   p,
 			})
+			if authoritativeMiss(p, nil) {
+				return &dhtQueryResult{success: true}, nil
+			}
 			return nil, err
 		default:
 			return nil, err
@@ -359,6 +687,8 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 				res.success = true
 			}
 			valslock.Unlock()
+		} else if authoritativeMiss(p, peers) {
+			res.success = true
 		}
 
 		routing.PublishQueryEvent(parent, &routing.QueryEvent{
@@ -369,12 +699,16 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 
 		return res, nil
 	})
+	query.op = "GetValue"
+	query.maxRPCs = vq.maxRPCs
+	query.freshDials = vq.freshDials
 
 	go func() {
 		reqCtx, cancel := context.WithTimeout(ctx, time.Minute)
 		defer cancel()
 
 		_, err = query.Run(reqCtx, rtp)
+		vq.truncated = err == ErrRPCBudgetExhausted
 
 		// We do have some values but we either ran out of peers to query or
 		// searched for a whole minute.
@@ -396,8 +730,34 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 // Some DHTs store values directly, while an indirect store stores pointers to
 // locations of the value, similarly to Coral and Mainline DHT.
 
+// ProvideStats reports how an announcement of a provider record went.
+type ProvideStats struct {
+	// ClosestSent and ClosestAccepted are the number of peers among the closest
+	// peers to the key we tried to send the record to and that accepted it.
+	ClosestSent     int
+	ClosestAccepted int
+	// RandomSent and RandomAccepted are the number of random peers (see the
+	// ProvideExtraFanout option) we tried to send the record to and that
+	// accepted it.
+	RandomSent     int
+	RandomAccepted int
+}
+
 // Provide makes this node announce that it can provide a value for the given key
-func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err error) {
+func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) error {
+	_, err := dht.ProvideWithStats(ctx, key, brdcst)
+	return err
+}
+
+// ProvideWithStats is like Provide but also reports which peers the provider
+// record was announced to.
+func (dht *IpfsDHT) ProvideWithStats(ctx context.Context, key cid.Cid, brdcst bool) (ProvideStats, error) {
+	return dht.provide(ctx, key, brdcst, nil)
+}
+
+// provide announces the provider record, recording each step in trace if it
+// isn't nil.
+func (dht *IpfsDHT) provide(ctx context.Context, key cid.Cid, brdcst bool, trace *ProvideTrace) (stats ProvideStats, err error) {
 	eip := logger.EventBegin(ctx, "Provide", key, logging.LoggableMap{"broadcast": brdcst})
 	defer func() {
 		if err != nil {
@@ -406,10 +766,17 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 		eip.Done()
 	}()
 
+	if dht.replica {
+		return stats, ErrReadOnlyReplica
+	}
+
 	// add self locally
-	dht.providers.AddProvider(ctx, key, dht.self)
+	err = dht.providers.AddProvider(ctx, key, dht.self)
+	if err := dht.checkProviderDatastoreError(err); err != nil {
+		return stats, err
+	}
 	if !brdcst {
-		return nil
+		return stats, nil
 	}
 
 	closerCtx := ctx
@@ -419,7 +786,7 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 
 		if timeout < 0 {
 			// timed out
-			return context.DeadlineExceeded
+			return stats, context.DeadlineExceeded
 		} else if timeout < 10*time.Second {
 			// Reserve 10% for the final put.
 			deadline = deadline.Add(-timeout / 10)
@@ -433,31 +800,90 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 		defer cancel()
 	}
 
-	peers, err := dht.GetClosestPeers(closerCtx, key.KeyString())
+	var concurrency *QueryConcurrencyStats
+	if trace != nil {
+		concurrency = &trace.Concurrency
+	}
+	peers, err := dht.getClosestPeers(closerCtx, key.KeyString(), concurrency, nil)
 	if err != nil {
-		return err
+		return stats, err
 	}
 
 	mes, err := dht.makeProvRecord(key)
 	if err != nil {
-		return err
+		return stats, err
 	}
 
+	var statsLk sync.Mutex
 	wg := sync.WaitGroup{}
+	putProvider := func(p peer.ID, random bool) {
+		defer wg.Done()
+		logger.Debugf("putProvider(%s, %s)", key, p)
+		start := time.Now()
+		err := dht.sendMessage(ctx, p, mes)
+		statsLk.Lock()
+		defer statsLk.Unlock()
+		if trace != nil {
+			trace.Sends = append(trace.Sends, ProvideSend{
+				Peer:     p,
+				Random:   random,
+				Err:      err,
+				Duration: time.Since(start),
+			})
+		}
+		if err != nil {
+			logger.Debug(err)
+			return
+		}
+		if random {
+			stats.RandomAccepted++
+		} else {
+			stats.ClosestAccepted++
+		}
+	}
+
+	closest := make(map[peer.ID]struct{})
 	for p := range peers {
+		if trace != nil {
+			trace.Closest = append(trace.Closest, p)
+		}
+		closest[p] = struct{}{}
+		stats.ClosestSent++
 		wg.Add(1)
-		go func(p peer.ID) {
-			defer wg.Done()
-			logger.Debugf("putProvider(%s, %s)", key, p)
-			err := dht.sendMessage(ctx, p, mes)
-			if err != nil {
-				logger.Debug(err)
-			}
-		}(p)
+		go putProvider(p, false)
+	}
+	for _, p := range dht.randomPeersExcluding(dht.provideExtraFanout, closest) {
+		stats.RandomSent++
+		wg.Add(1)
+		go putProvider(p, true)
 	}
 	wg.Wait()
-	return nil
+	return stats, nil
+}
+
+// randomPeersExcluding returns up to n random peers from the routing table
+// that aren't in the excluded set.
+func (dht *IpfsDHT) randomPeersExcluding(n int, excluded map[peer.ID]struct{}) []peer.ID {
+	if n <= 0 {
+		return nil
+	}
+	candidates := dht.routingTable.ListPeers()
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	out := make([]peer.ID, 0, n)
+	for _, p := range candidates {
+		if len(out) >= n {
+			break
+		}
+		if _, ok := excluded[p]; ok {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
 }
+
 func (dht *IpfsDHT) makeProvRecord(skey cid.Cid) (*pb.Message, error) {
 	pi := peer.AddrInfo{
 		ID:    dht.self,
@@ -477,9 +903,29 @@ func (dht *IpfsDHT) makeProvRecord(skey cid.Cid) (*pb.Message, error) {
 
 // FindProviders searches until the context expires.
 func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrInfo, error) {
-	var providers []peer.AddrInfo
-	for p := range dht.FindProvidersAsync(ctx, c, dht.bucketSize) {
-		providers = append(providers, p)
+	if !dht.mergeProviderAddrs {
+		var providers []peer.AddrInfo
+		for p := range dht.FindProvidersAsync(ctx, c, dht.bucketSize) {
+			providers = append(providers, p)
+		}
+		return providers, nil
+	}
+
+	var (
+		lk        sync.Mutex
+		providers []peer.AddrInfo
+	)
+	merged := newProviderAddrs()
+	dht.findProvidersAsyncRoutine(ctx, c, dht.bucketSize, nil, merged, func(res ProviderResult) bool {
+		lk.Lock()
+		defer lk.Unlock()
+		providers = append(providers, res.AddrInfo)
+		return ctx.Err() == nil
+	})
+	lk.Lock()
+	defer lk.Unlock()
+	for i, pi := range providers {
+		providers[i] = merged.get(pi)
 	}
 	return providers, nil
 }
@@ -491,23 +937,46 @@ func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count i
 	logger.Event(ctx, "findProviders", key)
 	peerOut := make(chan peer.AddrInfo, count)
 
-	go dht.findProvidersAsyncRoutine(ctx, key, count, peerOut)
+	go func() {
+		defer close(peerOut)
+		dht.findProvidersAsyncRoutine(ctx, key, count, nil, nil, func(res ProviderResult) bool {
+			select {
+			case peerOut <- res.AddrInfo:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
 	return peerOut
 }
 
-func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid, count int, peerOut chan peer.AddrInfo) {
+// findProvidersAsyncRoutine finds up to count providers for key, passing them
+// to out until it returns false. Providers are ranked if ranker isn't nil, and
+// the addresses of every provider response are merged into merged if it isn't.
+func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid, count int, ranker *providerRanker, merged *providerAddrs, out func(ProviderResult) bool) {
 	defer logger.EventBegin(ctx, "findProvidersAsync", key).Done()
-	defer close(peerOut)
+
+	send := func(pi peer.AddrInfo) bool {
+		if ranker != nil {
+			return out(ranker.rank(pi))
+		}
+		return out(ProviderResult{AddrInfo: pi})
+	}
 
 	ps := peer.NewLimitedSet(count)
-	provs := dht.providers.GetProviders(ctx, key)
+	provs, err := dht.providers.GetProvidersWithError(ctx, key)
+	if err := dht.checkProviderDatastoreError(err); err != nil {
+		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+			Type:  routing.QueryError,
+			Extra: err.Error(),
+		})
+		return
+	}
 	for _, p := range provs {
 		// NOTE: Assuming that this list of peers is unique
 		if ps.TryAdd(p) {
-			pi := dht.peerstore.PeerInfo(p)
-			select {
-			case peerOut <- pi:
-			case <-ctx.Done():
+			if !send(dht.peerstore.PeerInfo(p)) {
 				return
 			}
 		}
@@ -519,7 +988,21 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid,
 		}
 	}
 
-	peers := dht.routingTable.NearestPeers(kb.ConvertKey(key.KeyString()), AlphaValue)
+	// replay what a recent query for this key already found.
+	if dht.recentResults != nil {
+		for _, pi := range dht.recentResults.get(key) {
+			if ps.TryAdd(pi.ID) {
+				if !send(pi) {
+					return
+				}
+			}
+			if ps.Size() >= count {
+				return
+			}
+		}
+	}
+
+	peers := dht.seedPeers(kb.ConvertKey(key.KeyString()), AlphaValue)
 	if len(peers) == 0 {
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
@@ -544,17 +1027,31 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid,
 		provs := pb.PBPeersToPeerInfos(pmes.GetProviderPeers())
 		logger.Debugf("%d provider entries decoded", len(provs))
 
+		// Give closer peers back to the query to be queried
+		closer := pmes.GetCloserPeers()
+		clpeers := pb.PBPeersToPeerInfos(closer)
+		if ranker != nil {
+			ranker.add(p)
+			ranker.addInfos(clpeers)
+			ranker.addInfos(provs)
+		}
+
 		// Add unique providers from request, up to 'count'
 		for _, prov := range provs {
 			if prov.ID != dht.self {
+				prov.Addrs = dht.withAcceptedScopes(prov.Addrs)
 				dht.peerstore.AddAddrs(prov.ID, prov.Addrs, peerstore.TempAddrTTL)
 			}
 			logger.Debugf("got provider: %s", prov)
+			if merged != nil {
+				merged.add(*prov)
+			}
+			if dht.recentResults != nil {
+				dht.recentResults.add(key, *prov)
+			}
 			if ps.TryAdd(prov.ID) {
 				logger.Debugf("using provider: %s", prov)
-				select {
-				case peerOut <- *prov:
-				case <-ctx.Done():
+				if !send(*prov) {
 					logger.Debug("context timed out sending more providers")
 					return nil, ctx.Err()
 				}
@@ -565,9 +1062,6 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid,
 			}
 		}
 
-		// Give closer peers back to the query to be queried
-		closer := pmes.GetCloserPeers()
-		clpeers := pb.PBPeersToPeerInfos(closer)
 		logger.Debugf("got closer peers: %d %s", len(clpeers), clpeers)
 
 		routing.PublishQueryEvent(parent, &routing.QueryEvent{
@@ -577,8 +1071,9 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid,
 		})
 		return &dhtQueryResult{closerPeers: clpeers}, nil
 	})
+	query.op = "FindProviders"
 
-	_, err := query.Run(ctx, peers)
+	_, err = query.Run(ctx, peers)
 	if err != nil {
 		logger.Debugf("Query error: %s", err)
 		// Special handling for issue: https://github.com/ipfs/go-ipfs/issues/3032
@@ -611,12 +1106,21 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 		eip.Done()
 	}()
 
+	if id == dht.self {
+		return dht.findSelf(ctx)
+	}
+	return dht.findPeer(ctx, id)
+}
+
+// findPeer looks up the given peer on the network, regardless of the
+// SelfInResults option. Looking up our own ID is how we find our neighbours.
+func (dht *IpfsDHT) findPeer(ctx context.Context, id peer.ID) (peer.AddrInfo, error) {
 	// Check if were already connected to them
 	if pi := dht.FindLocal(id); pi.ID != "" {
 		return pi, nil
 	}
 
-	peers := dht.routingTable.NearestPeers(kb.ConvertPeerID(id), AlphaValue)
+	peers := dht.seedPeers(kb.ConvertPeerID(id), AlphaValue)
 	if len(peers) == 0 {
 		return peer.AddrInfo{}, kb.ErrLookupFailure
 	}
@@ -663,6 +1167,7 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 
 		return &dhtQueryResult{closerPeers: clpeerInfos}, nil
 	})
+	query.op = "FindPeer"
 
 	// run it!
 	result, err := query.Run(ctx, peers)
@@ -688,7 +1193,7 @@ func (dht *IpfsDHT) FindPeersConnectedToPeer(ctx context.Context, id peer.ID) (<
 	peersSeen := make(map[peer.ID]struct{})
 	var peersSeenMx sync.Mutex
 
-	peers := dht.routingTable.NearestPeers(kb.ConvertPeerID(id), AlphaValue)
+	peers := dht.seedPeers(kb.ConvertPeerID(id), AlphaValue)
 	if len(peers) == 0 {
 		return nil, kb.ErrLookupFailure
 	}
@@ -733,6 +1238,7 @@ func (dht *IpfsDHT) FindPeersConnectedToPeer(ctx context.Context, id peer.ID) (<
 
 		return &dhtQueryResult{closerPeers: clpeers}, nil
 	})
+	query.op = "FindPeersConnectedToPeer"
 
 	// run it! run it asynchronously to gen peers as results are found.
 	// this does no error checking
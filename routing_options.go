@@ -1,8 +1,22 @@
 package dht
 
-import "github.com/libp2p/go-libp2p-core/routing"
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
 
 type quorumOptionKey struct{}
+type trustedPeersOptionKey struct{}
+type trustedCorroborationOptionKey struct{}
+type maxRPCsOptionKey struct{}
+type freshnessOptionKey struct{}
+type noCacheOptionKey struct{}
+type putConflictOptionKey struct{}
+type freshDialsOptionKey struct{}
+type backgroundRefreshOptionKey struct{}
+type negativeResultsOptionKey struct{}
 
 const defaultQuorum = 16
 
@@ -27,3 +41,255 @@ func getQuorum(opts *routing.Options, ndefault int) int {
 	}
 	return responsesNeeded
 }
+
+// WithTrustedPeers is a DHT option that configures a set of trusted peers for
+// a value lookup. The trusted peers are always part of the peers the query
+// starts from, whether or not they are in our routing table, so their
+// addresses should already be known to the peerstore.
+//
+// On its own this only affects where the query starts. Combine it with
+// RequireTrustedCorroboration to reject values no trusted peer vouches for.
+func WithTrustedPeers(peers ...peer.ID) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		set := peer.NewSet()
+		if prev, ok := opts.Other[trustedPeersOptionKey{}].(*peer.Set); ok {
+			for _, p := range prev.Peers() {
+				set.Add(p)
+			}
+		}
+		for _, p := range peers {
+			set.Add(p)
+		}
+		opts.Other[trustedPeersOptionKey{}] = set
+		return nil
+	}
+}
+
+// RequireTrustedCorroboration is a DHT option that only accepts a value once
+// at least one of the peers configured with WithTrustedPeers has returned it.
+// GetValue fails with ErrNotCorroborated if no trusted peer corroborates the
+// best value found.
+//
+// This trades availability for integrity: if the trusted peers are offline,
+// unreachable or don't hold the record, the lookup fails even though
+// untrusted peers may have returned a perfectly valid value.
+func RequireTrustedCorroboration() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[trustedCorroborationOptionKey{}] = true
+		return nil
+	}
+}
+
+func getTrustedPeers(opts *routing.Options) *peer.Set {
+	set, _ := opts.Other[trustedPeersOptionKey{}].(*peer.Set)
+	return set
+}
+
+func getTrustedCorroboration(opts *routing.Options) bool {
+	required, _ := opts.Other[trustedCorroborationOptionKey{}].(bool)
+	return required
+}
+
+// MaxRPCs is a DHT option that bounds a value lookup by the total number of
+// peers it may query, across all hops. Once the budget is spent, the RPCs
+// still in flight are allowed to finish and GetValue returns the best value
+// found so far along with ErrRPCBudgetExhausted. SearchValue just closes its
+// channel early.
+//
+// Queries send up to AlphaValue RPCs concurrently (see the AdaptiveConcurrency
+// DHT option) and the budget is checked before each one, so it's never
+// exceeded; a budget lower than the concurrency simply limits the query to that
+// many of the closest peers. There is no
+// separate hop limit, a lookup may use its whole budget on a single hop.
+//
+// Default: 0 (no limit)
+func MaxRPCs(n int) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[maxRPCsOptionKey{}] = n
+		return nil
+	}
+}
+
+func getMaxRPCs(opts *routing.Options) int {
+	n, _ := opts.Other[maxRPCsOptionKey{}].(int)
+	return n
+}
+
+// ValueFreshnessPolicy chooses between a fast answer from our own datastore
+// and a fresh one from the network, see ValueFreshness.
+type ValueFreshnessPolicy struct {
+	// MaxStaleness is how long ago we may have received our local record
+	// for it to be returned without querying the network.
+	MaxStaleness time.Duration
+
+	// PreferFresh makes lookups query the network when the local record is
+	// too stale, like they do by default. Otherwise, the stale record is
+	// returned right away and refreshed from the network in the background.
+	PreferFresh bool
+}
+
+// ValueFreshness is a DHT option that lets value lookups return the record in
+// our own datastore instead of querying the network, depending on how fresh
+// it is. Without a local record, the network is always queried.
+//
+// Staleness is measured from when we stored the record, as records don't
+// carry a creation time in all namespaces. A record just received may thus
+// have been published long ago. Local records must still pass validation, so
+// e.g. expired IPNS records are never returned.
+//
+// ValueFreshnessPolicy{PreferFresh: true} is the default behavior. It's
+// ignored by offline lookups, which only ever look at the local record.
+func ValueFreshness(policy ValueFreshnessPolicy) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[freshnessOptionKey{}] = policy
+		return nil
+	}
+}
+
+func getValueFreshness(opts *routing.Options) (ValueFreshnessPolicy, bool) {
+	policy, ok := opts.Other[freshnessOptionKey{}].(ValueFreshnessPolicy)
+	return policy, ok
+}
+
+// BackgroundRefreshOnLocalHit is a DHT option that makes value lookups
+// answered from our own datastore because of the ValueFreshness option look
+// the key up in the network in the background anyway, as they do for stale
+// records. It has no effect without ValueFreshness.
+//
+// The caller gets the local record right away. If the background lookup finds
+// a better record, it replaces the local one, so later lookups return it.
+// There's at most one background lookup per key at a time.
+func BackgroundRefreshOnLocalHit() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[backgroundRefreshOptionKey{}] = true
+		return nil
+	}
+}
+
+func getBackgroundRefresh(opts *routing.Options) bool {
+	refresh, _ := opts.Other[backgroundRefreshOptionKey{}].(bool)
+	return refresh
+}
+
+// NoCache is a DHT option that makes GetValue skip the cache configured with
+// the GetValueCache option and query the network. The value found isn't
+// cached either.
+func NoCache() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[noCacheOptionKey{}] = true
+		return nil
+	}
+}
+
+func getNoCache(opts *routing.Options) bool {
+	noCache, _ := opts.Other[noCacheOptionKey{}].(bool)
+	return noCache
+}
+
+// OnPutValueConflict is a DHT option that makes PutValue ask the closest peers
+// for their record before putting ours, and apply policy if one of them
+// already holds a newer record according to the validator. This costs an extra
+// GET_VALUE per peer.
+//
+// By default, PutValue doesn't check and just sends our record, which peers
+// holding a newer one will refuse.
+func OnPutValueConflict(policy PutValueConflictPolicy) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[putConflictOptionKey{}] = policy
+		return nil
+	}
+}
+
+func getPutValueConflictPolicy(opts *routing.Options) (PutValueConflictPolicy, bool) {
+	policy, ok := opts.Other[putConflictOptionKey{}].(PutValueConflictPolicy)
+	return policy, ok
+}
+
+// ForceFreshDials is an experimental DHT option that makes value lookups only
+// query peers over connections they dial themselves, to measure cold dial
+// latency. It's meant for benchmarks and measurements only.
+//
+// The host reuses existing connections, which other protocols may be using,
+// so peers we're already connected to are skipped rather than dialed again.
+// The connections dialed by the lookup are closed once it's done. Expect
+// lookups to be much slower, and to miss the peers we're connected to.
+func ForceFreshDials() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[freshDialsOptionKey{}] = true
+		return nil
+	}
+}
+
+func getForceFreshDials(opts *routing.Options) bool {
+	fresh, _ := opts.Other[freshDialsOptionKey{}].(bool)
+	return fresh
+}
+
+// NegativeResultPolicy says how a value lookup treats a peer answering it has
+// no record for the key, see NegativeResults.
+type NegativeResultPolicy int
+
+const (
+	// NegativeResultsContinue keeps the lookup going until the closest peers
+	// to the key have all been queried, or the query runs out of peers. This
+	// is the default: a record is found as long as one of the peers we reach
+	// holds it, at the cost of querying every close peer when none does.
+	NegativeResultsContinue NegativeResultPolicy = iota
+
+	// NegativeResultsAuthoritative ends the lookup with routing.ErrNotFound as
+	// soon as a peer that knows no peer closer to the key than itself answers
+	// it has no record, unless a value was already found.
+	//
+	// Lookups for missing keys are much faster, but a single peer's answer
+	// can now hide a record that exists. This happens when the peer missed
+	// the put (records are only sent to the closest peers we knew of at the
+	// time), joined after it, has a sparse routing table and only believes
+	// it's among the closest, or simply lies. Only use it where a false
+	// negative is cheap, e.g. when the caller retries or records are
+	// republished often.
+	NegativeResultsAuthoritative
+)
+
+// NegativeResults is a DHT option that sets how value lookups treat peers
+// answering they have no record for the key. It doesn't apply to provider or
+// peer lookups.
+//
+// Default: NegativeResultsContinue
+func NegativeResults(policy NegativeResultPolicy) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[negativeResultsOptionKey{}] = policy
+		return nil
+	}
+}
+
+func getNegativeResultPolicy(opts *routing.Options) NegativeResultPolicy {
+	policy, _ := opts.Other[negativeResultsOptionKey{}].(NegativeResultPolicy)
+	return policy
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// rtHealthDebounce is how long the routing table has to stay healthy or
+// unhealthy before the change is reported.
+var rtHealthDebounce = 5 * time.Second
+
+// rtHealth reports routing table health changes, see
+// opts.OnRoutingTableHealthChange. The table is healthy when it holds more
+// than minRTRefreshThreshold peers.
+type rtHealth struct {
+	hook func(healthy bool, size int)
+	size func() int
+
+	mu      sync.Mutex
+	healthy bool        // last reported state
+	timer   *time.Timer // pending report, nil if none
+	closed  bool
+}
+
+func newRTHealth(hook func(healthy bool, size int), size func() int) *rtHealth {
+	return &rtHealth{hook: hook, size: size}
+}
+
+// changed is called with the new size of the routing table after each change.
+// It may be called while the routing table is locked.
+func (h *rtHealth) changed(size int) {
+	healthy := size > minRTRefreshThreshold
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	if healthy == h.healthy {
+		// flapped back before the change was reported.
+		if h.timer != nil {
+			h.timer.Stop()
+			h.timer = nil
+		}
+		return
+	}
+	if h.timer == nil {
+		h.timer = time.AfterFunc(rtHealthDebounce, h.report)
+	}
+}
+
+// report calls the hook if the health of the routing table changed since the
+// last report.
+func (h *rtHealth) report() {
+	size := h.size()
+	healthy := size > minRTRefreshThreshold
+
+	h.mu.Lock()
+	h.timer = nil
+	if h.closed || healthy == h.healthy {
+		h.mu.Unlock()
+		return
+	}
+	h.healthy = healthy
+	h.mu.Unlock()
+
+	h.hook(healthy, size)
+}
+
+// stop cancels the pending report, if any, and ignores further changes.
+func (h *rtHealth) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+}
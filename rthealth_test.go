@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRTHealth(t *testing.T) {
+	defer func(d time.Duration) { rtHealthDebounce = d }(rtHealthDebounce)
+	rtHealthDebounce = 50 * time.Millisecond
+
+	var (
+		mu      sync.Mutex
+		size    int
+		reports []bool
+	)
+	setSize := func(n int) {
+		mu.Lock()
+		size = n
+		mu.Unlock()
+	}
+	h := newRTHealth(func(healthy bool, n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if n != size {
+			t.Errorf("expected size %d, got %d", size, n)
+		}
+		reports = append(reports, healthy)
+	}, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return size
+	})
+	change := func(n int) {
+		setSize(n)
+		h.changed(n)
+	}
+	expect := func(want ...bool) {
+		t.Helper()
+		time.Sleep(4 * rtHealthDebounce)
+		mu.Lock()
+		defer mu.Unlock()
+		if len(reports) != len(want) {
+			t.Fatalf("expected %v, got %v", want, reports)
+		}
+		for i := range want {
+			if reports[i] != want[i] {
+				t.Fatalf("expected %v, got %v", want, reports)
+			}
+		}
+	}
+
+	// flapping isn't reported.
+	change(minRTRefreshThreshold + 1)
+	change(minRTRefreshThreshold)
+	expect()
+
+	change(minRTRefreshThreshold + 1)
+	change(minRTRefreshThreshold + 2)
+	expect(true)
+
+	change(minRTRefreshThreshold)
+	expect(true, false)
+
+	h.stop()
+	change(minRTRefreshThreshold + 1)
+	expect(true, false)
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// selfOnlyResponseThreshold is the number of consecutive responses in which a
+// peer returned only itself as a closer peer before we consider it to
+// misbehave. Honest peers never return themselves, as they're already known
+// to the requester.
+var selfOnlyResponseThreshold = 3
+
+// selfOnlyPeers is the maximum number of peers we track self-only responses
+// for.
+var selfOnlyPeers = 1024
+
+// selfOnlyTracker counts consecutive self-only responses per peer.
+type selfOnlyTracker struct {
+	lk     sync.Mutex
+	counts *lru.Cache
+}
+
+func newSelfOnlyTracker() *selfOnlyTracker {
+	counts, err := lru.New(selfOnlyPeers)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	return &selfOnlyTracker{counts: counts}
+}
+
+// record records whether p's latest response contained only p itself.
+func (t *selfOnlyTracker) record(p peer.ID, selfOnly bool) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if !selfOnly {
+		t.counts.Remove(p)
+		return
+	}
+	n, _ := t.counts.Get(p)
+	count, _ := n.(int)
+	t.counts.Add(p, count+1)
+}
+
+// flagged returns true if p consistently responds with only itself.
+func (t *selfOnlyTracker) flagged(p peer.ID) bool {
+	n, ok := t.counts.Peek(p)
+	return ok && n.(int) >= selfOnlyResponseThreshold
+}
+
+func (t *selfOnlyTracker) peers() []peer.ID {
+	var out []peer.ID
+	for _, k := range t.counts.Keys() {
+		if p := k.(peer.ID); t.flagged(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// isSelfOnlyResponse returns true if the closer peers returned by p only
+// contain p itself.
+func isSelfOnlyResponse(p peer.ID, closer []*peer.AddrInfo) bool {
+	if len(closer) == 0 {
+		return false
+	}
+	for _, c := range closer {
+		if c.ID != p {
+			return false
+		}
+	}
+	return true
+}
+
+// SelfOnlyResponders returns the peers that consistently answer our queries
+// with only themselves as closer peers. These peers are skipped by queries if
+// the PenalizeSelfOnlyResponses option is set.
+func (dht *IpfsDHT) SelfOnlyResponders() []peer.ID {
+	return dht.selfOnly.peers()
+}
@@ -0,0 +1,44 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestSelfOnlyTracker(t *testing.T) {
+	tracker := newSelfOnlyTracker()
+	p := peer.ID("peer")
+	other := peer.ID("other")
+
+	if isSelfOnlyResponse(p, nil) {
+		t.Fatal("an empty response isn't a self-only response")
+	}
+	if isSelfOnlyResponse(p, []*peer.AddrInfo{{ID: p}, {ID: other}}) {
+		t.Fatal("a response with other peers isn't a self-only response")
+	}
+	if !isSelfOnlyResponse(p, []*peer.AddrInfo{{ID: p}}) {
+		t.Fatal("expected a self-only response")
+	}
+
+	for i := 0; i < selfOnlyResponseThreshold-1; i++ {
+		tracker.record(p, true)
+	}
+	// a useful response resets the count.
+	tracker.record(p, false)
+	for i := 0; i < selfOnlyResponseThreshold-1; i++ {
+		tracker.record(p, true)
+	}
+	if tracker.flagged(p) {
+		t.Fatal("didn't expect the peer to be flagged yet")
+	}
+
+	tracker.record(p, true)
+	tracker.record(other, true)
+	if !tracker.flagged(p) {
+		t.Fatal("expected the peer to be flagged")
+	}
+	if peers := tracker.peers(); len(peers) != 1 || peers[0] != p {
+		t.Fatalf("expected only %s to be flagged, got %v", p, peers)
+	}
+}
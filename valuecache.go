@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// valueCache caches the record GetValue selected for each key, see the
+// GetValueCache option.
+type valueCache struct {
+	ttl     time.Duration
+	entries *lru.Cache // key -> *cachedVal
+}
+
+type cachedVal struct {
+	lk         sync.Mutex
+	val        []byte
+	expires    time.Time
+	refreshing bool
+}
+
+func newValueCache(ttl time.Duration, size int) *valueCache {
+	entries, err := lru.New(size)
+	if err != nil {
+		panic(err) //only happens if negative value is passed to lru constructor
+	}
+	return &valueCache{ttl: ttl, entries: entries}
+}
+
+// get returns the unexpired value cached for the key. refresh is true the
+// first time get is called in the last quarter of the entry's lifetime.
+func (c *valueCache) get(key string) (val []byte, refresh bool) {
+	v, ok := c.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*cachedVal)
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	left := time.Until(e.expires)
+	if left <= 0 {
+		return nil, false
+	}
+	if left < c.ttl/4 && !e.refreshing {
+		e.refreshing = true
+		refresh = true
+	}
+	return e.val, refresh
+}
+
+// put caches val for the key.
+func (c *valueCache) put(key string, val []byte) {
+	c.entries.Add(key, &cachedVal{val: val, expires: time.Now().Add(c.ttl)})
+}
+
+// remove drops the value cached for the key.
+func (c *valueCache) remove(key string) {
+	c.entries.Remove(key)
+}
+
+// valueFromCache returns the value cached for the key if it's still valid. If
+// the entry is about to expire, it's refreshed from the network in the
+// background.
+func (dht *IpfsDHT) valueFromCache(key string) []byte {
+	val, refresh := dht.valueCache.get(key)
+	if val == nil {
+		return nil
+	}
+	// records may have expired by their own rules since we cached them.
+	if err := dht.validatorFor(key).Validate(key, val); err != nil {
+		logger.Debugf("dropping invalid cached value for %s: %s", key, err)
+		dht.valueCache.remove(key)
+		return nil
+	}
+	if refresh {
+		go dht.refreshCachedValue(key, val)
+	}
+	return val
+}
+
+// refreshCachedValue looks the key up again and caches whichever of the new
+// and the cached values the validator selects.
+func (dht *IpfsDHT) refreshCachedValue(key string, cached []byte) {
+	ctx, cancel := context.WithTimeout(dht.Context(), revalidateTimeout)
+	defer cancel()
+	val, err := dht.GetValue(ctx, key, NoCache())
+	if err != nil {
+		// the entry expires as usual.
+		logger.Debugf("failed to refresh cached value for %s: %s", key, err)
+		return
+	}
+	if !bytes.Equal(val, cached) {
+		if i, err := dht.validatorFor(key).Select(key, [][]byte{val, cached}); err == nil && i == 1 {
+			val = cached
+		}
+	}
+	dht.valueCache.put(key, val)
+}
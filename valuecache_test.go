@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	u "github.com/ipfs/go-ipfs-util"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+func TestValueCacheExpiry(t *testing.T) {
+	c := newValueCache(100*time.Millisecond, 10)
+	c.put("/v/hello", []byte("world"))
+
+	if val, refresh := c.get("/v/hello"); string(val) != "world" || refresh {
+		t.Fatalf("expected a fresh cached value, got %q (refresh: %t)", val, refresh)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if val, refresh := c.get("/v/hello"); string(val) != "world" || !refresh {
+		t.Fatalf("expected the value to need a refresh, got %q (refresh: %t)", val, refresh)
+	}
+	if _, refresh := c.get("/v/hello"); refresh {
+		t.Fatal("expected a single refresh")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if val, _ := c.get("/v/hello"); val != nil {
+		t.Fatalf("expected the value to expire, got %q", val)
+	}
+}
+
+func TestGetValueCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+	defer a.host.Close()
+	defer b.host.Close()
+
+	a.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	b.Validator.(record.NamespacedValidator)["v"] = testValidator{}
+	a.valueCache = newValueCache(time.Hour, 10)
+	connect(t, ctx, a, b)
+
+	putLocal := func(val string) {
+		t.Helper()
+		rec := record.MakePutRecord("/v/hello", []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		if err := b.putLocal("/v/hello", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getValue := func(opts ...routing.Option) string {
+		t.Helper()
+		ctxT, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		val, err := a.GetValue(ctxT, "/v/hello", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(val)
+	}
+
+	putLocal("valid")
+	if val := getValue(); val != "valid" {
+		t.Fatalf("expected 'valid', got %q", val)
+	}
+
+	putLocal("newer")
+	if val := getValue(); val != "valid" {
+		t.Fatalf("expected the cached value, got %q", val)
+	}
+	if val := getValue(NoCache()); val != "newer" {
+		t.Fatalf("expected the network value, got %q", val)
+	}
+
+	// a refresh doesn't replace the cached value with a worse one.
+	putLocal("valid")
+	a.valueCache.put("/v/hello", []byte("newer"))
+	a.refreshCachedValue("/v/hello", []byte("newer"))
+	if val, _ := a.valueCache.get("/v/hello"); string(val) != "newer" {
+		t.Fatalf("expected the refresh to keep 'newer', got %q", val)
+	}
+
+	// invalid cached values are dropped.
+	a.valueCache.put("/v/hello", []byte("expired"))
+	if val := getValue(); val != "valid" {
+		t.Fatalf("expected the network value, got %q", val)
+	}
+}